@@ -0,0 +1,131 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A Format is the markup language of the documents processed.
+type Format int
+
+const (
+	// Markdown documents have [embedmd]:# commands, which generate code blocks
+	// delimited by ``` fences.
+	Markdown Format = iota
+
+	// AsciiDoc documents have // embedmd: comments as commands, such as
+	// // embedmd:(code.go), which generate [source,go] listing blocks
+	// delimited by ---- lines.
+	AsciiDoc
+)
+
+// WithFormat sets the format of the documents processed, which is Markdown
+// unless given. In AsciiDoc the commands take the same arguments, but images,
+// indexes, tabs, anchors, collapsed blocks and source links are not supported,
+// since they generate markdown or HTML.
+func WithFormat(f Format) Option {
+	return Option{func(e *embedder) { e.format = f }}
+}
+
+// asciidocPrefix starts the command lines in AsciiDoc unless WithCommandPrefix
+// is used.
+const asciidocPrefix = "// embedmd:"
+
+// listingDelimiter opens and closes the listing blocks generated in AsciiDoc,
+// unless their content has a line equal to it.
+const listingDelimiter = "----"
+
+// isListingDelimiter reports whether the line opens or closes an AsciiDoc
+// listing block, which is made of four or more hyphens.
+func isListingDelimiter(line string) bool {
+	return strings.HasPrefix(line, listingDelimiter) && strings.Trim(line, "-") == ""
+}
+
+// isSourceAttributes reports whether the line has the attributes of an
+// AsciiDoc source block, such as [source,go], which go before its delimiter.
+func isSourceAttributes(line string) bool {
+	return strings.HasPrefix(line, "[source") && strings.HasSuffix(line, "]")
+}
+
+// checkFormat returns an error if cmd generates something that cannot be
+// written in the format of the documents processed.
+func (e *embedder) checkFormat(cmd *command) error {
+	if e.format != AsciiDoc {
+		return nil
+	}
+	switch {
+	case cmd.image:
+		return fmt.Errorf("the image flag is only supported in markdown")
+	case cmd.index:
+		return fmt.Errorf("the index flag is only supported in markdown")
+	case cmd.anchor != "" || e.anchors != nil:
+		return fmt.Errorf("anchors are only supported in markdown")
+	case e.sourceLinks && isURL(cmd.path):
+		return fmt.Errorf("source links are only supported in markdown")
+	case cmd.collapse:
+		return fmt.Errorf("the collapse flag is only supported in markdown")
+	}
+	return nil
+}
+
+// codeFence returns the fence of a markdown code block with the content b,
+// which has three backticks unless the content has a run of as many, in which
+// case it has one more than the longest run, as CommonMark requires.
+func codeFence(b []byte) string {
+	longest, run := 0, 0
+	for _, c := range b {
+		if c != '`' {
+			run = 0
+			continue
+		}
+		if run++; run > longest {
+			longest = run
+		}
+	}
+	if longest < 3 {
+		return "```"
+	}
+	return strings.Repeat("`", longest+1)
+}
+
+// writeBlock writes the code block generated by cmd with the given language and
+// content in the format of the documents processed, keeping the attributes of
+// the block it replaces. A newline is added to the content if it doesn't end
+// with one, so the closing delimiter goes in its own line, and the delimiters
+// are made longer than any in the content, so it never closes the block.
+func (e *embedder) writeBlock(w io.Writer, cmd *command, lang string, b []byte) {
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		// limit the capacity so the content given is never overwritten.
+		b = append(b[:len(b):len(b)], '\n')
+	}
+	close := codeFence(b)
+	open := close + lang + cmd.attrs
+	if e.format == AsciiDoc {
+		close = listingDelimiter
+		for bytes.HasPrefix(b, []byte(close+"\n")) || bytes.Contains(b, []byte("\n"+close+"\n")) {
+			close += "-"
+		}
+		open = "[source]\n" + close
+		if lang != "" {
+			open = "[source," + lang + cmd.attrs + "]\n" + close
+		}
+	}
+	fmt.Fprintln(w, open)
+	w.Write(b)
+	fmt.Fprintln(w, close)
+}
@@ -0,0 +1,205 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const adocIn = `= Hello
+
+Some text.
+
+// embedmd:(code.go /func main/ $)
+
+[embedmd]:# (code.go)
+
+----
+// embedmd:(ignored.go)
+----
+`
+
+const adocOut = `= Hello
+
+Some text.
+
+// embedmd:(code.go /func main/ $)
+[source,go]
+----
+func main() {
+        fmt.Println("hello, test")
+}
+----
+
+[embedmd]:# (code.go)
+
+----
+// embedmd:(ignored.go)
+----
+`
+
+func TestCodeFence(t *testing.T) {
+	tc := []struct{ in, out string }{
+		{"plain code\n", "```"},
+		{"inline `code` and ``more``\n", "```"},
+		{"```go\ncode\n```\n", "````"},
+		{"a ````` run\n", "``````"},
+		{"~~~\ntildes\n~~~\n", "```"},
+	}
+	for _, tt := range tc {
+		if got := codeFence([]byte(tt.in)); got != tt.out {
+			t.Errorf("fence for %q: expected %s; got %s", tt.in, tt.out, got)
+		}
+	}
+}
+
+func TestAsciiDoc(t *testing.T) {
+	tc := []struct {
+		name  string
+		in    string
+		files map[string][]byte
+		opts  []Option
+		out   string
+		err   string
+	}{
+		{
+			name:  "generating listing blocks",
+			in:    adocIn,
+			files: map[string][]byte{"code.go": []byte(content)},
+			out:   adocOut,
+		},
+		{
+			name:  "regenerating listing blocks",
+			in:    adocOut,
+			files: map[string][]byte{"code.go": []byte(content)},
+			out:   adocOut,
+		},
+		{
+			name: "updating a listing block",
+			in: "// embedmd:(hello.txt)\n" +
+				"[source,txt]\n" +
+				"------\n" +
+				"old\n" +
+				"----\n" +
+				"------\n" +
+				"Yay!\n",
+			files: map[string][]byte{"hello.txt": []byte("hello\n")},
+			out: "// embedmd:(hello.txt)\n" +
+				"[source,txt]\n" +
+				"----\n" +
+				"hello\n" +
+				"----\n" +
+				"Yay!\n",
+		},
+		{
+			name: "keeping the attributes of a listing block",
+			in: "// embedmd:(hello.txt)\n" +
+				"[source,text,linenums]\n" +
+				"----\n" +
+				"old\n" +
+				"----\n",
+			files: map[string][]byte{"hello.txt": []byte("hello\n")},
+			out: "// embedmd:(hello.txt)\n" +
+				"[source,txt,linenums]\n" +
+				"----\n" +
+				"hello\n" +
+				"----\n",
+		},
+		{
+			name:  "content with listing delimiters",
+			in:    "// embedmd:(doc.adoc asciidoc)\n",
+			files: map[string][]byte{"doc.adoc": []byte("----\ncode\n----\n-----")},
+			out: "// embedmd:(doc.adoc asciidoc)\n" +
+				"[source,asciidoc]\n" +
+				"------\n" +
+				"----\ncode\n----\n-----\n" +
+				"------\n",
+		},
+		{
+			name: "a caption before the attributes",
+			in: "// embedmd:(hello.txt)\n" +
+				".old.txt\n" +
+				"[source,txt]\n" +
+				"----\n" +
+				"old\n" +
+				"----\n",
+			files: map[string][]byte{"hello.txt": []byte("hello\n")},
+			opts:  []Option{WithCaption(".{path}")},
+			out: "// embedmd:(hello.txt)\n" +
+				".hello.txt\n" +
+				"[source,txt]\n" +
+				"----\n" +
+				"hello\n" +
+				"----\n",
+		},
+		{
+			name:  "a custom prefix",
+			in:    "//embed:(hello.txt)\n// embedmd:(hello.txt)\n",
+			files: map[string][]byte{"hello.txt": []byte("hello\n")},
+			opts:  []Option{WithCommandPrefix("//embed:")},
+			out: "//embed:(hello.txt)\n" +
+				"[source,txt]\n" +
+				"----\n" +
+				"hello\n" +
+				"----\n" +
+				"// embedmd:(hello.txt)\n",
+		},
+		{
+			name:  "unbalanced listing block",
+			in:    "// embedmd:(hello.txt)\n----\nold\n",
+			files: map[string][]byte{"hello.txt": []byte("hello\n")},
+			err:   "3: unbalanced code section",
+		},
+		{
+			name:  "images",
+			in:    "// embedmd:(logo.png image)\n",
+			files: map[string][]byte{"logo.png": []byte("PNG")},
+			err:   "1: the image flag is only supported in markdown",
+		},
+		{
+			name:  "anchors",
+			in:    "// embedmd:(hello.txt)\n",
+			files: map[string][]byte{"hello.txt": []byte("hello\n")},
+			opts:  []Option{WithAnchors()},
+			err:   "1: anchors are only supported in markdown",
+		},
+		{
+			name:  "collapsed blocks",
+			in:    "// embedmd:(hello.txt collapse)\n",
+			files: map[string][]byte{"hello.txt": []byte("hello\n")},
+			err:   "1: the collapse flag is only supported in markdown",
+		},
+		{
+			name: "tabs",
+			in:   "// embedmd:(tabs)\n// embedmd:(hello.txt)\n// embedmd:(/tabs)\n",
+			err:  "1: groups of tabs are only supported in markdown",
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			opts := append([]Option{WithFetcher(fakeFileProvider(tt.files)), WithFormat(AsciiDoc)}, tt.opts...)
+			err := Process(&out, strings.NewReader(tt.in), opts...)
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			if tt.out != out.String() {
+				t.Errorf("case [%s]: expected output:\n###\n%s\n###; got###\n%s\n###", tt.name, tt.out, out.String())
+			}
+		})
+	}
+}
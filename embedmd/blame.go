@@ -0,0 +1,101 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// blame returns a summary of git blame for the file at path, restricted to
+// the lines from start to end if start is not zero. Each line of the summary
+// gives a range of lines, the commit that last changed them and its author.
+func blame(path string, start, end int) ([]byte, error) {
+	if _, inRepo := gitTracked(path); !inRepo {
+		return nil, fmt.Errorf("%s is not in a git repository", filepath.ToSlash(path))
+	}
+	dir, file := filepath.Split(path)
+	args := []string{"blame", "--porcelain"}
+	if start > 0 {
+		args = append(args, "-L", fmt.Sprintf("%d,%d", start, end))
+	}
+	cmd := exec.Command(gitCommand, append(args, "--", file)...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+	return summarizeBlame(out), nil
+}
+
+// summarizeBlame turns the porcelain output of git blame into one line per
+// range of contiguous lines last changed by the same commit.
+func summarizeBlame(porcelain []byte) []byte {
+	type hunk struct {
+		sha        string
+		start, end int
+	}
+	var hunks []hunk
+	authors := make(map[string]string)
+
+	s := bufio.NewScanner(bytes.NewReader(porcelain))
+	sha := ""
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "\t") {
+			continue // the content of the line.
+		}
+		if v := strings.TrimPrefix(line, "author "); v != line {
+			if _, ok := authors[sha]; !ok {
+				authors[sha] = v
+			}
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) < 3 || len(f[0]) != 40 {
+			continue // other information about the commit.
+		}
+		n, err := strconv.Atoi(f[2])
+		if err != nil {
+			continue
+		}
+		sha = f[0]
+		if last := len(hunks) - 1; last >= 0 && hunks[last].sha == sha && hunks[last].end == n-1 {
+			hunks[last].end = n
+			continue
+		}
+		hunks = append(hunks, hunk{sha, n, n})
+	}
+
+	var b bytes.Buffer
+	for _, h := range hunks {
+		lines := fmt.Sprintf("L%d-L%d", h.start, h.end)
+		if h.start == h.end {
+			lines = fmt.Sprintf("L%d", h.start)
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", lines, h.sha[:7], authors[h.sha])
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,252 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const porcelain = `1111111111111111111111111111111111111111 1 1 2
+author Jane Doe
+author-mail <jane@example.com>
+summary first
+filename code.go
+	package main
+1111111111111111111111111111111111111111 2 2
+	
+2222222222222222222222222222222222222222 3 3 1
+author John Doe
+summary second
+filename code.go
+	func main() {}
+1111111111111111111111111111111111111111 4 4 1
+	// end
+`
+
+func TestSummarizeBlame(t *testing.T) {
+	want := "L1-L2 1111111 Jane Doe\n" +
+		"L3 2222222 John Doe\n" +
+		"L4 1111111 Jane Doe\n"
+	if got := string(summarizeBlame([]byte(porcelain))); got != want {
+		t.Errorf("expected summary %q; got %q", want, got)
+	}
+}
+
+func TestBlame(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Jane Doe", "-c", "user.email=jane@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "code.go"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("init", "-q")
+	git("add", "code.go")
+	git("commit", "-q", "-m", "add code")
+
+	tc := []struct {
+		name       string
+		path       string
+		start, end int
+		out        string
+		err        string
+	}{
+		{name: "whole file",
+			path: "code.go", out: `^L1-L8 [0-9a-f]{7} Jane Doe\n$`},
+		{name: "line range",
+			path: "code.go", start: 2, end: 3, out: `^L2-L3 [0-9a-f]{7} Jane Doe\n$`},
+		{name: "missing file",
+			path: "missing.go", err: "fatal: no such path 'missing.go' in HEAD"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := blame(filepath.Join(dir, tt.path), tt.start, tt.end)
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			if !regexp.MustCompile(tt.out).Match(b) {
+				t.Errorf("case [%s]: expected summary matching %q; got %q", tt.name, tt.out, b)
+			}
+		})
+	}
+
+	noRepo, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(noRepo)
+	_, err = blame(filepath.Join(noRepo, "code.go"), 0, 0)
+	eqErr(t, "not in a repository", err, filepath.ToSlash(noRepo)+"/code.go is not in a git repository")
+}
+
+func TestRefDiff(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Jane Doe", "-c", "user.email=jane@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	commit := func(content, tag string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "api.go"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", "api.go")
+		git("commit", "-q", "-m", tag)
+		git("tag", tag)
+	}
+	git("init", "-q")
+	commit("package api\n\nfunc A() {}\n", "v1.0")
+	commit("package api\n\nfunc A() {}\n\nfunc B() {}\n", "v1.1")
+
+	tc := []struct {
+		name     string
+		from, to string
+		out      string
+		err      string
+	}{
+		{name: "two versions",
+			from: "v1.0", to: "v1.1",
+			out: "--- api.go@v1.0\n+++ api.go@v1.1\n@@ -1,3 +1,5 @@\n package api\n \n func A() {}\n+\n+func B() {}\n"},
+		{name: "same version",
+			from: "v1.1", to: "v1.1"},
+		{name: "unknown ref",
+			from: "v1.0", to: "v2.0",
+			err: "fatal: invalid object name 'v2.0'."},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := refDiff(filepath.Join(dir, "api.go"), "api.go", tt.from, tt.to)
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			if string(b) != tt.out {
+				t.Errorf("case [%s]: expected diff %q; got %q", tt.name, tt.out, b)
+			}
+		})
+	}
+
+	noRepo, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(noRepo)
+	_, err = refDiff(filepath.Join(noRepo, "api.go"), "api.go", "v1.0", "v1.1")
+	eqErr(t, "not in a repository", err, filepath.ToSlash(noRepo)+"/api.go is not in a git repository")
+}
+
+func TestGitPaths(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Jane Doe", "-c", "user.email=jane@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "docs", "old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "docs", "old", "api.go"), []byte("package old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "first")
+	git("tag", "v1.0")
+	git("rm", "-q", "-r", "docs/old")
+	if err := os.MkdirAll(filepath.Join(dir, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	docs := filepath.Join(dir, "docs")
+	tc := []struct {
+		name string
+		path string
+		out  string
+		err  string
+	}{
+		{name: "file removed since",
+			path: "git:v1.0:old/api.go", out: "package old\n"},
+		{name: "unknown ref",
+			path: "git:v2.0:old/api.go", err: "fatal: invalid object name 'v2.0'."},
+		{name: "missing file",
+			path: "git:v1.0:new/api.go", err: "fatal: path 'docs/new/api.go' does not exist in 'v1.0'"},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := fetcher{}.Fetch(docs, tt.path)
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			if string(b) != tt.out {
+				t.Errorf("case [%s]: expected content %q; got %q", tt.name, tt.out, b)
+			}
+		})
+	}
+
+	in := "[embedmd]:# (git:v1.0:old/api.go)\n"
+	var out bytes.Buffer
+	if err := Process(&out, strings.NewReader(in), WithBaseDir(docs), WithExec()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := in + "```go\npackage old\n```\n"; out.String() != want {
+		t.Errorf("expected output %q; got %q", want, out.String())
+	}
+	err = Process(ioutil.Discard, strings.NewReader(in), WithBaseDir(docs))
+	eqErr(t, "without exec", err, "1: could not read git:v1.0:old/api.go: running git is not allowed")
+
+	defer func(git string) { gitCommand = git }(gitCommand)
+	gitCommand = filepath.Join(dir, "missing-git")
+	_, err = fetcher{}.Fetch(docs, "git:v1.0:old/api.go")
+	eqErr(t, "missing git", err, "fork/exec "+gitCommand+": no such file or directory")
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+)
+
+// A Bundle collects the whole content of every source embedded by the
+// processed markdown, so they can be written together as a single markdown
+// file for offline review.
+type Bundle struct {
+	sources map[string]bundled // by resolved path or url.
+}
+
+type bundled struct {
+	lang    string
+	content []byte
+}
+
+// WithBundle adds the sources embedded by the processed commands to b, so the
+// same Bundle can be used to collect them across several calls to Process.
+// Local files are identified by their path joined to the base directory, urls
+// by the url of their raw content, and files on ssh remotes by their path as
+// given, so each source is only added once.
+func WithBundle(b *Bundle) Option {
+	return Option{func(e *embedder) { e.bundle = b }}
+}
+
+// add adds the content of the source at path, unless it was already added.
+func (b *Bundle) add(path, lang string, content []byte) {
+	if b.sources == nil {
+		b.sources = make(map[string]bundled)
+	}
+	if _, ok := b.sources[path]; !ok {
+		b.sources[path] = bundled{lang, content}
+	}
+}
+
+// bundlePath returns the path identifying the source of a command, which is
+// fetched from path in dir.
+func bundlePath(dir, path string) string {
+	if isURL(path) {
+		return rawURL(path)
+	}
+	if isSSHPath(path) {
+		return path
+	}
+	if ref, file, ok := splitGitPath(path); ok {
+		return gitPathPrefix + ref + ":" + filepath.ToSlash(filepath.Join(dir, filepath.FromSlash(file)))
+	}
+	return filepath.ToSlash(filepath.Join(dir, filepath.FromSlash(path)))
+}
+
+// WriteTo writes the collected sources as markdown to w, each in a code block
+// with its path as the heading, sorted by path. The code blocks of sources
+// with code blocks of their own are opened with longer fences.
+func (b *Bundle) WriteTo(w io.Writer) (int64, error) {
+	var paths []string
+	for path := range b.sources {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	for i, path := range paths {
+		if i > 0 {
+			fmt.Fprintln(&buf)
+		}
+		s := b.sources[path]
+		fence := "```"
+		for bytes.HasPrefix(s.content, []byte(fence)) || bytes.Contains(s.content, []byte("\n"+fence)) {
+			fence += "`"
+		}
+		fmt.Fprintf(&buf, "## %s\n\n%s%s\n", path, fence, s.lang)
+		buf.Write(s.content)
+		if len(s.content) > 0 && s.content[len(s.content)-1] != '\n' {
+			fmt.Fprintln(&buf)
+		}
+		fmt.Fprintln(&buf, fence)
+	}
+	return buf.WriteTo(w)
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// cacheVersion changes whenever the content extracted for a command could
+// change, so the entries of previous versions are never used.
+const cacheVersion = 3
+
+// WithCache keeps the content extracted by the commands embedding local files
+// in the given directory, so it's not extracted and transformed again in
+// later runs while the file, the command, and the options stay the same.
+// Entries are keyed by the hash of all of them, and never removed.
+func WithCache(dir string) Option {
+	return Option{func(e *embedder) { e.cache = &cache{dir: dir} }}
+}
+
+// A cache stores the content extracted by commands in files named after the
+// hash of their key.
+type cache struct {
+	dir string
+	// settings describes the options affecting the extracted content.
+	settings string
+}
+
+// cacheSettings describes the options of e affecting the content extracted
+// by commands.
+func (e *embedder) cacheSettings() string {
+	var secrets []string
+	for _, re := range e.secrets {
+		secrets = append(secrets, re.String())
+	}
+	return fmt.Sprintf("%d %v %v %v %v %d %v %v %q %d", cacheVersion, e.pretty, e.sorted,
+		e.trimSpace, e.normalize, e.tabWidth, e.newline, e.exec, secrets, e.wrap)
+}
+
+// transform returns the content extracted by cmd from b as f does, unless it
+// was already in the cache. The language of the content is cached too, since
+// f sets it for commands embedding code blocks with no language given.
+func (c *cache) transform(cmd *command, b []byte, f func(*command, []byte) ([]byte, error)) ([]byte, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", c.settings, cmd)
+	h.Write(b)
+	path := filepath.Join(c.dir, hex.EncodeToString(h.Sum(nil)))
+
+	if entry, err := ioutil.ReadFile(path); err == nil {
+		if i := bytes.IndexByte(entry, '\n'); i >= 0 {
+			if cmd.lang == "" {
+				cmd.lang = string(entry[:i])
+			}
+			return entry[i+1:], nil
+		}
+	}
+
+	out, err := f(cmd, b)
+	if err != nil {
+		return nil, err
+	}
+	// failing to write to the cache only makes the next run slower.
+	if os.MkdirAll(c.dir, 0755) == nil {
+		ioutil.WriteFile(path, append([]byte(cmd.lang+"\n"), out...), 0644)
+	}
+	return out, nil
+}
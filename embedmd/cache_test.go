@@ -0,0 +1,89 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	runs := 0
+	f := func(cmd *command, b []byte) ([]byte, error) {
+		runs++
+		if cmd.lang == "" {
+			cmd.lang = "go"
+		}
+		return bytes.ToUpper(b), nil
+	}
+	c := &cache{dir: filepath.Join(dir, "cache"), settings: "a"}
+	tc := []struct {
+		name     string
+		cmd      string
+		settings string
+		in       string
+		runs     int
+	}{
+		{name: "first run", cmd: "(doc.md fence:1)", settings: "a", in: "code", runs: 1},
+		{name: "same content", cmd: "(doc.md fence:1)", settings: "a", in: "code", runs: 1},
+		{name: "other content", cmd: "(doc.md fence:1)", settings: "a", in: "more code", runs: 2},
+		{name: "other command", cmd: "(doc.md fence:2)", settings: "a", in: "code", runs: 3},
+		{name: "other options", cmd: "(doc.md fence:1)", settings: "b", in: "code", runs: 4},
+	}
+	for _, tt := range tc {
+		cmd, err := parseCommand(tt.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.settings = tt.settings
+		out, err := c.transform(cmd, []byte(tt.in), f)
+		if err != nil {
+			t.Fatalf("case [%s]: unexpected error: %v", tt.name, err)
+		}
+		if want := strings.ToUpper(tt.in); string(out) != want || cmd.lang != "go" {
+			t.Errorf("case [%s]: expected %q in go; got %q in %q", tt.name, want, out, cmd.lang)
+		}
+		if runs != tt.runs {
+			t.Errorf("case [%s]: expected %d runs; got %d", tt.name, tt.runs, runs)
+		}
+	}
+}
+
+func TestCacheSettings(t *testing.T) {
+	settings := func(opts ...Option) string {
+		e := embedder{}
+		for _, opt := range opts {
+			opt.f(&e)
+		}
+		return e.cacheSettings()
+	}
+	if settings() != settings() {
+		t.Errorf("expected the same settings for the same options")
+	}
+	for _, opt := range []Option{WithPrettyPrint("json"), WithTrimTrailingSpace(true), WithExpandLeadingTabs(4), WithRedact(nil)} {
+		if settings() == settings(opt) {
+			t.Errorf("expected different settings for %v", opt)
+		}
+	}
+}
@@ -15,21 +15,152 @@ package embedmd
 
 import (
 	"errors"
+	"fmt"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 type command struct {
+	// line is the line of the command in the markdown.
+	line int
+
 	path, lang string
 	start, end *string
+
+	// startLine and endLine, if not zero, delimit the lines to embed.
+	startLine, endLine int
+
+	// fence, if not zero, selects the code block of a markdown file to embed,
+	// counting from one.
+	fence int
+
+	// firstLines, if not empty, is a regular expression selecting the first
+	// line of each of its matches.
+	firstLines string
+
+	// stripLicense removes the license header at the top of the content.
+	stripLicense bool
+
+	// stripShebang removes the shebang line at the top of the content.
+	stripShebang bool
+
+	// noTrim and rawIndent keep the trailing whitespace and the leading tabs
+	// of the content, overriding WithTrimTrailingSpace and
+	// WithExpandLeadingTabs for this command.
+	noTrim, rawIndent bool
+
+	// numbered prefixes each line with its number in the source file.
+	numbered bool
+
+	// wrap, if not zero, is the width at which long lines are wrapped,
+	// overriding WithWrap for this command.
+	wrap int
+
+	// collapse wraps the generated code block in a <details> element with the
+	// given summary, or the path if it's empty.
+	collapse bool
+	summary  string
+
+	// anchor, if not empty, is the id of the anchor before the code block.
+	anchor string
+
+	// sink, if not empty, names the sink receiving the generated code block
+	// instead of the markdown.
+	sink string
+
+	// exported embeds the exported declarations in a Go file, omitting the
+	// function bodies if noBodies is set.
+	exported, noBodies bool
+
+	// funcName, if not empty, names the function or method whose declaration
+	// is embedded from a Go file, as given with func:name.
+	funcName string
+
+	// docPath, if not empty, is the argument selecting the sub-document to
+	// embed from a JSON or YAML file, as in jsonpath:$.paths, whose steps are
+	// held in docKeys.
+	docPath string
+	docKeys []pathKey
+
+	// extractor, if not empty, names the program extracting the content to
+	// embed, which is passed extractorArgs.
+	extractor     string
+	extractorArgs []string
+
+	// blame embeds a summary of git blame for the file instead of its content.
+	blame bool
+
+	// diffFrom and diffTo, if not empty, are the git refs whose versions of the
+	// file are compared, embedding their differences instead of its content.
+	diffFrom, diffTo string
+
+	// index generates a list of the markdown files in the directory at path.
+	index bool
+
+	// tree embeds a listing of the files in the directory at path, up to
+	// depth levels deep if not zero, including hidden files if hidden is set.
+	tree   bool
+	depth  int
+	hidden bool
+
+	// goTool, if not empty, is the go command, vet or build, whose output on
+	// the package at path is embedded.
+	goTool string
+
+	// image embeds the file as an image inlined with a data URI.
+	image bool
+
+	// run, if not empty, holds the program and arguments whose output is
+	// embedded, as given with exec:, and path holds them joined by spaces.
+	run []string
+
+	// expectLines and expectSHA, if set, are the number of lines and a prefix
+	// of the hex encoded SHA-256 hash the embedded content must have.
+	expectLines int
+	expectSHA   string
+
+	// strip holds the regular expressions matching the lines removed from the
+	// embedded content, as given with strip=/re/.
+	strip []string
+
+	// grep and grepV hold the regular expressions the lines of the selected
+	// content must match, and must not, to be embedded, as given with
+	// grep=/re/ and grep-v=/re/.
+	grep, grepV []string
+
+	// attrs holds the attributes that followed the language of the code block
+	// found after the command, such as {.line-numbers} in ```go {.line-numbers},
+	// which are kept in the one generated.
+	attrs string
 }
 
-func parseCommand(s string) (*command, error) {
+// errNoLang is returned for commands embedding a file with no extension, and
+// thus no language, unless a language is given or it's a well-known file,
+// such as a Dockerfile, or a script with a shebang line.
+var errNoLang = errors.New("language is required when file has no extension")
+
+func parseCommand(s string) (*command, error) { return parseCommandLang(s, false, nil) }
+
+// parseCommandLang parses a command like parseCommand, but the language of the
+// files whose name is in names is the one given there, and if guess is set
+// the language of the files with no extension, or known name, is left empty,
+// to be found once their content is fetched.
+func parseCommandLang(s string, guess bool, names map[string]string) (*command, error) {
 	s = strings.TrimSpace(s)
 	if len(s) < 2 || s[0] != '(' || s[len(s)-1] != ')' {
 		return nil, errors.New("argument list should be in parenthesis")
 	}
 
+	// the arguments after exec: are the ones of the program, taken as they are.
+	if inner := strings.TrimSpace(s[1 : len(s)-1]); strings.HasPrefix(inner, execPrefix) {
+		run := strings.Fields(inner[len(execPrefix):])
+		if len(run) == 0 {
+			return nil, errors.New("missing program to run after exec:")
+		}
+		return &command{path: strings.Join(run, " "), lang: "text", run: run}, nil
+	}
+
 	args, err := fields(s[1 : len(s)-1])
 	if err != nil {
 		return nil, err
@@ -39,15 +170,61 @@ func parseCommand(s string) (*command, error) {
 	}
 
 	cmd := &command{path: args[0]}
-	args = args[1:]
+	args, err = parseFlags(cmd, args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	// URLs such as GitHub permalinks can select lines with a #L10-L20 fragment.
+	if i := strings.LastIndex(cmd.path, "#"); i >= 0 && isURL(cmd.path) {
+		if start, end, err := parseLineRange(cmd.path[i+1:]); err == nil {
+			if cmd.startLine > 0 {
+				return nil, errors.New("only one line range can be given")
+			}
+			cmd.path, cmd.startLine, cmd.endLine = cmd.path[:i], start, end
+		}
+	}
+
+	if cmd.collapse && (cmd.image || cmd.index) {
+		return nil, errors.New("only code blocks can be collapsed")
+	}
+
+	if cmd.goTool != "" {
+		// packages are checked as a whole, with no language.
+		if len(args) > 0 || cmd.startLine > 0 || cmd.firstLines != "" || cmd.image || cmd.blame || cmd.index || cmd.extractor != "" || cmd.fence > 0 || cmd.exported || cmd.numbered {
+			return nil, fmt.Errorf("%s%s only checks a whole package", goToolArg, cmd.goTool)
+		}
+		return cmd, nil
+	}
+
+	if cmd.tree {
+		// directories are listed as a whole, with no language.
+		if len(args) > 0 || cmd.startLine > 0 || cmd.firstLines != "" || cmd.image || cmd.blame || cmd.index || cmd.extractor != "" || cmd.fence > 0 || cmd.exported || cmd.diffFrom != "" || cmd.numbered {
+			return nil, errors.New("tree only lists the files in a directory")
+		}
+		return cmd, nil
+	}
+	if cmd.depth > 0 || cmd.hidden {
+		return nil, errors.New("depth and hidden can only be used with tree")
+	}
+
+	if cmd.index {
+		// directories are indexed as a whole, with no language.
+		if len(args) > 0 || cmd.firstLines != "" || cmd.image || cmd.blame || cmd.extractor != "" || cmd.fence > 0 || cmd.diffFrom != "" || cmd.numbered {
+			return nil, errors.New("index only lists the files in a directory")
+		}
+		return cmd, nil
+	}
+
+	// code blocks of markdown files have their own language, used when none
+	// is given.
 	if len(args) > 0 && args[0][0] != '/' {
 		cmd.lang, args = args[0], args[1:]
-	} else {
-		ext := filepath.Ext(cmd.path[1:])
-		if len(ext) == 0 {
-			return nil, errors.New("language is required when file has no extension")
+	} else if cmd.fence == 0 {
+		cmd.lang = fileLang(cmd.path, names)
+		if cmd.lang == "" && (!guess || cmd.blame) {
+			return nil, errNoLang
 		}
-		cmd.lang = ext[1:]
 	}
 
 	switch {
@@ -55,25 +232,447 @@ func parseCommand(s string) (*command, error) {
 		cmd.start = &args[0]
 	case len(args) == 2:
 		cmd.start, cmd.end = &args[0], &args[1]
+		if *cmd.end == "EOF" {
+			*cmd.end = "$"
+		}
 	case len(args) > 2:
 		return nil, errors.New("too many arguments")
 	}
+	if cmd.end != nil && strings.HasPrefix(*cmd.end, "+") {
+		if _, err := parseLineCount(*cmd.end); err != nil {
+			return nil, err
+		}
+	}
+	if cmd.start != nil && cmd.startLine > 0 {
+		return nil, errors.New("line ranges cannot be combined with regexps")
+	}
+	if cmd.extractor != "" && (cmd.start != nil || cmd.startLine > 0 || cmd.firstLines != "" || cmd.blame || cmd.image) {
+		return nil, errors.New("ext cannot be combined with other ways of selecting content")
+	}
+	if cmd.exported && (cmd.start != nil || cmd.startLine > 0 || cmd.firstLines != "" || cmd.blame || cmd.image || cmd.extractor != "") {
+		return nil, errors.New("#exported cannot be combined with other ways of selecting content")
+	}
+	if cmd.funcName != "" && (cmd.start != nil || cmd.startLine > 0 || cmd.firstLines != "" || cmd.blame || cmd.image || cmd.extractor != "" || cmd.exported || cmd.fence > 0) {
+		return nil, errors.New("func: cannot be combined with other ways of selecting content")
+	}
+	if cmd.docPath != "" && (cmd.start != nil || cmd.startLine > 0 || cmd.firstLines != "" || cmd.blame || cmd.image || cmd.extractor != "" || cmd.exported || cmd.funcName != "" || cmd.numbered) {
+		return nil, fmt.Errorf("%s cannot be combined with other ways of selecting content", cmd.docPath[:strings.IndexByte(cmd.docPath, ':')+1])
+	}
+	if cmd.noBodies && !cmd.exported {
+		return nil, errors.New("no-bodies can only be used with #exported")
+	}
+	if cmd.firstLines != "" && (cmd.start != nil || cmd.startLine > 0) {
+		return nil, errors.New("firstlines cannot be combined with other ways of selecting content")
+	}
+	if cmd.fence > 0 && (cmd.blame || cmd.image) {
+		return nil, errors.New("fence cannot be combined with blame or image")
+	}
+	if cmd.diffFrom != "" && (cmd.start != nil || cmd.startLine > 0 || cmd.firstLines != "" || cmd.image || cmd.blame || cmd.extractor != "" || cmd.exported || cmd.funcName != "" || cmd.docPath != "" || cmd.fence > 0 || cmd.numbered) {
+		return nil, errors.New("diff only compares whole files")
+	}
+	if cmd.numbered && (cmd.extractor != "" || cmd.exported || cmd.firstLines != "" || cmd.fence > 0 || cmd.stripLicense || len(cmd.strip) > 0 || len(cmd.grep) > 0 || len(cmd.grepV) > 0 || cmd.blame || cmd.image) {
+		return nil, errors.New("numbered only supports whole files, regexps and line ranges")
+	}
+	if cmd.blame && (cmd.start != nil || cmd.firstLines != "" || cmd.image) {
+		return nil, errors.New("blame only supports whole files or line ranges")
+	}
+	if cmd.image && (cmd.start != nil || cmd.startLine > 0 || cmd.firstLines != "" || len(cmd.strip) > 0 || len(cmd.grep) > 0 || len(cmd.grepV) > 0 || cmd.wrap > 0) {
+		return nil, errors.New("images are embedded whole")
+	}
 
 	return cmd, nil
 }
 
-// fields returns a list of the groups of text separated by blanks,
-// keeping all text surrounded by / as a group.
+// extLang returns the language implied by the extension of the file at path,
+// or an empty string if it has none.
+func extLang(path string) string {
+	ext := filepath.Ext(path[1:])
+	if len(ext) == 0 {
+		return ""
+	}
+	return ext[1:]
+}
+
+// String returns the argument list of the command in its canonical form, with
+// single spaces between the arguments, the language only if it differs from
+// the one implied by the file name or extension, and the flags in a fixed
+// order.
+func (cmd *command) String() string {
+	if len(cmd.run) > 0 {
+		return "(" + execPrefix + " " + strings.Join(cmd.run, " ") + ")"
+	}
+	// only urls keep their line range as a fragment, as in GitHub permalinks.
+	args := []string{cmd.path}
+	if isURL(cmd.path) {
+		args[0] += cmd.lineRange()
+	}
+	if cmd.lang != "" && (cmd.lang != fileLang(cmd.path, nil) || cmd.fence > 0) {
+		args = append(args, cmd.lang)
+	}
+	if !isURL(cmd.path) && cmd.startLine > 0 {
+		args = append(args, cmd.lineRange())
+	}
+	if cmd.fence > 0 {
+		args = append(args, fmt.Sprintf("fence:%d", cmd.fence))
+	}
+	if cmd.funcName != "" {
+		args = append(args, funcArg+cmd.funcName)
+	}
+	if cmd.docPath != "" {
+		args = append(args, cmd.docPath)
+	}
+	if cmd.start != nil {
+		args = append(args, *cmd.start)
+	}
+	if cmd.end != nil {
+		args = append(args, *cmd.end)
+	}
+	if cmd.firstLines != "" {
+		args = append(args, firstLinesArg+cmd.firstLines)
+	}
+	for _, re := range cmd.grep {
+		args = append(args, grepArg+re)
+	}
+	for _, re := range cmd.grepV {
+		args = append(args, grepVArg+re)
+	}
+	for _, re := range cmd.strip {
+		args = append(args, stripArg+re)
+	}
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{cmd.stripLicense, "strip-license"},
+		{cmd.stripShebang, "strip-shebang"},
+		{cmd.noTrim, "no-trim"},
+		{cmd.rawIndent, "raw-indent"},
+		{cmd.numbered, "numbered"},
+		{cmd.exported, "#exported"},
+		{cmd.noBodies, "no-bodies"},
+		{cmd.image, "image"},
+		{cmd.blame, "blame"},
+		{cmd.index, "index"},
+		{cmd.tree, "tree"},
+		{cmd.hidden, "hidden"},
+	} {
+		if f.set {
+			args = append(args, f.name)
+		}
+	}
+	if cmd.depth > 0 {
+		args = append(args, fmt.Sprintf("depth=%d", cmd.depth))
+	}
+	if cmd.wrap > 0 {
+		args = append(args, fmt.Sprintf("wrap=%d", cmd.wrap))
+	}
+	switch {
+	case cmd.summary != "":
+		args = append(args, collapseArg+`"`+cmd.summary+`"`)
+	case cmd.collapse:
+		args = append(args, "collapse")
+	}
+	if cmd.goTool != "" {
+		args = append(args, goToolArg+cmd.goTool)
+	}
+	if cmd.diffFrom != "" {
+		args = append(args, diffArg+cmd.diffFrom+".."+cmd.diffTo)
+	}
+	if cmd.anchor != "" {
+		args = append(args, "anchor="+cmd.anchor)
+	}
+	if cmd.sink != "" {
+		args = append(args, "sink="+cmd.sink)
+	}
+	if cmd.expectLines > 0 {
+		args = append(args, fmt.Sprintf("expect-lines=%d", cmd.expectLines))
+	}
+	if cmd.expectSHA != "" {
+		args = append(args, "expect-sha="+cmd.expectSHA)
+	}
+	// the arguments after the extractor are its own, so it goes last.
+	if cmd.extractor != "" {
+		args = append(append(args, extractorArg+cmd.extractor), cmd.extractorArgs...)
+	}
+	return "(" + strings.Join(args, " ") + ")"
+}
+
+// firstLinesArg prefixes the regular expression of a firstlines argument, as
+// in firstlines:/^func/.
+const firstLinesArg = "firstlines:"
+
+// funcArg prefixes the name of the function or method to embed from a Go
+// file, as in func:main or func:(*Server).Serve.
+const funcArg = "func:"
+
+// stripArg prefixes the regular expression matching the lines to remove, as
+// in strip=/^\/\/go:build/.
+const stripArg = "strip="
+
+// grepArg and grepVArg prefix the regular expressions that the embedded lines
+// must match, and must not, as in grep=/^export / or grep-v=/^#/.
+const (
+	grepArg  = "grep="
+	grepVArg = "grep-v="
+)
+
+// extractorArg prefixes the name of the extractor program, as in ext:name.
+const extractorArg = "ext:"
+
+// diffArg prefixes the git refs whose versions of a file are compared, as in
+// diff:v1.0..v1.1.
+const diffArg = "diff:"
+
+// goToolArg prefixes the go command checking a package, as in go:vet.
+const goToolArg = "go:"
+
+// parseFlags sets the fields of cmd corresponding to the flags in args, which
+// can appear in any position after the path, and returns the other arguments.
+// All the arguments after an extractor are passed to it.
+func parseFlags(cmd *command, args []string) ([]string, error) {
+	var rest []string
+	for i, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, extractorArg):
+			cmd.extractor, cmd.extractorArgs = arg[len(extractorArg):], args[i+1:]
+			if cmd.extractor == "" || strings.ContainsAny(cmd.extractor, `/\`) {
+				return nil, fmt.Errorf("bad extractor name in %q", arg)
+			}
+			return rest, nil
+		case strings.HasPrefix(arg, "#L"):
+			if cmd.startLine > 0 {
+				return nil, errors.New("only one line range can be given")
+			}
+			start, end, err := parseLineRange(arg[1:])
+			if err != nil {
+				return nil, fmt.Errorf("bad line range in %q, expected #L10-L20 or #L10", arg)
+			}
+			cmd.startLine, cmd.endLine = start, end
+		case arg == "strip-license":
+			cmd.stripLicense = true
+		case arg == "strip-shebang":
+			cmd.stripShebang = true
+		case arg == "no-trim":
+			cmd.noTrim = true
+		case arg == "raw-indent":
+			cmd.rawIndent = true
+		case arg == "numbered":
+			cmd.numbered = true
+		case arg == "collapse":
+			cmd.collapse = true
+		case strings.HasPrefix(arg, collapseArg):
+			summary := arg[len(collapseArg):]
+			if len(summary) >= 2 && summary[0] == '"' && summary[len(summary)-1] == '"' {
+				summary = summary[1 : len(summary)-1]
+			}
+			if strings.TrimSpace(summary) == "" {
+				return nil, fmt.Errorf("missing summary in %q", arg)
+			}
+			cmd.collapse, cmd.summary = true, summary
+		case arg == "image":
+			cmd.image = true
+		case arg == "#exported":
+			cmd.exported = true
+		case arg == "no-bodies":
+			cmd.noBodies = true
+		case arg == "blame":
+			cmd.blame = true
+		case arg == "index":
+			cmd.index = true
+		case arg == "tree":
+			cmd.tree = true
+		case arg == "hidden":
+			cmd.hidden = true
+		case strings.HasPrefix(arg, "depth="):
+			n, err := strconv.Atoi(arg[len("depth="):])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("bad depth in %q", arg)
+			}
+			cmd.depth = n
+		case strings.HasPrefix(arg, diffArg):
+			refs := strings.SplitN(arg[len(diffArg):], "..", 2)
+			if len(refs) != 2 || !isRef(refs[0]) || !isRef(refs[1]) {
+				return nil, fmt.Errorf("bad git refs in %q, expected diff:from..to", arg)
+			}
+			cmd.diffFrom, cmd.diffTo = refs[0], refs[1]
+		case strings.HasPrefix(arg, goToolArg):
+			cmd.goTool = arg[len(goToolArg):]
+			if _, ok := goToolArgs[cmd.goTool]; !ok {
+				return nil, fmt.Errorf("bad go command in %q, only vet and build are supported", arg)
+			}
+		case strings.HasPrefix(arg, firstLinesArg):
+			cmd.firstLines = arg[len(firstLinesArg):]
+		case strings.HasPrefix(arg, jsonPathArg) || strings.HasPrefix(arg, yamlPathArg):
+			if cmd.docPath != "" {
+				return nil, errors.New("only one path can be given")
+			}
+			keys, err := parseDocPath(arg)
+			if err != nil {
+				return nil, fmt.Errorf("bad path in %q: %v", arg, err)
+			}
+			cmd.docPath, cmd.docKeys = arg, keys
+		case strings.HasPrefix(arg, funcArg):
+			cmd.funcName = arg[len(funcArg):]
+			if cmd.funcName == "" {
+				return nil, fmt.Errorf("bad function name in %q", arg)
+			}
+		case strings.HasPrefix(arg, stripArg):
+			cmd.strip = append(cmd.strip, arg[len(stripArg):])
+		case strings.HasPrefix(arg, grepArg):
+			cmd.grep = append(cmd.grep, arg[len(grepArg):])
+		case strings.HasPrefix(arg, grepVArg):
+			cmd.grepV = append(cmd.grepV, arg[len(grepVArg):])
+		case strings.HasPrefix(arg, "anchor="):
+			cmd.anchor = arg[len("anchor="):]
+			if cmd.anchor == "" || strings.Trim(cmd.anchor, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_") != "" {
+				return nil, fmt.Errorf("bad anchor in %q", arg)
+			}
+		case strings.HasPrefix(arg, "fence:"):
+			n, err := strconv.Atoi(arg[len("fence:"):])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("bad code block number in %q", arg)
+			}
+			cmd.fence = n
+		case strings.HasPrefix(arg, "sink="):
+			cmd.sink = arg[len("sink="):]
+			if cmd.sink == "" {
+				return nil, errors.New("missing sink name")
+			}
+		case strings.HasPrefix(arg, "wrap="):
+			n, err := strconv.Atoi(arg[len("wrap="):])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("bad width in %q", arg)
+			}
+			cmd.wrap = n
+		case strings.HasPrefix(arg, "expect-lines="):
+			n, err := strconv.Atoi(arg[len("expect-lines="):])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("bad number of lines in %q", arg)
+			}
+			cmd.expectLines = n
+		case strings.HasPrefix(arg, "expect-sha="):
+			sum := strings.ToLower(arg[len("expect-sha="):])
+			if sum == "" || strings.Trim(sum, "0123456789abcdef") != "" {
+				return nil, fmt.Errorf("bad hash in %q", arg)
+			}
+			cmd.expectSHA = sum
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return rest, nil
+}
+
+// isRef reports whether s can be a git ref, such as a tag or a commit, which
+// is never mistaken for an option of git.
+func isRef(s string) bool {
+	return s != "" && !strings.HasPrefix(s, "-") && !strings.Contains(s, ":") && !strings.Contains(s, "..")
+}
+
+// gitPathPrefix starts the paths of files in a git ref, as in git:v1.0:api.go.
+const gitPathPrefix = "git:"
+
+// splitGitPath splits a path like git:ref:file into the git ref and the path
+// of the file, which is relative to the markdown file.
+func splitGitPath(path string) (ref, file string, ok bool) {
+	if !strings.HasPrefix(path, gitPathPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(path[len(gitPathPrefix):], ":", 2)
+	if len(parts) != 2 || !isRef(parts[0]) || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// lineRange returns the lines selected by the command in the format used by
+// GitHub, such as #L10-L20 or #L10, or an empty string if there are none.
+func (cmd *command) lineRange() string {
+	switch {
+	case cmd.startLine == 0:
+		return ""
+	case cmd.startLine == cmd.endLine:
+		return fmt.Sprintf("#L%d", cmd.startLine)
+	default:
+		return fmt.Sprintf("#L%d-L%d", cmd.startLine, cmd.endLine)
+	}
+}
+
+// parseLineRange parses line ranges with the format used by GitHub, such as
+// L10-L20 for lines 10 to 20 or L10 for line 10 alone.
+func parseLineRange(s string) (start, end int, err error) {
+	from, to := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+	line := func(s string) (int, error) {
+		if len(s) < 2 || s[0] != 'L' {
+			return 0, fmt.Errorf("bad line number %q", s)
+		}
+		n, err := strconv.Atoi(s[1:])
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("bad line number %q", s)
+		}
+		return n, nil
+	}
+	if start, err = line(from); err != nil {
+		return 0, 0, err
+	}
+	if end, err = line(to); err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// fields returns a list of the groups of text separated by blanks, keeping
+// all text surrounded by / and the flags and occurrence index after it as a
+// group, as well as arguments such as firstlines, strip, or grep followed by
+// text surrounded by /.
 func fields(s string) ([]string, error) {
 	var args []string
 
 	for s = strings.TrimSpace(s); len(s) > 0; s = strings.TrimSpace(s) {
-		if s[0] == '/' {
-			sep := nextSlash(s[1:])
+		// summaries can be quoted to have spaces, as in collapse="Show code".
+		if strings.HasPrefix(s, collapseArg+`"`) {
+			end := strings.IndexByte(s[len(collapseArg)+1:], '"')
+			if end < 0 {
+				return nil, errors.New("unbalanced \" in summary")
+			}
+			end += len(collapseArg) + 2
+			args, s = append(args, s[:end]), s[end:]
+			continue
+		}
+		prefix := 0
+		for _, arg := range []string{firstLinesArg, stripArg, grepArg, grepVArg} {
+			if strings.HasPrefix(s, arg+"/") {
+				prefix = len(arg)
+			}
+		}
+		// paths starting with // are not regular expressions.
+		if s[prefix] == '/' && !strings.HasPrefix(s, "//") {
+			sep := nextSlash(s[prefix+1:])
 			if sep < 0 {
 				return nil, errors.New("unbalanced /")
 			}
-			args, s = append(args, s[:sep+2]), s[sep+2:]
+			// the regular expression can be followed by flags.
+			end := prefix + sep + 2
+			for end < len(s) && 'a' <= s[end] && s[end] <= 'z' {
+				end++
+			}
+			// and by an occurrence index, with or without brackets.
+			if end < len(s) && s[end] == '[' {
+				if i := strings.IndexByte(s[end:], ']'); i > 0 {
+					end += i + 1
+				}
+			}
+			for end < len(s) && '0' <= s[end] && s[end] <= '9' {
+				end++
+			}
+			args, s = append(args, s[:end]), s[end:]
 		} else {
 			sep := strings.IndexByte(s[1:], ' ')
 			if sep < 0 {
@@ -13,7 +13,10 @@
 
 package embedmd
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+)
 
 func TestParseCommand(t *testing.T) {
 	tc := []struct {
@@ -34,6 +37,9 @@ func TestParseCommand(t *testing.T) {
 		{name: "file with no extension and no lang",
 			in:  "(test)",
 			err: "language is required when file has no extension"},
+		{name: "well-known file with no extension",
+			in:  "(docker/Dockerfile /FROM/)",
+			cmd: command{path: "docker/Dockerfile", lang: "dockerfile", start: ptr("/FROM/")}},
 		{name: "surrounding blanks",
 			in:  "   \t  (code.go)  \t  ",
 			cmd: command{path: "code.go", lang: "go"}},
@@ -46,6 +52,24 @@ func TestParseCommand(t *testing.T) {
 		{name: "regexp not closed",
 			in:  "(code.go /start)",
 			err: "unbalanced /"},
+		{name: "regexps with flags",
+			in:  "(code.go /func main.*}/s /end/s)",
+			cmd: command{path: "code.go", lang: "go", start: ptr("/func main.*}/s"), end: ptr("/end/s")}},
+		{name: "regexps with several flags",
+			in:  "(code.go /^func main/im /^}$/m)",
+			cmd: command{path: "code.go", lang: "go", start: ptr("/^func main/im"), end: ptr("/^}$/m")}},
+		{name: "case-insensitive regexp",
+			in:  "(code.go /todo/i)",
+			cmd: command{path: "code.go", lang: "go", start: ptr("/todo/i")}},
+		{name: "case-insensitive regexp with an escaped slash",
+			in:  `(code.go /docs\/i/i /\.md/)`,
+			cmd: command{path: "code.go", lang: "go", start: ptr(`/docs\/i/i`), end: ptr(`/\.md/`)}},
+		{name: "escaped slash before an i",
+			in:  `(code.go /docs\/i)`,
+			err: "unbalanced /"},
+		{name: "first lines with flags",
+			in:  "(code.go firstlines:/^func.*{/s)",
+			cmd: command{path: "code.go", lang: "go", firstLines: "/^func.*{/s"}},
 		{name: "end regexp not closed",
 			in:  "(code.go /start/ /end)",
 			err: "unbalanced /"},
@@ -58,17 +82,253 @@ func TestParseCommand(t *testing.T) {
 		{name: "using $ as end",
 			in:  "(foo.go /start/ $)",
 			cmd: command{path: "foo.go", lang: "go", start: ptr("/start/"), end: ptr("$")}},
+		{name: "using EOF as end",
+			in:  "(foo.go /start/ EOF)",
+			cmd: command{path: "foo.go", lang: "go", start: ptr("/start/"), end: ptr("$")}},
+		{name: "using blank as end",
+			in:  "(foo.go /start/ blank)",
+			cmd: command{path: "foo.go", lang: "go", start: ptr("/start/"), end: ptr("blank")}},
+		{name: "occurrences",
+			in:  "(slides.md /---/[2] /---/s[3])",
+			cmd: command{path: "slides.md", lang: "md", start: ptr("/---/[2]"), end: ptr("/---/s[3]")}},
+		{name: "occurrences without brackets",
+			in:  "(code.go /func foo/2 /^}/)",
+			cmd: command{path: "code.go", lang: "go", start: ptr("/func foo/2"), end: ptr("/^}/")}},
+		{name: "file named EOF",
+			in:  "(EOF go /start/)",
+			cmd: command{path: "EOF", lang: "go", start: ptr("/start/")}},
+		{name: "strip license",
+			in:  "(foo.go strip-license)",
+			cmd: command{path: "foo.go", lang: "go", stripLicense: true}},
+		{name: "strip shebang",
+			in:  "(run.sh strip-shebang strip-license)",
+			cmd: command{path: "run.sh", lang: "sh", stripShebang: true, stripLicense: true}},
+		{name: "raw content",
+			in:  "(foo.go no-trim /start/ raw-indent)",
+			cmd: command{path: "foo.go", lang: "go", start: ptr("/start/"), noTrim: true, rawIndent: true}},
+		{name: "strip license after the regexps",
+			in:  "(foo.go go /start/ $ strip-license)",
+			cmd: command{path: "foo.go", lang: "go", start: ptr("/start/"), end: ptr("$"), stripLicense: true}},
+		{name: "exported declarations",
+			in:  "(code.go #exported no-bodies)",
+			cmd: command{path: "code.go", lang: "go", exported: true, noBodies: true}},
+		{name: "exported declarations with a regexp",
+			in: "(code.go #exported /func/)", err: "#exported cannot be combined with other ways of selecting content"},
+		{name: "no bodies without exported declarations",
+			in: "(code.go no-bodies)", err: "no-bodies can only be used with #exported"},
+		{name: "extractor",
+			in:  "(data.xyz ext:parser /a b/ c)",
+			cmd: command{path: "data.xyz", lang: "xyz", extractor: "parser", extractorArgs: []string{"/a b/", "c"}}},
+		{name: "extractor with a language",
+			in:  "(data.xyz text strip-license ext:parser)",
+			cmd: command{path: "data.xyz", lang: "text", stripLicense: true, extractor: "parser"}},
+		{name: "extractor with a path",
+			in: "(data.xyz ext:../parser)", err: "bad extractor name in \"ext:../parser\""},
+		{name: "extractor with a regexp",
+			in: "(data.xyz /start/ ext:parser)", err: "ext cannot be combined with other ways of selecting content"},
+		{name: "anchor",
+			in:  "(code.go anchor=serve-http_2)",
+			cmd: command{path: "code.go", lang: "go", anchor: "serve-http_2"}},
+		{name: "bad anchor",
+			in: "(code.go anchor=a\"b)", err: "bad anchor in \"anchor=a\\\"b\""},
+		{name: "code block",
+			in:  "(other.md fence:2)",
+			cmd: command{path: "other.md", fence: 2}},
+		{name: "code block with a language",
+			in:  "(other.md go fence:1 /func/)",
+			cmd: command{path: "other.md", lang: "go", fence: 1, start: ptr("/func/")}},
+		{name: "bad code block number",
+			in: "(other.md fence:0)", err: "bad code block number in \"fence:0\""},
+		{name: "first lines",
+			in:  "(foo.go firstlines:/^func [A-Z]/)",
+			cmd: command{path: "foo.go", lang: "go", firstLines: "/^func [A-Z]/"}},
+		{name: "first lines with a language",
+			in:  "(foo.txt go firstlines:/^func/)",
+			cmd: command{path: "foo.txt", lang: "go", firstLines: "/^func/"}},
+		{name: "first lines not closed",
+			in: "(foo.go firstlines:/^func)", err: "unbalanced /"},
+		{name: "first lines with a regexp",
+			in: "(foo.go firstlines:/^func/ /start/)", err: "firstlines cannot be combined with other ways of selecting content"},
+		{name: "stripped lines",
+			in:  "(foo.go strip=/^\\/\\/go:build/)",
+			cmd: command{path: "foo.go", lang: "go", strip: []string{"/^\\/\\/go:build/"}}},
+		{name: "stripped lines with regexps",
+			in:  "(foo.go /func main/ strip=/ nolint$/ $ strip=/^$/)",
+			cmd: command{path: "foo.go", lang: "go", start: ptr("/func main/"), end: ptr("$"), strip: []string{"/ nolint$/", "/^$/"}}},
+		{name: "stripped lines not closed",
+			in: "(foo.go strip=/^func)", err: "unbalanced /"},
+		{name: "numbered stripped lines",
+			in: "(foo.go numbered strip=/^$/)", err: "numbered only supports whole files, regexps and line ranges"},
+		{name: "filtered lines",
+			in:  "(env.sh grep=/^export / grep-v=/SECRET/ grep=/=/)",
+			cmd: command{path: "env.sh", lang: "sh", grep: []string{"/^export /", "/=/"}, grepV: []string{"/SECRET/"}}},
+		{name: "filtered lines in a range",
+			in:  "(env.sh /# prod/ grep=/ PATH/ /# dev/)",
+			cmd: command{path: "env.sh", lang: "sh", start: ptr("/# prod/"), end: ptr("/# dev/"), grep: []string{"/ PATH/"}}},
+		{name: "numbered filtered lines",
+			in: "(env.sh numbered grep-v=/^$/)", err: "numbered only supports whole files, regexps and line ranges"},
+		{name: "program output",
+			in:  "(exec: mytool --help /tmp)",
+			cmd: command{path: "mytool --help /tmp", lang: "text", run: []string{"mytool", "--help", "/tmp"}}},
+		{name: "program output with no space",
+			in:  "(exec:mytool)",
+			cmd: command{path: "mytool", lang: "text", run: []string{"mytool"}}},
+		{name: "missing program",
+			in: "(exec: )", err: "missing program to run after exec:"},
+		{name: "start and a number of lines",
+			in:  "(foo.go /start/ +3)",
+			cmd: command{path: "foo.go", lang: "go", start: ptr("/start/"), end: ptr("+3")}},
+		{name: "start and a bad number of lines",
+			in: "(foo.go /start/ +three)", err: `bad line count "+three", expected +N with N positive`},
+		{name: "function",
+			in:  "(foo.go func:(*Server).Handle)",
+			cmd: command{path: "foo.go", lang: "go", funcName: "(*Server).Handle"}},
+		{name: "function with a language",
+			in:  "(foo.tmpl go func:main)",
+			cmd: command{path: "foo.tmpl", lang: "go", funcName: "main"}},
+		{name: "function with no name",
+			in: "(foo.go func:)", err: `bad function name in "func:"`},
+		{name: "function with a regexp",
+			in: "(foo.go func:main /start/)", err: "func: cannot be combined with other ways of selecting content"},
+		{name: "json path",
+			in:  "(api.yaml yaml jsonpath:$.paths./pets.get)",
+			cmd: command{path: "api.yaml", lang: "yaml", docPath: "jsonpath:$.paths./pets.get", docKeys: []pathKey{{"paths", -1}, {"/pets", -1}, {"get", -1}}}},
+		{name: "yaml path",
+			in:  "(deploy.yml yamlpath:spec['app.kubernetes.io'][0])",
+			cmd: command{path: "deploy.yml", lang: "yml", docPath: "yamlpath:spec['app.kubernetes.io'][0]", docKeys: []pathKey{{"spec", -1}, {"app.kubernetes.io", -1}, {"", 0}}}},
+		{name: "json path with no $",
+			in: "(api.json jsonpath:paths)", err: `bad path in "jsonpath:paths": the path should start with $`},
+		{name: "json path with a bad index",
+			in: "(api.json jsonpath:$.tags[first])", err: `bad path in "jsonpath:$.tags[first]": bad index in "[first]"`},
+		{name: "json path with a regexp",
+			in: "(api.json jsonpath:$.tags /start/)", err: "jsonpath: cannot be combined with other ways of selecting content"},
+		{name: "two paths",
+			in: "(api.json jsonpath:$.tags yamlpath:tags)", err: "only one path can be given"},
+		{name: "collapsed",
+			in:  "(foo.go collapse)",
+			cmd: command{path: "foo.go", lang: "go", collapse: true}},
+		{name: "collapsed with a summary",
+			in:  `(foo.go /start/ collapse="Show the code" numbered)`,
+			cmd: command{path: "foo.go", lang: "go", start: ptr("/start/"), collapse: true, summary: "Show the code", numbered: true}},
+		{name: "collapsed with an unquoted summary",
+			in:  "(foo.go collapse=Code)",
+			cmd: command{path: "foo.go", lang: "go", collapse: true, summary: "Code"}},
+		{name: "collapsed with an empty summary",
+			in: `(foo.go collapse="")`, err: `missing summary in "collapse=\"\""`},
+		{name: "collapsed with unbalanced quotes",
+			in: `(foo.go collapse="Show code)`, err: `unbalanced " in summary`},
+		{name: "wrapped lines",
+			in:  "(run.sh wrap=80)",
+			cmd: command{path: "run.sh", lang: "sh", wrap: 80}},
+		{name: "bad width",
+			in: "(run.sh wrap=0)", err: `bad width in "wrap=0"`},
+		{name: "wrapped image",
+			in: "(logo.png image wrap=80)", err: "images are embedded whole"},
+		{name: "expected lines and hash",
+			in:  "(foo.go /start/ expect-lines=12 expect-sha=315D64F9)",
+			cmd: command{path: "foo.go", lang: "go", start: ptr("/start/"), expectLines: 12, expectSHA: "315d64f9"}},
+		{name: "bad expected lines",
+			in: "(foo.go expect-lines=many)", err: "bad number of lines in \"expect-lines=many\""},
+		{name: "bad expected hash",
+			in: "(foo.go expect-sha=xyz)", err: "bad hash in \"expect-sha=xyz\""},
+		{name: "sink",
+			in:  "(code.go sink=examples.md)",
+			cmd: command{path: "code.go", lang: "go", sink: "examples.md"}},
+		{name: "sink without a name",
+			in: "(code.go sink=)", err: "missing sink name"},
+		{name: "blame",
+			in:  "(code.go blame)",
+			cmd: command{path: "code.go", lang: "go", blame: true}},
+		{name: "blame with a regexp",
+			in: "(code.go /start/ blame)", err: "blame only supports whole files or line ranges"},
+		{name: "index",
+			in:  "(docs/ index)",
+			cmd: command{path: "docs/", index: true}},
+		{name: "index with a regexp",
+			in: "(docs/ index /start/)", err: "index only lists the files in a directory"},
+		{name: "tree",
+			in:  "(examples/ tree depth=2 hidden)",
+			cmd: command{path: "examples/", tree: true, depth: 2, hidden: true}},
+		{name: "tree with a regexp",
+			in: "(examples/ tree /start/)", err: "tree only lists the files in a directory"},
+		{name: "depth without tree",
+			in: "(code.go depth=2)", err: "depth and hidden can only be used with tree"},
+		{name: "bad depth",
+			in: "(examples/ tree depth=0)", err: "bad depth in \"depth=0\""},
+		{name: "go vet",
+			in:  "(./sample go:vet)",
+			cmd: command{path: "./sample", goTool: "vet"}},
+		{name: "go build with a regexp",
+			in: "(./sample go:build /start/)", err: "go:build only checks a whole package"},
+		{name: "unknown go command",
+			in: "(./sample go:test)", err: "bad go command in \"go:test\", only vet and build are supported"},
+		{name: "diff between refs",
+			in:  "(api.go diff:v1.0..v1.1)",
+			cmd: command{path: "api.go", lang: "go", diffFrom: "v1.0", diffTo: "v1.1"}},
+		{name: "diff with a single ref",
+			in: "(api.go diff:v1.0)", err: "bad git refs in \"diff:v1.0\", expected diff:from..to"},
+		{name: "diff with an option as a ref",
+			in: "(api.go diff:--output=x..v1.1)", err: "bad git refs in \"diff:--output=x..v1.1\", expected diff:from..to"},
+		{name: "diff with a regexp",
+			in: "(api.go /func/ diff:v1.0..v1.1)", err: "diff only compares whole files"},
+		{name: "image",
+			in:  "(logo.png image)",
+			cmd: command{path: "logo.png", lang: "png", image: true}},
+		{name: "image with a regexp",
+			in: "(logo.png image /start/)", err: "images are embedded whole"},
 		{name: "extra arguments",
 			in: "(foo.go /start/ $ extra)", err: "too many arguments"},
 		{name: "file name with directories",
 			in:  "(foo/bar.go)",
 			cmd: command{path: "foo/bar.go", lang: "go"}},
+		{name: "path from the repository root",
+			in:  "(//pkg/server/code.go)",
+			cmd: command{path: "//pkg/server/code.go", lang: "go"}},
+		{name: "path from the repository root with a regexp",
+			in:  "(//pkg/code.go /start/)",
+			cmd: command{path: "//pkg/code.go", lang: "go", start: ptr("/start/")}},
 		{name: "url",
 			in:  "(http://golang.org/sample.go)",
 			cmd: command{path: "http://golang.org/sample.go", lang: "go"}},
 		{name: "bad url",
 			in:  "(http://golang:org:sample.go)",
 			cmd: command{path: "http://golang:org:sample.go", lang: "go"}},
+		{name: "url with a line range",
+			in:  "(https://github.com/campoy/embedmd/blob/abc/main.go#L10-L20)",
+			cmd: command{path: "https://github.com/campoy/embedmd/blob/abc/main.go", lang: "go", startLine: 10, endLine: 20}},
+		{name: "url with a single line",
+			in:  "(https://github.com/campoy/embedmd/blob/abc/main.go#L10)",
+			cmd: command{path: "https://github.com/campoy/embedmd/blob/abc/main.go", lang: "go", startLine: 10, endLine: 10}},
+		{name: "local file with a line range",
+			in:  "(code.go #L10-L20)",
+			cmd: command{path: "code.go", lang: "go", startLine: 10, endLine: 20}},
+		{name: "local file with a single line and a language",
+			in:  "(Makefile make #L3)",
+			cmd: command{path: "Makefile", lang: "make", startLine: 3, endLine: 3}},
+		{name: "bad line range",
+			in:  "(code.go #L10-20)",
+			err: `bad line range in "#L10-20", expected #L10-L20 or #L10`},
+		{name: "line range and regexp",
+			in:  "(code.go #L10-L20 /func main/)",
+			err: "line ranges cannot be combined with regexps"},
+		{name: "url with a line range and a regexp",
+			in:  "(https://x.com/a.go#L3-L4 /a b/)",
+			err: "line ranges cannot be combined with regexps"},
+		{name: "two line ranges",
+			in:  "(https://x.com/a.go#L3-L4 #L5)",
+			err: "only one line range can be given"},
+		{name: "numbered lines",
+			in:  "(code.go /func main/ numbered)",
+			cmd: command{path: "code.go", lang: "go", start: ptr("/func main/"), numbered: true}},
+		{name: "numbered lines and stripped license",
+			in:  "(code.go numbered strip-license)",
+			err: "numbered only supports whole files, regexps and line ranges"},
+		{name: "file in a git ref",
+			in:  "(git:v1.2.0:pkg/api.go /func New/)",
+			cmd: command{path: "git:v1.2.0:pkg/api.go", lang: "go", start: ptr("/func New/")}},
+		{name: "url with another fragment",
+			in:  "(https://golang.org/sample.go#top go)",
+			cmd: command{path: "https://golang.org/sample.go#top", lang: "go"}},
 	}
 
 	for _, tt := range tc {
@@ -91,6 +351,81 @@ func TestParseCommand(t *testing.T) {
 			if !eqPtr(want.end, got.end) {
 				t.Errorf("case [%s]: expected end %v; got %v", tt.name, str(want.end), str(got.end))
 			}
+			if want.firstLines != got.firstLines {
+				t.Errorf("case [%s]: expected first lines %q; got %q", tt.name, want.firstLines, got.firstLines)
+			}
+			if want.expectLines != got.expectLines || want.expectSHA != got.expectSHA {
+				t.Errorf("case [%s]: expected %d lines and sha %q; got %d and %q", tt.name, want.expectLines, want.expectSHA, got.expectLines, got.expectSHA)
+			}
+			if want.extractor != got.extractor || fmt.Sprint(want.extractorArgs) != fmt.Sprint(got.extractorArgs) {
+				t.Errorf("case [%s]: expected extractor %q with %q; got %q with %q", tt.name, want.extractor, want.extractorArgs, got.extractor, got.extractorArgs)
+			}
+			if want.exported != got.exported || want.noBodies != got.noBodies {
+				t.Errorf("case [%s]: expected exported %v and no bodies %v; got %v and %v", tt.name, want.exported, want.noBodies, got.exported, got.noBodies)
+			}
+			if fmt.Sprint(want.run) != fmt.Sprint(got.run) {
+				t.Errorf("case [%s]: expected program %q; got %q", tt.name, want.run, got.run)
+			}
+			if want.funcName != got.funcName {
+				t.Errorf("case [%s]: expected func %q; got %q", tt.name, want.funcName, got.funcName)
+			}
+			if want.docPath != got.docPath || fmt.Sprint(want.docKeys) != fmt.Sprint(got.docKeys) {
+				t.Errorf("case [%s]: expected path %q with %v; got %q with %v", tt.name, want.docPath, want.docKeys, got.docPath, got.docKeys)
+			}
+			if want.fence != got.fence {
+				t.Errorf("case [%s]: expected code block %d; got %d", tt.name, want.fence, got.fence)
+			}
+			if want.anchor != got.anchor {
+				t.Errorf("case [%s]: expected anchor %q; got %q", tt.name, want.anchor, got.anchor)
+			}
+			if want.sink != got.sink {
+				t.Errorf("case [%s]: expected sink %q; got %q", tt.name, want.sink, got.sink)
+			}
+			if want.blame != got.blame {
+				t.Errorf("case [%s]: expected blame %v; got %v", tt.name, want.blame, got.blame)
+			}
+			if want.index != got.index {
+				t.Errorf("case [%s]: expected index %v; got %v", tt.name, want.index, got.index)
+			}
+			if want.diffFrom != got.diffFrom || want.diffTo != got.diffTo {
+				t.Errorf("case [%s]: expected diff %s..%s; got %s..%s", tt.name, want.diffFrom, want.diffTo, got.diffFrom, got.diffTo)
+			}
+			if want.tree != got.tree || want.depth != got.depth || want.hidden != got.hidden {
+				t.Errorf("case [%s]: expected tree %v with depth %d and hidden %v; got %v, %d and %v", tt.name, want.tree, want.depth, want.hidden, got.tree, got.depth, got.hidden)
+			}
+			if want.goTool != got.goTool {
+				t.Errorf("case [%s]: expected go command %q; got %q", tt.name, want.goTool, got.goTool)
+			}
+			if want.image != got.image {
+				t.Errorf("case [%s]: expected image %v; got %v", tt.name, want.image, got.image)
+			}
+			if want.stripShebang != got.stripShebang {
+				t.Errorf("case [%s]: expected strip shebang %v; got %v", tt.name, want.stripShebang, got.stripShebang)
+			}
+			if want.noTrim != got.noTrim || want.rawIndent != got.rawIndent {
+				t.Errorf("case [%s]: expected no trim %v and raw indent %v; got %v and %v", tt.name, want.noTrim, want.rawIndent, got.noTrim, got.rawIndent)
+			}
+			if fmt.Sprint(want.grep) != fmt.Sprint(got.grep) || fmt.Sprint(want.grepV) != fmt.Sprint(got.grepV) {
+				t.Errorf("case [%s]: expected filters %q and %q; got %q and %q", tt.name, want.grep, want.grepV, got.grep, got.grepV)
+			}
+			if fmt.Sprint(want.strip) != fmt.Sprint(got.strip) {
+				t.Errorf("case [%s]: expected stripped lines %q; got %q", tt.name, want.strip, got.strip)
+			}
+			if want.numbered != got.numbered {
+				t.Errorf("case [%s]: expected numbered %v; got %v", tt.name, want.numbered, got.numbered)
+			}
+			if want.collapse != got.collapse || want.summary != got.summary {
+				t.Errorf("case [%s]: expected collapse %v with summary %q; got %v with %q", tt.name, want.collapse, want.summary, got.collapse, got.summary)
+			}
+			if want.wrap != got.wrap {
+				t.Errorf("case [%s]: expected wrap %d; got %d", tt.name, want.wrap, got.wrap)
+			}
+			if want.stripLicense != got.stripLicense {
+				t.Errorf("case [%s]: expected strip license %v; got %v", tt.name, want.stripLicense, got.stripLicense)
+			}
+			if want.startLine != got.startLine || want.endLine != got.endLine {
+				t.Errorf("case [%s]: expected lines %d-%d; got %d-%d", tt.name, want.startLine, want.endLine, got.startLine, got.endLine)
+			}
 		})
 	}
 }
@@ -14,11 +14,16 @@
 package embedmd
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Fetcher provides an abstraction on a file system.
@@ -31,15 +36,39 @@ type Fetcher interface {
 	Fetch(dir, path string) ([]byte, error)
 }
 
-type fetcher struct{}
+// defaultClient is the client fetching urls unless WithHTTPClient is used. Its
+// transport, as the one of any client with no transport, uses the proxy given
+// by the HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment variables.
+var defaultClient = &http.Client{Timeout: 30 * time.Second}
 
-func (fetcher) Fetch(dir, path string) ([]byte, error) {
-	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+// fetchRetries is the number of times a url is fetched again when the server
+// fails, waiting retryDelay the first time and twice as long every next one.
+const fetchRetries = 2
+
+var retryDelay = 500 * time.Millisecond // replaced by testing functions.
+
+// fetcher reads local files and fetches urls with client, sending the given
+// headers only in the requests for urls.
+type fetcher struct {
+	client *http.Client
+	header http.Header
+}
+
+// Fetch reads the file at path, joined lexically to dir, or fetches the url or
+// the file on an ssh remote.
+func (f fetcher) Fetch(dir, path string) ([]byte, error) {
+	if ref, file, ok := splitGitPath(path); ok {
+		return gitShow(dir, file, ref)
+	}
+	if p, ok := splitSSHPath(path); ok {
+		return sshCat(p)
+	}
+	if !isURL(path) {
 		path = filepath.Join(dir, filepath.FromSlash(path))
 		return ioutil.ReadFile(path)
 	}
 
-	res, err := http.Get(path)
+	res, err := httpGet(f.client, f.header, rawURL(path))
 	if err != nil {
 		return nil, err
 	}
@@ -49,3 +78,270 @@ func (fetcher) Fetch(dir, path string) ([]byte, error) {
 	}
 	return ioutil.ReadAll(res.Body)
 }
+
+// httpGet gets the url with the given client and headers, trying again after a
+// delay when the server fails with a 5xx status.
+func httpGet(client *http.Client, header http.Header, url string) (*http.Response, error) {
+	delay := retryDelay
+	for i := 0; ; i++ {
+		res, err := httpDo(client, header, "GET", url)
+		if err != nil || res.StatusCode < 500 || i == fetchRetries {
+			return res, err
+		}
+		res.Body.Close()
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// httpDo sends a request with the given method and headers to the url. The
+// client drops the headers that could leak credentials, such as Authorization,
+// when following redirects to other domains.
+func httpDo(client *http.Client, header http.Header, method, url string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	return client.Do(req)
+}
+
+// checkURL returns an error if the content at the url cannot be fetched with
+// the given client and headers. It only asks for the headers of the response,
+// unless the server does not support it.
+func checkURL(client *http.Client, header http.Header, path string) error {
+	res, err := httpDo(client, header, "HEAD", rawURL(path))
+	if err == nil && res.StatusCode == http.StatusMethodNotAllowed {
+		res.Body.Close()
+		res, err = httpGet(client, header, rawURL(path))
+	}
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", res.Status)
+	}
+	return nil
+}
+
+// rawURL returns the url with its fragment removed, so it's never sent to the
+// server. GitHub urls pointing to a file in a repository, such as permalinks,
+// are replaced with the url of the raw content of the file.
+func rawURL(path string) string {
+	if i := strings.IndexByte(path, '#'); i >= 0 {
+		path = path[:i]
+	}
+	const prefix = "https://github.com/"
+	if !strings.HasPrefix(path, prefix) {
+		return path
+	}
+	parts := strings.SplitN(path[len(prefix):], "/", 4)
+	if len(parts) < 4 || parts[2] != "blob" {
+		return path
+	}
+	return "https://raw.githubusercontent.com/" + parts[0] + "/" + parts[1] + "/" + parts[3]
+}
+
+// blobURL returns the url of the page showing a file in a GitHub repository
+// given the url of its raw content, or the url itself for any other url.
+func blobURL(path string) string {
+	const prefix = "https://raw.githubusercontent.com/"
+	if !strings.HasPrefix(path, prefix) {
+		return path
+	}
+	parts := strings.SplitN(path[len(prefix):], "/", 4)
+	if len(parts) < 4 {
+		return path
+	}
+	return "https://github.com/" + parts[0] + "/" + parts[1] + "/blob/" + parts[2] + "/" + parts[3]
+}
+
+// missingFetcher wraps a Fetcher, marking the errors it returns as missing
+// content, so they can be told apart from the ones of the wrappers refusing
+// to fetch content.
+type missingFetcher struct{ Fetcher }
+
+func (f missingFetcher) Fetch(dir, path string) ([]byte, error) {
+	b, err := f.Fetcher.Fetch(dir, path)
+	if err != nil {
+		return nil, missingError{err}
+	}
+	return b, nil
+}
+
+// missingError is an error fetching content that might be available later.
+type missingError struct{ err error }
+
+func (e missingError) Error() string { return e.err.Error() }
+
+// cachingFetcher wraps a Fetcher, fetching each file or url only once, so the
+// commands embedding parts of the same content share it. Urls are identified
+// by the url of their raw content, ignoring the base directory. Errors are
+// only shared with the calls waiting for the same fetch, so the next call
+// tries again.
+type cachingFetcher struct {
+	Fetcher
+
+	mu      sync.Mutex
+	fetches map[fetchKey]*fetch
+}
+
+type fetchKey struct{ dir, path string }
+
+// A fetch is the result of fetching some content, which is ready once done
+// is closed.
+type fetch struct {
+	done chan struct{}
+	b    []byte
+	err  error
+}
+
+func (f *cachingFetcher) Fetch(dir, path string) ([]byte, error) {
+	key := fetchKey{dir, path}
+	if isURL(path) {
+		key = fetchKey{"", rawURL(path)}
+	} else if isSSHPath(path) {
+		key = fetchKey{"", path}
+	}
+
+	f.mu.Lock()
+	if c, ok := f.fetches[key]; ok {
+		f.mu.Unlock()
+		<-c.done
+		return c.b, c.err
+	}
+	if f.fetches == nil {
+		f.fetches = make(map[fetchKey]*fetch)
+	}
+	c := &fetch{done: make(chan struct{})}
+	f.fetches[key] = c
+	f.mu.Unlock()
+
+	c.b, c.err = f.Fetcher.Fetch(dir, path)
+	if c.err != nil {
+		f.mu.Lock()
+		delete(f.fetches, key)
+		f.mu.Unlock()
+	}
+	close(c.done)
+	return c.b, c.err
+}
+
+// safeFetcher wraps a Fetcher, refusing to fetch urls or files outside of
+// the root directory.
+type safeFetcher struct {
+	Fetcher
+	root string
+}
+
+func (f safeFetcher) Fetch(dir, path string) ([]byte, error) {
+	if isURL(path) {
+		return nil, errors.New("fetching urls is not allowed in safe mode")
+	}
+	if err := within(f.root, filepath.Join(dir, filepath.FromSlash(path))); err != nil {
+		return nil, err
+	}
+	return f.Fetcher.Fetch(dir, path)
+}
+
+// trackedFetcher wraps a Fetcher, refusing to fetch files that are not
+// tracked by git. Files outside of a git repository are fetched unless strict
+// is set. URLs, files in git refs, and files on ssh remotes are always fetched.
+type trackedFetcher struct {
+	Fetcher
+	strict bool
+}
+
+func (f trackedFetcher) Fetch(dir, path string) ([]byte, error) {
+	if _, _, ok := splitGitPath(path); ok || isURL(path) || isSSHPath(path) {
+		return f.Fetcher.Fetch(dir, path)
+	}
+	p := filepath.Join(dir, filepath.FromSlash(path))
+	ok, inRepo := gitTracked(p)
+	if !inRepo && f.strict {
+		return nil, fmt.Errorf("%s is not in a git repository", filepath.ToSlash(p))
+	}
+	if inRepo && !ok {
+		return nil, fmt.Errorf("%s is not tracked by git", filepath.ToSlash(p))
+	}
+	return f.Fetcher.Fetch(dir, path)
+}
+
+// gitCommand is the git binary run by the commands using git.
+var gitCommand = "git" // replaced by testing functions.
+
+// gitTracked reports whether the file at path is tracked by git, and whether
+// its directory is in a git repository at all.
+func gitTracked(path string) (tracked, inRepo bool) {
+	dir, file := filepath.Split(path)
+	git := func(args ...string) bool {
+		cmd := exec.Command(gitCommand, args...)
+		cmd.Dir = dir
+		return cmd.Run() == nil
+	}
+	if git("ls-files", "--error-unmatch", "--", file) {
+		return true, true
+	}
+	return false, git("rev-parse", "--is-inside-work-tree")
+}
+
+// findRepoRoot returns the closest directory containing dir, or dir itself,
+// that contains a .git entry.
+func findRepoRoot(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for d := abs; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			return d, nil
+		}
+		if filepath.Dir(d) == d {
+			return "", fmt.Errorf("could not find the repository root of %s", filepath.ToSlash(dir))
+		}
+	}
+}
+
+// errEscapesBaseDir is returned for the paths outside of the base directory
+// when WithRestrictToBaseDir is used.
+var errEscapesBaseDir = errors.New("path escapes base directory")
+
+// inBaseDir returns errEscapesBaseDir if the given path, once symbolic links
+// are resolved, is not in the base directory dir.
+func inBaseDir(dir, path string) error {
+	if err := within(dir, path); err != nil {
+		return errEscapesBaseDir
+	}
+	return nil
+}
+
+// within returns an error if the given path, once symbolic links are
+// resolved, is not in the root directory.
+func within(root, path string) error {
+	resolve := func(path string) (string, error) {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		if p, err := filepath.EvalSymlinks(path); err == nil {
+			path = p
+		}
+		return path, nil
+	}
+	r, err := resolve(root)
+	if err != nil {
+		return err
+	}
+	p, err := resolve(path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(r, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside of %s", filepath.ToSlash(path), filepath.ToSlash(root))
+	}
+	return nil
+}
@@ -0,0 +1,484 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRawURL(t *testing.T) {
+	tc := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{name: "plain url",
+			in:  "https://golang.org/sample.go",
+			out: "https://golang.org/sample.go"},
+		{name: "fragment is removed",
+			in:  "https://golang.org/sample.go#L10-L20",
+			out: "https://golang.org/sample.go"},
+		{name: "github permalink",
+			in:  "https://github.com/campoy/embedmd/blob/abc123/embedmd/embedmd.go#L10-L20",
+			out: "https://raw.githubusercontent.com/campoy/embedmd/abc123/embedmd/embedmd.go"},
+		{name: "github url not pointing to a file",
+			in:  "https://github.com/campoy/embedmd/tree/master/embedmd",
+			out: "https://github.com/campoy/embedmd/tree/master/embedmd"},
+		{name: "raw github url",
+			in:  "https://raw.githubusercontent.com/campoy/embedmd/master/sample/hello.go",
+			out: "https://raw.githubusercontent.com/campoy/embedmd/master/sample/hello.go"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rawURL(tt.in); got != tt.out {
+				t.Errorf("case [%s]: expected %q; got %q", tt.name, tt.out, got)
+			}
+		})
+	}
+}
+
+func TestSafeFetcher(t *testing.T) {
+	tc := []struct {
+		name string
+		dir  string
+		path string
+		err  string
+	}{
+		{name: "file in the root",
+			dir: "docs", path: "code.go"},
+		{name: "file in a parent directory within the root",
+			dir: "docs/guide", path: "../code.go"},
+		{name: "file outside of the root",
+			dir: "docs", path: "../../code.go", err: "../code.go is outside of docs"},
+		{name: "url",
+			dir: "docs", path: "https://golang.org/sample.go", err: "fetching urls is not allowed in safe mode"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			f := safeFetcher{
+				Fetcher: fakeFileProvider{
+					"docs/code.go": []byte(content),
+					"code.go":      []byte(content),
+				},
+				root: "docs",
+			}
+			_, err := f.Fetch(tt.dir, tt.path)
+			eqErr(t, tt.name, err, tt.err)
+		})
+	}
+}
+
+// countingFetcher counts the calls to Fetch for each path, failing the first
+// ones for the paths in fails.
+type countingFetcher struct {
+	Fetcher
+
+	mu    sync.Mutex
+	calls map[string]int
+	fails map[string]int
+}
+
+func (f *countingFetcher) Fetch(dir, path string) ([]byte, error) {
+	f.mu.Lock()
+	f.calls[path]++
+	failed := f.calls[path] <= f.fails[path]
+	f.mu.Unlock()
+	if failed {
+		return nil, fmt.Errorf("could not fetch %s", path)
+	}
+	return f.Fetcher.Fetch(dir, path)
+}
+
+func TestCachingFetcher(t *testing.T) {
+	counter := &countingFetcher{
+		Fetcher: mixedContentProvider{
+			files: map[string][]byte{"code.go": []byte(content), "flaky.go": []byte(content)},
+			urls:  map[string][]byte{"https://fakeurl.com/main.go": []byte(content)},
+		},
+		calls: make(map[string]int),
+		fails: map[string]int{"flaky.go": 1},
+	}
+	f := &cachingFetcher{Fetcher: counter}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b, err := f.Fetch("", "code.go"); err != nil || string(b) != content {
+				t.Errorf("unexpected fetch of code.go: %q, %v", b, err)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, path := range []string{"https://fakeurl.com/main.go", "https://fakeurl.com/main.go#top"} {
+		if _, err := f.Fetch("docs", path); err != nil {
+			t.Errorf("unexpected error fetching %s: %v", path, err)
+		}
+	}
+	if _, err := f.Fetch("", "flaky.go"); err == nil {
+		t.Errorf("expected the first fetch of flaky.go to fail")
+	}
+	if _, err := f.Fetch("", "flaky.go"); err != nil {
+		t.Errorf("expected the error fetching flaky.go not to be kept; got %v", err)
+	}
+
+	want := map[string]int{"code.go": 1, "https://fakeurl.com/main.go": 1, "flaky.go": 2}
+	if fmt.Sprint(counter.calls) != fmt.Sprint(want) {
+		t.Errorf("expected calls %v; got %v", want, counter.calls)
+	}
+}
+
+func TestBlobURL(t *testing.T) {
+	tc := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{name: "plain url",
+			in:  "https://golang.org/sample.go",
+			out: "https://golang.org/sample.go"},
+		{name: "raw github url",
+			in:  "https://raw.githubusercontent.com/campoy/embedmd/master/sample/hello.go",
+			out: "https://github.com/campoy/embedmd/blob/master/sample/hello.go"},
+		{name: "raw github url not pointing to a file",
+			in:  "https://raw.githubusercontent.com/campoy/embedmd",
+			out: "https://raw.githubusercontent.com/campoy/embedmd"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := blobURL(tt.in); got != tt.out {
+				t.Errorf("case [%s]: expected %q; got %q", tt.name, tt.out, got)
+			}
+		})
+	}
+}
+
+func TestTrackedFetcher(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	repo, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repo)
+	noRepo, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(noRepo)
+
+	for _, dir := range []string{repo, noRepo} {
+		for _, name := range []string{"tracked.go", "untracked.go"} {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, args := range [][]string{{"init", "-q"}, {"add", "tracked.go"}} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+
+	tc := []struct {
+		name   string
+		dir    string
+		path   string
+		strict bool
+		err    string
+	}{
+		{name: "tracked file",
+			dir: repo, path: "tracked.go"},
+		{name: "untracked file",
+			dir: repo, path: "untracked.go", err: filepath.ToSlash(repo) + "/untracked.go is not tracked by git"},
+		{name: "file outside of a repository",
+			dir: noRepo, path: "untracked.go"},
+		{name: "file outside of a repository in strict mode",
+			dir: noRepo, path: "untracked.go", strict: true, err: filepath.ToSlash(noRepo) + "/untracked.go is not in a git repository"},
+		{name: "url",
+			dir: repo, path: "https://golang.org/sample.go", strict: true},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			f := trackedFetcher{
+				Fetcher: mixedContentProvider{
+					files: map[string][]byte{
+						filepath.Join(repo, "tracked.go"):     []byte(content),
+						filepath.Join(repo, "untracked.go"):   []byte(content),
+						filepath.Join(noRepo, "untracked.go"): []byte(content),
+					},
+					urls: map[string][]byte{"https://golang.org/sample.go": []byte(content)},
+				},
+				strict: tt.strict,
+			}
+			_, err := f.Fetch(tt.dir, tt.path)
+			eqErr(t, tt.name, err, tt.err)
+		})
+	}
+}
+
+func TestFindRepoRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := filepath.Join(dir, "repo")
+	docs := filepath.Join(repo, "docs", "guide")
+	for _, d := range []string{filepath.Join(repo, ".git"), docs} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, d := range []string{repo, docs} {
+		root, err := findRepoRoot(d)
+		if err != nil {
+			t.Errorf("unexpected error finding the root of %s: %v", d, err)
+		} else if root != repo {
+			t.Errorf("expected the root of %s to be %s; got %s", d, repo, root)
+		}
+	}
+	if _, err := findRepoRoot(dir); err == nil {
+		t.Errorf("expected an error finding the root of %s", dir)
+	}
+}
+
+func TestRootFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if root, err := findRepoRoot(dir); err == nil {
+		t.Skipf("the temporary directory is in the repository %s", root)
+	}
+	docs := filepath.Join(dir, "docs")
+	files := map[string]string{
+		filepath.Join(dir, "pkg", "code.go"):  "root\n",
+		filepath.Join(docs, "pkg", "code.go"): "docs\n",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tc := []struct {
+		name string
+		opts []Option
+		out  string
+	}{
+		{name: "fallback root",
+			opts: []Option{WithRootFallback(dir)},
+			out:  "root\n"},
+		{name: "repository root over the fallback",
+			opts: []Option{WithRootFallback(dir), WithRepoRoot(docs)},
+			out:  "docs\n"},
+	}
+	for _, tt := range tc {
+		var out bytes.Buffer
+		opts := append(tt.opts, WithBaseDir(docs))
+		if err := Process(&out, strings.NewReader("[embedmd]:# (//pkg/code.go)\n"), opts...); err != nil {
+			t.Errorf("case [%s]: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if want := "[embedmd]:# (//pkg/code.go)\n```go\n" + tt.out + "```\n"; out.String() != want {
+			t.Errorf("case [%s]: expected %q; got %q", tt.name, want, out.String())
+		}
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = 0
+
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		n := calls[r.URL.Path]
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/flaky.go" && n < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/flaky.go":
+			fmt.Fprint(w, "package main\n")
+		case r.URL.Path == "/down.go":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	tc := []struct {
+		name  string
+		path  string
+		out   string
+		err   string
+		calls int
+	}{
+		{name: "server failing twice",
+			path: "/flaky.go", out: "package main\n", calls: 3},
+		{name: "server failing on every retry",
+			path: "/down.go", err: "status 502 Bad Gateway", calls: 3},
+		{name: "missing file is not retried",
+			path: "/missing.go", err: "status 404 Not Found", calls: 1},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := fetcher{client: defaultClient}.Fetch("", s.URL+tt.path)
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			if string(b) != tt.out {
+				t.Errorf("case [%s]: expected content %q; got %q", tt.name, tt.out, b)
+			}
+		})
+		if calls[tt.path] != tt.calls {
+			t.Errorf("case [%s]: expected %d requests; got %d", tt.name, tt.calls, calls[tt.path])
+		}
+	}
+}
+
+// roundTripFunc is an http.RoundTripper calling itself.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestWithHTTPClient(t *testing.T) {
+	var requested []string
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requested = append(requested, r.URL.String())
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("package main\n")),
+		}, nil
+	})}
+
+	in := "[embedmd]:# (https://github.com/campoy/embedmd/blob/abc/main.go)\n"
+	var out bytes.Buffer
+	if err := Process(&out, strings.NewReader(in), WithHTTPClient(client)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := in + "```go\npackage main\n```\n"; out.String() != want {
+		t.Errorf("expected output %q; got %q", want, out.String())
+	}
+	if want := "[https://raw.githubusercontent.com/campoy/embedmd/abc/main.go]"; fmt.Sprint(requested) != want {
+		t.Errorf("expected requests %s; got %v", want, requested)
+	}
+}
+
+func TestWithHTTPHeader(t *testing.T) {
+	defer os.Unsetenv("EMBEDMD_TEST_TOKEN")
+	os.Setenv("EMBEDMD_TEST_TOKEN", "secret")
+
+	var got []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Method+" "+r.Header.Get("Authorization")+" "+r.Header.Get("X-Team"))
+		fmt.Fprint(w, "package main\n")
+	}))
+	defer s.Close()
+
+	opts := []Option{
+		WithHTTPHeader("Authorization", "token ${EMBEDMD_TEST_TOKEN}"),
+		WithHTTPHeader("X-Team", "docs"),
+	}
+	in := "[embedmd]:# (" + s.URL + "/main.go)\n"
+	var out bytes.Buffer
+	if err := Process(&out, strings.NewReader(in), opts...); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := in + "```go\npackage main\n```\n"; out.String() != want {
+		t.Errorf("expected output %q; got %q", want, out.String())
+	}
+	err := CheckURLs(strings.NewReader(in), func(_ int, _ string, err error) {
+		if err != nil {
+			t.Errorf("unexpected error checking %s: %v", s.URL, err)
+		}
+	}, opts...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "[GET token secret docs HEAD token secret docs]"; fmt.Sprint(got) != want {
+		t.Errorf("expected requests %s; got %v", want, got)
+	}
+
+	err = Process(&out, strings.NewReader(in), WithHTTPHeader("Authorization", "token $EMBEDMD_MISSING_TOKEN"))
+	eqErr(t, "missing variable", err, "header Authorization: environment variable EMBEDMD_MISSING_TOKEN is not set")
+}
+
+func TestCheckURLs(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok.go":
+		case "/get.go":
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	in := "[embedmd]:# (code.go)\n" +
+		"[embedmd]:# (" + s.URL + "/ok.go)\n" +
+		"```go\nold\n```\n" +
+		"[embedmd]:# (" + s.URL + "/get.go#L1-L2)\n" +
+		"[embedmd]:# (" + s.URL + "/missing.go)\n"
+	var got []string
+	err := CheckURLs(strings.NewReader(in), func(line int, url string, err error) {
+		got = append(got, fmt.Sprintf("%d %s %v", line, strings.TrimPrefix(url, s.URL), err))
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"2 /ok.go <nil>", "6 /get.go <nil>", "7 /missing.go status 404 Not Found"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected reports %q; got %q", want, got)
+	}
+
+	err = CheckURLs(strings.NewReader("[embedmd]:# (code.go /start)\n"), func(int, string, error) {})
+	eqErr(t, "bad command", err, "1: unbalanced /")
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+// detailsOpen and detailsClose are the lines around the collapsed code blocks
+// generated by the commands with the collapse flag.
+const (
+	detailsOpen  = "<details>"
+	detailsClose = "</details>"
+)
+
+// collapseArg prefixes the summary of a collapsed code block, as in
+// collapse="Show code".
+const collapseArg = "collapse="
+
+// isSummary reports whether the line is the summary of a collapsed code block.
+func isSummary(line string) bool {
+	return strings.HasPrefix(line, "<summary>") && strings.HasSuffix(line, "</summary>")
+}
+
+// runCollapsed runs a command with the collapse flag, writing what it would
+// generate without it in a <details> element, so it's shown collapsed with
+// the summary given, or the path of the command if none was given. A blank
+// line goes after the summary and before the end of the element, since
+// GitHub only renders markdown separated from HTML by blank lines.
+func (e *embedder) runCollapsed(w io.Writer, cmd *command) error {
+	// the copy has no sink, since w already is the one of cmd if it has one.
+	inner := *cmd
+	inner.collapse, inner.summary, inner.sink = false, "", ""
+	var b bytes.Buffer
+	if err := e.runCommand(&b, &inner); err != nil {
+		return err
+	}
+	summary := cmd.summary
+	if summary == "" {
+		summary = cmd.path
+	}
+	fmt.Fprintln(w, detailsOpen)
+	fmt.Fprintf(w, "<summary>%s</summary>\n\n", html.EscapeString(summary))
+	w.Write(b.Bytes())
+	fmt.Fprintf(w, "\n%s\n", detailsClose)
+	return nil
+}
@@ -0,0 +1,415 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPathArg and yamlPathArg prefix the paths selecting the sub-document to
+// embed from a JSON or YAML file, as in jsonpath:$.paths./pets.get or
+// yamlpath:paths./pets.get.
+const (
+	jsonPathArg = "jsonpath:"
+	yamlPathArg = "yamlpath:"
+)
+
+// pathSyntaxes contains the parsers of the paths selecting a sub-document, per
+// prefix of the argument giving them.
+var pathSyntaxes = map[string]func(string) ([]pathKey, error){
+	jsonPathArg: parseJSONPath,
+	yamlPathArg: parseYAMLPath,
+}
+
+// pathSelectors contains the functions selecting the sub-document at a path,
+// per language of the document.
+var pathSelectors = map[string]func([]byte, []pathKey) ([]byte, error){
+	"json": selectJSON,
+	"yaml": selectYAML,
+	"yml":  selectYAML,
+}
+
+// A pathKey is a step of a path selecting a sub-document, which is either the
+// key of a member of an object or the index of an item in an array.
+type pathKey struct {
+	name  string
+	index int // -1 for the keys of members.
+}
+
+// parseDocPath parses an argument like jsonpath:$.paths./pets.get into the
+// keys of the path given, using the syntax selected by its prefix.
+func parseDocPath(arg string) ([]pathKey, error) {
+	for prefix, parse := range pathSyntaxes {
+		if strings.HasPrefix(arg, prefix) {
+			return parse(arg[len(prefix):])
+		}
+	}
+	return nil, fmt.Errorf("unknown path syntax in %q", arg)
+}
+
+// parseJSONPath parses a JSONPath made only of keys and indexes, such as
+// $.paths['/pets'].get or $.tags[0].
+func parseJSONPath(s string) ([]pathKey, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, errors.New("the path should start with $")
+	}
+	return parsePathKeys(s[1:])
+}
+
+// parseYAMLPath parses a path like a JSONPath, but with no $, as in
+// paths./pets.get or tags[0].
+func parseYAMLPath(s string) ([]pathKey, error) {
+	if s == "" {
+		return nil, errors.New("missing path")
+	}
+	if s[0] != '[' {
+		s = "." + s
+	}
+	return parsePathKeys(s)
+}
+
+// parsePathKeys parses a sequence of .key, ['key'] and [index] steps. Keys with
+// dots or brackets must be quoted.
+func parsePathKeys(s string) ([]pathKey, error) {
+	var keys []pathKey
+	for s != "" {
+		switch {
+		case s[0] == '.':
+			end := strings.IndexAny(s[1:], ".[")
+			if end < 0 {
+				end = len(s) - 1
+			}
+			if end == 0 {
+				return nil, errors.New("empty key")
+			}
+			keys, s = append(keys, pathKey{s[1 : end+1], -1}), s[end+1:]
+		case strings.HasPrefix(s, "['") || strings.HasPrefix(s, `["`):
+			end := strings.Index(s[2:], s[1:2]+"]")
+			if end < 0 {
+				return nil, fmt.Errorf("unbalanced quotes in %q", s)
+			}
+			keys, s = append(keys, pathKey{s[2 : end+2], -1}), s[end+4:]
+		case s[0] == '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unbalanced brackets in %q", s)
+			}
+			n, err := strconv.Atoi(s[1:end])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("bad index in %q", s[:end+1])
+			}
+			keys, s = append(keys, pathKey{index: n}), s[end+1:]
+		default:
+			return nil, fmt.Errorf("expected . or [ before %q", s)
+		}
+	}
+	return keys, nil
+}
+
+// formatPath returns the keys of a path written as a JSONPath, as they are
+// shown in the errors.
+func formatPath(keys []pathKey) string {
+	s := "$"
+	for _, k := range keys {
+		switch {
+		case k.index >= 0:
+			s += fmt.Sprintf("[%d]", k.index)
+		case strings.ContainsAny(k.name, ".[]'"):
+			s += `["` + k.name + `"]`
+		default:
+			s += "." + k.name
+		}
+	}
+	return s
+}
+
+// selectPath returns the sub-document at the path given by keys of the
+// content b in the given language.
+func selectPath(lang string, b []byte, keys []pathKey) ([]byte, error) {
+	sel, ok := pathSelectors[lang]
+	if !ok {
+		return nil, fmt.Errorf("cannot select a path in language %q", lang)
+	}
+	return sel(b, keys)
+}
+
+// selectJSON returns the value at the path in the JSON document b, indented
+// with two spaces and with its members in the order they are written.
+func selectJSON(b []byte, keys []pathKey) ([]byte, error) {
+	var v json.RawMessage
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		v = bytes.TrimSpace(v)
+		switch {
+		case k.index < 0 && len(v) > 0 && v[0] == '{':
+			var obj map[string]json.RawMessage
+			if err := json.Unmarshal(v, &obj); err != nil {
+				return nil, err
+			}
+			member, ok := obj[k.name]
+			if !ok {
+				return nil, fmt.Errorf("no key %q in %s", k.name, formatPath(keys[:i]))
+			}
+			v = member
+		case k.index >= 0 && len(v) > 0 && v[0] == '[':
+			var items []json.RawMessage
+			if err := json.Unmarshal(v, &items); err != nil {
+				return nil, err
+			}
+			if k.index >= len(items) {
+				return nil, fmt.Errorf("no index %d in %s, which has %d items", k.index, formatPath(keys[:i]), len(items))
+			}
+			v = items[k.index]
+		case k.index < 0:
+			return nil, fmt.Errorf("no key %q in %s, which is not an object", k.name, formatPath(keys[:i]))
+		default:
+			return nil, fmt.Errorf("no index %d in %s, which is not an array", k.index, formatPath(keys[:i]))
+		}
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, bytes.TrimSpace(v), "", "  "); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// selectYAML returns the value at the path in the YAML document b, keeping its
+// lines but removing the indentation they have in the document. Only block
+// mappings and sequences can be followed by the path, as in most documents
+// written by hand, such as OpenAPI specs.
+func selectYAML(b []byte, keys []pathKey) ([]byte, error) {
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	if i := firstYAMLLine(lines); i >= 0 && strings.TrimSpace(lines[i]) == "---" {
+		lines = lines[i+1:]
+	}
+	lines = dedent(lines)
+	for i, k := range keys {
+		first := firstYAMLLine(lines)
+		var line string
+		if first >= 0 {
+			line = lines[first]
+		}
+		isSeq := line == "-" || strings.HasPrefix(line, "- ")
+		_, _, isMap := yamlKey(line)
+		switch {
+		case k.index < 0 && isMap:
+			value, ok := yamlMember(lines, k.name)
+			if !ok {
+				return nil, fmt.Errorf("no key %q in %s", k.name, formatPath(keys[:i]))
+			}
+			lines = value
+		case k.index >= 0 && isSeq:
+			items := yamlItems(lines)
+			if k.index >= len(items) {
+				return nil, fmt.Errorf("no index %d in %s, which has %d items", k.index, formatPath(keys[:i]), len(items))
+			}
+			lines = items[k.index]
+		case k.index < 0:
+			return nil, fmt.Errorf("no key %q in %s, which is not a mapping", k.name, formatPath(keys[:i]))
+		default:
+			return nil, fmt.Errorf("no index %d in %s, which is not a sequence", k.index, formatPath(keys[:i]))
+		}
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+// isYAMLContent reports whether the line is neither blank nor a comment.
+func isYAMLContent(line string) bool {
+	s := strings.TrimSpace(line)
+	return s != "" && s[0] != '#'
+}
+
+// firstYAMLLine returns the index of the first line that is neither blank nor
+// a comment, or -1 if there's none.
+func firstYAMLLine(lines []string) int {
+	for i, line := range lines {
+		if isYAMLContent(line) {
+			return i
+		}
+	}
+	return -1
+}
+
+// yamlKey returns the key of the mapping entry in the line, unquoted, and the
+// rest of the line after the colon following it, reporting whether the line
+// starts a mapping entry.
+func yamlKey(line string) (key, rest string, ok bool) {
+	// flow collections, such as {a: 1}, are not followed by the paths.
+	if line == "" || strings.HasPrefix(line, "- ") || strings.ContainsRune("#{[ ", rune(line[0])) {
+		return "", "", false
+	}
+	end := 0
+	switch line[0] {
+	case '"':
+		for end = 1; end < len(line) && line[end] != '"'; end++ {
+			if line[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(line) {
+			return "", "", false
+		}
+		k, err := strconv.Unquote(line[:end+1])
+		if err != nil {
+			return "", "", false
+		}
+		key, end = k, end+1
+	case '\'':
+		for end = 1; end < len(line); end++ {
+			if line[end] == '\'' {
+				if end+1 < len(line) && line[end+1] == '\'' {
+					end++
+					continue
+				}
+				break
+			}
+		}
+		if end >= len(line) {
+			return "", "", false
+		}
+		key, end = strings.Replace(line[1:end], "''", "'", -1), end+1
+	default:
+		i := strings.Index(line, ": ")
+		if i < 0 && strings.HasSuffix(line, ":") {
+			i = len(line) - 1
+		}
+		if i <= 0 {
+			return "", "", false
+		}
+		return strings.TrimSpace(line[:i]), line[i+1:], true
+	}
+	rest = strings.TrimLeft(line[end:], " ")
+	if rest != ":" && !strings.HasPrefix(rest, ": ") {
+		return "", "", false
+	}
+	return key, rest[1:], true
+}
+
+// yamlMember returns the lines of the value of the entry with the given key in
+// the block mapping in lines, with no indentation.
+func yamlMember(lines []string, name string) ([]string, bool) {
+	for i, line := range lines {
+		key, rest, ok := yamlKey(line)
+		if !ok || key != name {
+			continue
+		}
+		// the value ends at the next line of the mapping, but sequences can be
+		// written with their items as indented as the key.
+		end := i + 1
+		seq := false
+		for ; end < len(lines); end++ {
+			l := lines[end]
+			if !isYAMLContent(l) || l[0] == ' ' {
+				continue
+			}
+			if (l == "-" || strings.HasPrefix(l, "- ")) && (seq || end == i+1 || firstYAMLLine(lines[i+1:end]) < 0) {
+				seq = true
+				continue
+			}
+			break
+		}
+		value := lines[i+1 : end]
+		if v := yamlScalar(rest); v != "" && v[0] != '|' && v[0] != '>' && v[0] != '&' {
+			value = []string{v}
+		}
+		return dedent(value), true
+	}
+	return nil, false
+}
+
+// yamlScalar returns the value written after a key or a dash, with no comment.
+func yamlScalar(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "#") {
+		return ""
+	}
+	if s != "" && s[0] != '"' && s[0] != '\'' {
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = strings.TrimSpace(s[:i])
+		}
+	}
+	return s
+}
+
+// yamlItems returns the lines of the items of the block sequence in lines,
+// with no indentation.
+func yamlItems(lines []string) [][]string {
+	var items [][]string
+	start := -1
+	for i, line := range lines {
+		if line != "-" && !strings.HasPrefix(line, "- ") {
+			continue
+		}
+		if start >= 0 {
+			items = append(items, yamlItem(lines[start:i]))
+		}
+		start = i
+	}
+	if start >= 0 {
+		items = append(items, yamlItem(lines[start:]))
+	}
+	return items
+}
+
+// yamlItem returns the lines of an item of a block sequence, starting with its
+// dash, which is replaced with a space so what follows is indented like the
+// rest of the item.
+func yamlItem(lines []string) []string {
+	item := append([]string{" " + lines[0][1:]}, lines[1:]...)
+	return dedent(item)
+}
+
+// dedent removes the indentation shared by the lines that are neither blank
+// nor comments, and any leading blank lines. Comments less indented than that
+// have all their indentation removed.
+func dedent(lines []string) []string {
+	min := -1
+	for _, line := range lines {
+		if !isYAMLContent(line) {
+			continue
+		}
+		if n := len(line) - len(strings.TrimLeft(line, " ")); min < 0 || n < min {
+			min = n
+		}
+	}
+	if min < 0 {
+		min = 0
+	}
+	var out []string
+	for _, line := range lines {
+		if len(out) == 0 && strings.TrimSpace(line) == "" {
+			continue
+		}
+		n := len(line) - len(strings.TrimLeft(line, " "))
+		if n > min {
+			n = min
+		}
+		out = append(out, line[n:])
+	}
+	return out
+}
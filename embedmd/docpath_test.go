@@ -0,0 +1,142 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import "testing"
+
+const petsJSON = `{
+  "openapi": "3.0.0",
+  "paths": {
+    "/pets": {
+      "get": {"summary": "List all pets", "tags": ["pets", "read"]},
+      "post": {"summary": "Create a pet"}
+    },
+    "/pets.json": {"get": {"summary": "List all pets as JSON"}}
+  }
+}`
+
+const petsYAML = `---
+# the pet store.
+openapi: 3.0.0
+paths:
+  /pets:
+    get:
+      summary: List all pets # for everyone
+      tags:
+      - pets
+      - read
+      parameters:
+        - name: limit
+          in: query
+          description: |
+            How many items to return at one time.
+
+            No more than 100.
+        - name: offset
+          in: query
+
+  "/pets/{id}":
+    get:
+      summary: 'Info for a pet: its name'
+`
+
+func TestSelectPath(t *testing.T) {
+	tc := []struct {
+		name string
+		lang string
+		in   string
+		path string
+		out  string
+		err  string
+	}{
+		{name: "json object",
+			lang: "json", in: petsJSON, path: "jsonpath:$.paths./pets.get",
+			out: "{\n  \"summary\": \"List all pets\",\n  \"tags\": [\n    \"pets\",\n    \"read\"\n  ]\n}\n"},
+		{name: "json item",
+			lang: "json", in: petsJSON, path: "jsonpath:$.paths./pets.get.tags[1]",
+			out: "\"read\"\n"},
+		{name: "json quoted key",
+			lang: "json", in: petsJSON, path: `jsonpath:$.paths["/pets.json"].get.summary`,
+			out: "\"List all pets as JSON\"\n"},
+		{name: "json whole document",
+			lang: "json", in: `{"a":1}`, path: "jsonpath:$",
+			out: "{\n  \"a\": 1\n}\n"},
+		{name: "json missing key",
+			lang: "json", in: petsJSON, path: "jsonpath:$.paths./pets.put",
+			err: `no key "put" in $.paths./pets`},
+		{name: "json missing index",
+			lang: "json", in: petsJSON, path: "jsonpath:$.paths./pets.get.tags[2]",
+			err: "no index 2 in $.paths./pets.get.tags, which has 2 items"},
+		{name: "json key in a string",
+			lang: "json", in: petsJSON, path: "jsonpath:$.openapi.version",
+			err: `no key "version" in $.openapi, which is not an object`},
+		{name: "json index in an object",
+			lang: "json", in: petsJSON, path: "jsonpath:$.paths[0]",
+			err: "no index 0 in $.paths, which is not an array"},
+		{name: "invalid json",
+			lang: "json", in: `{"a":`, path: "jsonpath:$.a",
+			err: "unexpected end of JSON input"},
+		{name: "yaml mapping",
+			lang: "yaml", in: petsYAML, path: "jsonpath:$.paths./pets.get.tags",
+			out: "- pets\n- read\n"},
+		{name: "yaml sequence item",
+			lang: "yaml", in: petsYAML, path: "yamlpath:paths./pets.get.parameters[0]",
+			out: "name: limit\n" +
+				"in: query\n" +
+				"description: |\n" +
+				"  How many items to return at one time.\n" +
+				"\n" +
+				"  No more than 100.\n"},
+		{name: "yaml scalar",
+			lang: "yaml", in: petsYAML, path: "yamlpath:paths./pets.get.summary",
+			out: "List all pets\n"},
+		{name: "yaml quoted key",
+			lang: "yml", in: petsYAML, path: `yamlpath:paths["/pets/{id}"].get`,
+			out: "summary: 'Info for a pet: its name'\n"},
+		{name: "yaml top-level key",
+			lang: "yaml", in: petsYAML, path: "yamlpath:openapi",
+			out: "3.0.0\n"},
+		{name: "yaml missing key",
+			lang: "yaml", in: petsYAML, path: "jsonpath:$.paths./pets.post",
+			err: `no key "post" in $.paths./pets`},
+		{name: "yaml missing index",
+			lang: "yaml", in: petsYAML, path: "yamlpath:paths./pets.get.parameters[2]",
+			err: "no index 2 in $.paths./pets.get.parameters, which has 2 items"},
+		{name: "yaml key in a scalar",
+			lang: "yaml", in: petsYAML, path: "yamlpath:openapi.version",
+			err: `no key "version" in $.openapi, which is not a mapping`},
+		{name: "yaml key in a flow mapping",
+			lang: "yaml", in: "tags: {a: 1}\n", path: "yamlpath:tags.a",
+			err: `no key "a" in $.tags, which is not a mapping`},
+		{name: "unsupported language",
+			lang: "toml", in: "a = 1\n", path: "jsonpath:$.a",
+			err: `cannot select a path in language "toml"`},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parseDocPath(tt.path)
+			if err != nil {
+				t.Fatalf("could not parse %q: %v", tt.path, err)
+			}
+			out, err := selectPath(tt.lang, []byte(tt.in), keys)
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			if string(out) != tt.out {
+				t.Errorf("case [%s]: expected %q; got %q", tt.name, tt.out, out)
+			}
+		})
+	}
+}
@@ -24,7 +24,13 @@
 // a url starting with http:// or https://.
 // If the pathOrURL is a url the tool will fetch the content in that url.
 // The embedded content starts at the first line that matches /start regexp/
-// and finishes at the first line matching /end regexp/.
+// and finishes at the first line matching /end regexp/. More precisely, it
+// starts where the match of /start regexp/ starts and finishes right where
+// the following match of /end regexp/ finishes, so the newline after it is
+// only included if the regular expression matches it, or with the option
+// WithIncludeTrailingNewline. Either way, the closing fence of the code block
+// goes in its own line, and the fences are longer than any run of backticks in
+// the content, so it never closes the code block early.
 //
 // Omitting the the second regular expression will embed only the piece of
 // text that matches /regexp/:
@@ -39,10 +45,80 @@
 //
 //     [embedmd]:# (pathOrURL language /start regexp/ $)
 //
+// EOF can be used instead of $ as the end, with the same meaning:
+//
+//     [embedmd]:# (pathOrURL language /start regexp/ EOF)
+//
+// To embed the paragraph starting at a point, up to the first blank line after
+// the line where /start regexp/ matches, use blank as the end:
+//
+//     [embedmd]:# (pathOrURL language /start regexp/ blank)
+//
+// To embed the line where /start regexp/ matches and the N lines after it,
+// use +N as the end:
+//
+//     [embedmd]:# (pathOrURL language /start regexp/ +3)
+//
+// Flags can follow the closing slash of a regular expression. With the s flag
+// the . matches newlines too, so a single regular expression can span several
+// lines:
+//
+//     [embedmd]:# (pathOrURL language /func main.*}/s)
+//
+// The i flag makes it case-insensitive, so /todo/i matches both TODO and todo,
+// and flags can be combined, as in /func main.*}/is. The m flag is accepted
+// too, though ^ and $ always match at the start and end of lines. Flags only
+// follow the closing slash, so the i in /docs\/i/ is part of the expression.
+//
+// A regular expression can be followed by an occurrence index to use its Nth
+// match in the file rather than the first one. The end must come after the
+// start, even when both use the same regular expression, so this embeds the
+// content between the second and third separators of a slide deck:
+//
+//     [embedmd]:# (slides.md /---/[2] /---/[3])
+//
+// The brackets can be omitted, as in /func foo/2, which embeds the second
+// definition of foo, such as one for another build tag:
+//
+//     [embedmd]:# (code.go /func foo/2 /^}/)
+//
+// If the start regular expression has a group, the embedded content starts
+// where its first group matches rather than where the whole expression does,
+// so the text before the group only anchors the start. The content finishes
+// where the whole expression, or the end, matches, and groups in the end are
+// ignored. This embeds a function without the comment line before it:
+//
+//     [embedmd]:# (code.go /Hello says hello\.\n(func)/ /^}/)
+//
 // Finally you can embed a whole file by omitting both regular expressions:
 //
 //     [embedmd]:# (pathOrURL language)
 //
+// Paths starting with // are relative to the root of the repository rather
+// than to the markdown file, which avoids long chains of ../ in monorepos. The
+// root is the closest directory with a .git entry, unless set with WithRepoRoot.
+// Outside of a repository, they are relative to the directory set with
+// WithRootFallback, or the current directory.
+//
+//     [embedmd]:# (//pkg/server/code.go)
+//
+// With WithSSH, files on hosts only reachable over ssh are read by running ssh,
+// with paths such as user@host:path or scp://user@host:port/path:
+//
+//     [embedmd]:# (git@build.internal:src/server/main.go /func main/ /^}/)
+//
+// A url can also select a range of lines with a fragment such as #L10-L20, or
+// #L10 for a single line, as found in GitHub permalinks. The fragment is never
+// sent to the server, and urls of files in GitHub repositories are fetched
+// from their raw content:
+//
+//     [embedmd]:# (https://github.com/user/repo/blob/sha/file.go#L10-L20)
+//
+// Local files select their lines with the same range given as an argument,
+// which cannot be combined with regular expressions:
+//
+//     [embedmd]:# (file.go #L10-L20)
+//
 // You can ommit the language in any of the previous commands, and the extension
 // of the file will be used for the snippet syntax highlighting. Note that while
 // this works Go files, since the file extension .go matches the name of the language
@@ -50,104 +126,1560 @@
 //
 //     [embedmd]:# (file.ext)
 //
+// Files with no extension need a language, unless the WithLangGuessing option
+// is used to guess it from their content.
+//
+// Commands can be grouped with the tabs markers, so their code blocks are shown
+// as tabs by Docusaurus. Everything between the markers other than the commands
+// is generated, wrapping each code block in its own <TabItem>:
+//
+//     [embedmd]:# (tabs)
+//     [embedmd]:# (hello.go)
+//     [embedmd]:# (hello.py)
+//     [embedmd]:# (/tabs)
+//
+// Commands inside code blocks are ignored, unless the info string of the block
+// has the embedmd flag, as in ````md embedmd. Such blocks must be opened with
+// more backticks than the code blocks generated in them, or with tildes, as in
+// ~~~md embedmd. As in CommonMark, a code block is only closed by a fence of
+// the same character, at least as long as the one opening it.
+//
+// The info string of a code block after its language, such as {.line-numbers}
+// in ```go {.line-numbers}, is kept when the block is generated again, so
+// attributes for syntax highlighters can be added by hand.
+//
+// Documents written in AsciiDoc can be processed with WithFormat(AsciiDoc).
+// Their commands are comments starting with // embedmd:, with the same
+// arguments, which generate source blocks delimited by ---- lines, or longer
+// ones if the content has such a line. Commands in listing blocks are ignored,
+// and the attributes after the language, as in [source,go,linenums], are kept.
+//
+//     // embedmd:(code.go /func main/ $)
+//
+// Flags can be added after the path to change how the content is embedded:
+//
+//     strip-license: removes the first comment block, such as a license
+//         header, at the top of the embedded content (after the shebang line
+//         if any), together with the blank lines after it. Comment blocks are
+//         /* */ comments or runs of // lines, and also runs of # lines for
+//         languages using # for comments, like python or sh.
+//
+//     strip-shebang: removes the first line of the embedded content if it is
+//         a shebang line, such as #!/bin/bash, which is kept by default.
+//
+//     strip=/regexp/: removes the lines of the embedded content matching the
+//         regular expression, such as strip=/^\/\/go:build/ for build
+//         constraints. It can be given several times.
+//
+//     grep=/regexp/ and grep-v=/regexp/: embed only the lines of the selected
+//         content matching the regular expression, or not matching it, such
+//         as grep=/^export / for the exports of a script. They work on the
+//         whole file or on the content between the start and end, and can be
+//         given several times, so a line is embedded only if it passes every
+//         filter.
+//
+//     no-trim: keeps the whitespace at the end of the lines, which
+//         WithTrimTrailingSpace removes by default for the other commands.
+//
+//     raw-indent: keeps the tabs used for indentation even when
+//         WithExpandLeadingTabs expands them for the other commands.
+//
+//     wrap=N: wraps the lines longer than N characters, as WithWrap does for
+//         every command.
+//
+//     numbered: prefixes each line with its number in the source file, so
+//         fragments selected with regular expressions or line ranges keep
+//         their real numbers. It cannot be combined with strip-license or
+//         with the languages formatted by WithPrettyPrint or WithSortedKeys.
+//
+//     [embedmd]:# (pathOrURL language strip-license)
+//
+// Commands can also assert the content they embed, failing when it drifts: the
+// expect-lines=N flag requires N lines, and expect-sha=HASH requires the
+// SHA-256 hash of the content, in hexadecimal, to start with HASH. Both apply
+// to the content as embedded, including a final newline.
+//
+//     [embedmd]:# (pathOrURL language /start/ /end/ expect-lines=12 expect-sha=315d64f9)
+//
+// Small images can be inlined, so the markdown is self-contained, with the
+// image flag. Rather than a code block, the command generates a markdown image
+// whose source is a data URI, and replaces it when run again. Images larger
+// than 64KiB, or the size given to WithMaxFileSize, are not inlined.
+//
+//     [embedmd]:# (logo.png image)
+//
+// The index flag keeps a list of links to the markdown files in a local
+// directory, using the first level one heading of each file as its title, or
+// its name if there is none. The list is regenerated on every run, so index
+// pages stay in sync as documents are added.
+//
+//     [embedmd]:# (docs/ index)
+//
+// The tree flag embeds, in a text code block, a tree listing the files in a
+// local directory and its subdirectories, only depth=N levels deep if given.
+// Files whose name starts with a dot are skipped unless the hidden flag is
+// used too.
+//
+//     [embedmd]:# (examples/ tree depth=2)
+//
+// The fence:N flag embeds the content of the Nth code block of a markdown
+// file, counting from one, so examples can be shared between documents. The
+// code block keeps the language of the original one unless one is given, and
+// regular expressions select the content within it.
+//
+//     [embedmd]:# (other.md fence:2)
+//
+// For Go files, the #exported flag embeds the declarations of the exported
+// functions, methods, types, variables, and constants, with their doc
+// comments, which gives an overview of the public API of a file. With the
+// no-bodies flag the function bodies are omitted.
+//
+//     [embedmd]:# (code.go #exported no-bodies)
+//
+// The func:name flag embeds the declaration of a single function with its doc
+// comment, found by parsing the Go file, so a closing brace within the body
+// never ends it early as it can with regular expressions. Methods are named
+// after their receiver type, as in func:(*Server).Handle.
+//
+//     [embedmd]:# (code.go func:main)
+//
+// For JSON and YAML files, the jsonpath: and yamlpath: flags embed the value at
+// a path made of keys and indexes, as in $.paths./pets.get or tags[0], which
+// yamlpath: writes with no $. JSON values are indented with two spaces, while
+// YAML ones keep their lines, with the indentation they had in the file
+// removed, so only block mappings and sequences can be followed. The language
+// of the file, json or yaml, selects how it's parsed, and a missing key fails
+// the command with an error naming it.
+//
+//     [embedmd]:# (api.yaml yaml jsonpath:$.paths./pets.get)
+//
+// For other formats, the ext:name flag runs the program embedmd-name, found in
+// the PATH, to extract the content to embed. The program receives the content
+// of the file on its standard input and the arguments following ext:name as
+// its own, and writes the content to embed to its standard output. If it exits
+// with a non zero status the command fails. Since this runs other programs,
+// it requires WithExec.
+//
+//     [embedmd]:# (data.xyz text ext:myparser section=intro)
+//
+// A command starting with exec: embeds the standard output of running the
+// program that follows, in the base directory, so the help of a tool, for
+// instance, never drifts from the docs. The arguments are split on spaces and
+// passed as they are, with no shell, and the code block has the text
+// language. If the program exits with a non zero status, the command fails
+// with its standard error. This runs arbitrary programs, written in the
+// markdown, so it requires WithExec and should never be used on untrusted
+// documents.
+//
+//     [embedmd]:# (exec: mytool --help)
+//
+// The anchor=id flag adds an HTML anchor with the given id before the code
+// block, so it can be linked to. WithAnchors adds them to every code block.
+//
+//     [embedmd]:# (code.go /func ServeHTTP/ /^}/ anchor=serve-http)
+//
+// The collapse flag puts the code block in a <details> element, which GitHub
+// renders collapsed, so long files don't take over the document. Its summary
+// is the path unless given, quoted if it has spaces, as in
+// collapse="Show code". The element is replaced along with the block when run
+// again, rather than nested.
+//
+//     [embedmd]:# (server.go collapse="Show the whole server")
+//
+// The sink=name flag sends the code block generated by the command to the sink
+// with that name, declared with WithSink, instead of the markdown. This can be
+// used to collect the snippets scattered across several documents in a single
+// file.
+//
+//     [embedmd]:# (pathOrURL language sink=examples)
+//
+// The blame flag embeds a summary of git blame for a local file, or a range of
+// its lines, instead of its content. Each line of the summary gives a range of
+// lines, the commit that last changed them, and its author. Since it runs git,
+// it requires the WithExec option.
+//
+//     [embedmd]:# (path blame)
+//
+// The diff:from..to flag embeds, in a diff code block, the unified diff
+// between the versions of a local file in two git refs, such as tags, which
+// is handy for the "what changed" section of release notes. It requires the
+// WithExec option too, and fails for files outside of a git repository.
+//
+//     [embedmd]:# (api.go diff:v1.0..v1.1)
+//
+// Paths like git:ref:path embed a local file as it is in a git ref, such as a
+// tag or a commit, without checking it out, which documents older versions of
+// an API. The path is relative to the markdown file, as usual, and the file
+// does not need to exist anymore. It requires the WithExec option as well.
+//
+//     [embedmd]:# (git:v1.2.0:api.go /func New/ /^}/)
+//
+// The go:vet and go:build flags embed the output of go vet or go build on the
+// local package in the directory at path, or a success marker such as
+// "go vet: ok" if there is none, proving that the examples in it are valid.
+// Packages failing the check have their errors embedded, and a warning is
+// reported unless WithStrictChecks makes the command fail. Since they run go,
+// they require the WithExec option.
+//
+//     [embedmd]:# (./examples go:vet)
+//
+// Instead of a contiguous range, firstlines:/re/ embeds the first line of every
+// match of the regular expression, in order, which is handy to list the
+// signatures of the exported functions in a file:
+//
+//     [embedmd]:# (pathOrURL language firstlines:/^func [A-Z]/)
+//
+// Some extensions are known to need a different language name, so diagrams in
+// .mmd files are embedded as mermaid and .puml files as plantuml, which are the
+// names expected by the renderers supporting them.
+//
 package embedmd
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
 	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
 )
 
 // Process reads markdown from the given io.Reader searching for an embedmd
 // command. When a command is found, it is executed and the output is written
 // into the given io.Writer with the rest of standard markdown.
 func Process(out io.Writer, in io.Reader, opts ...Option) error {
-	e := embedder{Fetcher: fetcher{}}
+	em, err := New(opts...)
+	if err != nil {
+		return err
+	}
+	return em.Process(out, in)
+}
+
+// An Embedder processes markdown with the options given once to New, so a
+// program processing many documents, such as a static site generator, can
+// reuse it and share its fetcher, with the content kept by WithFetchCache or
+// WithCache, and the statistics or bundle collected, across them. The anchors,
+// overlapping line ranges, and sinks are still kept for each document
+// separately, as with Process. An Embedder must not be used by several
+// goroutines at once.
+type Embedder struct {
+	e embedder
+}
+
+// New returns an Embedder processing markdown with the given options. It fails
+// if an environment variable used in WithHTTPHeader is not set.
+func New(opts ...Option) (*Embedder, error) {
+	e := embedder{httpClient: defaultClient, trimSpace: true}
+	for _, opt := range opts {
+		opt.f(&e)
+	}
+	header, err := expandHeader(e.header)
+	if err != nil {
+		return nil, err
+	}
+	if e.Fetcher == nil {
+		e.Fetcher = fetcher{e.httpClient, header}
+	}
+	if e.fetchOnce {
+		e.Fetcher = &cachingFetcher{Fetcher: e.Fetcher}
+	}
+	if e.placeholder != "" {
+		e.Fetcher = missingFetcher{e.Fetcher}
+	}
+	if e.safe {
+		e.Fetcher = safeFetcher{e.Fetcher, e.root}
+		e.exec, e.ssh = false, false
+	}
+	if e.tracked {
+		e.Fetcher = trackedFetcher{e.Fetcher, e.trackedStrict}
+	}
+	if e.cache != nil {
+		e.cache.settings = e.cacheSettings()
+	}
+	return &Embedder{e}, nil
+}
+
+// Process reads markdown from in and writes it to out with the code blocks of
+// its embedmd commands, as the Process function does with the options of em.
+func (em *Embedder) Process(out io.Writer, in io.Reader) error {
+	e := em.e
+	// the state kept along a document starts anew with every one.
+	if e.anchors != nil {
+		e.anchors = make(map[string]int)
+	}
+	if e.ranges != nil {
+		e.ranges = make(map[string][]lineRange)
+	}
+	e.sinks = make([]*sink, len(em.e.sinks))
+	for i, s := range em.e.sinks {
+		e.sinks[i] = &sink{name: s.name, w: s.w}
+	}
+
+	p := &parser{
+		run:        e.runCommand,
+		lookahead:  e.lookahead,
+		stale:      e.stale,
+		confirm:    e.confirm,
+		blankAfter: e.blankAfter,
+		guessLang:  true, // scripts have their language found from their shebang.
+		names:      e.names,
+		keepGoing:  e.keepGoing,
+		prefix:     e.prefix,
+		format:     e.format,
+		fenceLang:  e.fenceLang,
+		anchors:    e.anchors != nil,
+	}
+	if e.pinURLs {
+		p.pinned = func(cmd *command) bool { return isURL(cmd.path) }
+	}
+	if e.caption != "" {
+		p.isCaption = captionMatcher(e.caption)
+	}
+	if err := p.process(out, in); err != nil {
+		return err
+	}
+	return e.flushSinks()
+}
+
+// CheckURLs reads markdown from the given io.Reader and checks that the url
+// in every embedmd command using one can be fetched, calling report with the
+// line of the command, the url, and the error found, if any. Nothing is
+// embedded, and only the errors in the markdown itself are returned. Of the
+// options given, only WithHTTPClient and WithHTTPHeader have an effect.
+func CheckURLs(in io.Reader, report func(line int, url string, err error), opts ...Option) error {
+	e := embedder{httpClient: defaultClient}
 	for _, opt := range opts {
 		opt.f(&e)
 	}
-	return process(out, in, e.runCommand)
+	header, err := expandHeader(e.header)
+	if err != nil {
+		return err
+	}
+	run := func(_ io.Writer, cmd *command) error {
+		if isURL(cmd.path) {
+			report(cmd.line, cmd.path, checkURL(e.httpClient, header, cmd.path))
+		}
+		return nil
+	}
+	return process(ioutil.Discard, in, run)
+}
+
+// A Command is an embedmd command found in markdown.
+type Command struct {
+	Line int    // line of the command in the markdown, counting from one.
+	Path string // path or url of the embedded content, as written.
+	Lang string // language of the code block.
+
+	// Start and End are the regular expressions selecting the embedded
+	// content, with their slashes and flags as in /func main/s, or empty if
+	// not given. End can also be $ to embed until the end of the file.
+	Start, End string
+}
+
+// Commands reads markdown from the given io.Reader and returns the embedmd
+// commands found in it, in order, without running them. As with Process, the
+// commands in code blocks are ignored, and so are the markers of tabs. Bad
+// commands are returned as errors with their line number.
+func Commands(in io.Reader) ([]Command, error) {
+	var cmds []Command
+	run := func(_ io.Writer, cmd *command) error {
+		cmds = append(cmds, exportCommand(cmd))
+		return nil
+	}
+	if err := process(ioutil.Discard, in, run); err != nil {
+		return nil, err
+	}
+	return cmds, nil
+}
+
+// exportCommand returns the Command describing cmd.
+func exportCommand(cmd *command) Command {
+	c := Command{Line: cmd.line, Path: cmd.path, Lang: cmd.lang}
+	if cmd.start != nil {
+		c.Start = *cmd.start
+	}
+	if cmd.end != nil {
+		c.End = *cmd.end
+	}
+	return c
 }
 
 // An Option provides a way to adapt the Process function to your needs.
 type Option struct{ f func(*embedder) }
 
 // WithBaseDir indicates that the given path should be used to resolve relative
-// paths.
+// paths. Paths, even absolute ones, are joined to it lexically, as the links
+// in the markdown are, so docs/../code.go is code.go even if docs is a
+// symbolic link, and paths with enough ../ elements refer to files outside of
+// it, unless WithRestrictToBaseDir is used.
 func WithBaseDir(path string) Option {
 	return Option{func(e *embedder) { e.baseDir = path }}
 }
 
+// WithRestrictToBaseDir refuses to read local files, or list directories, that
+// are not in the base directory once symbolic links have been resolved, so a
+// malicious markdown cannot embed files such as ../../etc/passwd. This includes
+// paths starting with // that are relative to a repository root outside of
+// the base directory. URLs are fetched, and the programs run with WithExec are
+// not restricted; use WithSafeMode to lock down those too.
+func WithRestrictToBaseDir() Option {
+	return Option{func(e *embedder) { e.restrict = true }}
+}
+
+// WithRepoRoot sets the root of the repository, which paths starting with //,
+// as in //pkg/server/code.go, are relative to. If not set, the root is the
+// closest directory containing the base directory with a .git entry or, if
+// there is none, the one set with WithRootFallback.
+func WithRepoRoot(path string) Option {
+	return Option{func(e *embedder) { e.repoRoot = path }}
+}
+
+// WithRootFallback sets the directory paths starting with // are relative to
+// when no repository contains the base directory and WithRepoRoot is not used.
+// If not set, it is the current directory.
+func WithRootFallback(path string) Option {
+	return Option{func(e *embedder) { e.rootFallback = path }}
+}
+
 // WithFetcher provides a custom Fetcher to be used whenever a path or url needs
 // to be fetched.
 func WithFetcher(c Fetcher) Option {
 	return Option{func(e *embedder) { e.Fetcher = c }}
 }
 
+// WithHTTPClient makes the urls be fetched with the given client, instead of
+// one giving up after 30 seconds. Either way, urls are fetched again up to two
+// times when the server fails with a 5xx status. It has no effect along with
+// WithFetcher.
+func WithHTTPClient(c *http.Client) Option {
+	return Option{func(e *embedder) { e.httpClient = c }}
+}
+
+// WithHTTPHeader adds a header to the requests fetching urls, such as an
+// Authorization header for private servers, and can be given several times.
+// References to environment variables in the value, as in $TOKEN or ${TOKEN},
+// are replaced by their values, so tokens need not be written in scripts;
+// Process fails if any of them is not set. The headers are never used for
+// local files, and have no effect along with WithFetcher.
+func WithHTTPHeader(key, value string) Option {
+	return Option{func(e *embedder) {
+		if e.header == nil {
+			e.header = make(http.Header)
+		}
+		e.header.Add(key, value)
+	}}
+}
+
+// expandHeader returns a copy of the headers with the references to
+// environment variables in their values replaced, or an error if any of the
+// variables is not set.
+func expandHeader(header http.Header) (http.Header, error) {
+	if header == nil {
+		return nil, nil
+	}
+	expanded := make(http.Header)
+	for key, values := range header {
+		for _, v := range values {
+			var missing string
+			v = os.Expand(v, func(name string) string {
+				value, ok := os.LookupEnv(name)
+				if !ok && missing == "" {
+					missing = name
+				}
+				return value
+			})
+			if missing != "" {
+				return nil, fmt.Errorf("header %s: environment variable %s is not set", key, missing)
+			}
+			expanded[key] = append(expanded[key], v)
+		}
+	}
+	return expanded, nil
+}
+
+// WithKeepGoing makes the commands that fail, including the ones that cannot
+// be parsed, be skipped instead of making Process fail, so the errors of all
+// of them can be found at once. Their blocks are kept as they are, and report
+// is called with the line of each of them and its error.
+func WithKeepGoing(report func(line int, err error)) Option {
+	return Option{func(e *embedder) { e.keepGoing = report }}
+}
+
+// WithCommandPrefix makes the commands start with the given prefix instead of
+// [embedmd]:#, as in [embed]:# (code.go). To keep the commands hidden when the
+// markdown is rendered, the prefix should be a link reference definition too.
+func WithCommandPrefix(prefix string) Option {
+	return Option{func(e *embedder) { e.prefix = prefix }}
+}
+
+// WithFetchCache makes each file or url be fetched only once per call to
+// Process, even when several commands embed parts of it. Errors are not kept,
+// so a command failing to fetch some content doesn't make the next ones using
+// it fail too.
+func WithFetchCache() Option {
+	return Option{func(e *embedder) { e.fetchOnce = true }}
+}
+
+// WithLookahead allows up to n lines of text, such as a caption, between a
+// command and the code block it manages. By default the code block must
+// immediately follow the command.
+//
+// Any line that is neither a command nor the start of a code block counts
+// towards the limit. If no code block starts within the next n lines, a new
+// one is generated right after the command and the lines are kept after it.
+func WithLookahead(n int) Option {
+	return Option{func(e *embedder) { e.lookahead = n }}
+}
+
+// WithPrettyPrint reformats the content embedded for the given languages so
+// every element is on its own line, making changes easier to review in diffs.
+// Only json is supported for now, and content that is not valid for its
+// formatter makes the command fail.
+func WithPrettyPrint(langs ...string) Option {
+	return Option{func(e *embedder) {
+		if e.pretty == nil {
+			e.pretty = make(map[string]bool)
+		}
+		for _, lang := range langs {
+			e.pretty[lang] = true
+		}
+	}}
+}
+
+// WithSortedKeys reformats the content embedded for the given languages like
+// WithPrettyPrint, also sorting the keys of every object, so the embedded
+// content is stable when the source reorders them. Only json is supported for
+// now, and content that is not valid json makes the command fail.
+func WithSortedKeys(langs ...string) Option {
+	return Option{func(e *embedder) {
+		if e.sorted == nil {
+			e.sorted = make(map[string]bool)
+		}
+		for _, lang := range langs {
+			e.sorted[lang] = true
+		}
+	}}
+}
+
+// WithStaleBlocks calls f with the line number of every command whose
+// generated code block is missing or differs from the one in the input.
+func WithStaleBlocks(f func(line int)) Option {
+	return Option{func(e *embedder) { e.stale = f }}
+}
+
+// WithConfirmation calls f for every command whose generated content differs
+// from the one in the input, with the line of the command and both contents.
+// The new content is only written if f returns true, otherwise the old one is
+// kept as is.
+func WithConfirmation(f func(line int, old, new string) bool) Option {
+	return Option{func(e *embedder) { e.confirm = f }}
+}
+
+// WithSourceLinks adds a link to the url of the embedded content after the
+// code blocks of the commands embedding urls, such as [(source)](url), which
+// is replaced when run again. If blob is true, urls of the raw content of
+// files in GitHub repositories are replaced with the url of the page showing
+// them, which is easier to read.
+func WithSourceLinks(blob bool) Option {
+	return Option{func(e *embedder) { e.sourceLinks, e.blobLinks = true, blob }}
+}
+
+// WithAnchors adds an HTML anchor before every generated code block, such as
+// <a id="code-go-func-main"></a>, so it can be linked to. The id is made of
+// the name of the embedded file and the regular expressions or lines
+// selecting the content, and a number is added to the ids already used in the
+// markdown to keep them unique. The anchor=id flag gives the id for a single
+// command, with or without this option.
+func WithAnchors() Option {
+	return Option{func(e *embedder) { e.anchors = make(map[string]int) }}
+}
+
+// WithPinnedURLs keeps the blocks generated by the commands embedding urls as
+// they are in the input, without fetching the urls again, so remote content
+// is pinned once it is first embedded. Only the commands with no block yet
+// fetch their urls. Commands within tabs are not pinned.
+func WithPinnedURLs() Option {
+	return Option{func(e *embedder) { e.pinURLs = true }}
+}
+
+// WithCaption adds a visible caption before every code block with the given
+// format, where {path} is replaced by the path or url of the embedded content,
+// so readers can see where it comes from, as in "> from {path}". Captions are
+// generated again with the code blocks, like the anchors added by WithAnchors,
+// which go before them.
+func WithCaption(format string) Option {
+	return Option{func(e *embedder) { e.caption = format }}
+}
+
+// WithLangGuessing makes the commands embedding files with no extension, no
+// well-known name, no shebang line, and no given language guess it from some
+// distinctive syntax in the content, such as a package clause followed by
+// functions for go. Commands whose language is not clear fail as they do
+// without this option, since guessing can be wrong.
+func WithLangGuessing() Option {
+	return Option{func(e *embedder) { e.guessLang = true }}
+}
+
+// WithFileNameLang makes the code blocks of the files called name, such as
+// Dockerfile or .bashrc, use lang as their language unless a language is
+// given in the command. The files with a well-known name have a built-in
+// language, such as dockerfile or bash, which this replaces, and the name
+// takes precedence over the extension, if any, as in CMakeLists.txt. It can
+// be used several times.
+func WithFileNameLang(name, lang string) Option {
+	return Option{func(e *embedder) {
+		if e.names == nil {
+			e.names = make(map[string]string)
+		}
+		e.names[name] = lang
+	}}
+}
+
+// WithMissingPlaceholder makes the commands whose content cannot be fetched,
+// such as a missing file, generate a code block containing the placeholder
+// instead of failing, with {path} replaced by the path or url of the content,
+// as in "// source {path} not found". The block is generated again once the
+// content can be fetched. The commands still fail when the content is not
+// allowed, as in safe mode. The problem is reported to WithWarnings, if set.
+func WithMissingPlaceholder(placeholder string) Option {
+	return Option{func(e *embedder) { e.placeholder = placeholder }}
+}
+
+// WithBlankLineAfter makes sure every generated block is followed by a blank
+// line, so the text after it starts a new paragraph. A blank line is inserted
+// only when the line after the block is not already blank, or the end of the
+// file.
+func WithBlankLineAfter() Option {
+	return Option{func(e *embedder) { e.blankAfter = true }}
+}
+
+// WithExpandLeadingTabs replaces the tabs used for indentation in the embedded
+// content with spaces, up to the next multiple of width columns. Only the tabs
+// at the beginning of each line, possibly mixed with spaces, are expanded; any
+// other tab, such as the ones aligning comments or struct tags, is kept.
+// Commands with the raw-indent flag are not affected, and neither are the
+// ones embedding Makefiles, whose language is make, makefile, or mk, since
+// their recipes must be indented with tabs and would not work if copied.
+func WithExpandLeadingTabs(width int) Option {
+	return Option{func(e *embedder) { e.tabWidth = width }}
+}
+
+// WithWrap wraps the lines of the embedded content longer than n characters at
+// the last space that fits, out of quotes if possible, and indents the lines
+// continuing them four more spaces than the line wrapped. Lines with no space
+// to wrap at are kept whole. Commands can set their own width with wrap=N.
+// It has no effect if n is zero or negative.
+//
+// Wrapping changes the content embedded, so wrapped commands or code may no
+// longer work if copied from the markdown, the content no longer matches the
+// lines of the file it comes from, and expect-lines and expect-sha apply to
+// it as wrapped.
+func WithWrap(n int) Option {
+	return Option{func(e *embedder) { e.wrap = n }}
+}
+
+// WithMaxFileSize makes the commands fail when the content they fetch is more
+// than n bytes long. Without it, there is no limit on the content embedded in
+// code blocks, and images larger than 64KiB are not inlined.
+func WithMaxFileSize(n int) Option {
+	return Option{func(e *embedder) { e.maxSize = n }}
+}
+
+// WithSink declares a sink called name, so commands with the sink=name flag
+// write their code blocks to it rather than in the markdown, which is left
+// unchanged after those commands. The code blocks routed to a sink accumulate
+// and are written to w, in order, once the whole markdown has been processed.
+// Nothing is written to any sink if the processing fails.
+func WithSink(name string, w io.Writer) Option {
+	return Option{func(e *embedder) { e.sinks = append(e.sinks, &sink{name: name, w: w}) }}
+}
+
+// A sink accumulates the code blocks routed to it until they are flushed.
+type sink struct {
+	name string
+	w    io.Writer
+	buf  bytes.Buffer
+}
+
+// sink returns the sink with the given name, or nil if there is none.
+func (e *embedder) sink(name string) *sink {
+	for _, s := range e.sinks {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// flushSinks writes the code blocks accumulated by each sink.
+func (e *embedder) flushSinks() error {
+	for _, s := range e.sinks {
+		if s.buf.Len() == 0 {
+			continue
+		}
+		if _, err := s.w.Write(s.buf.Bytes()); err != nil {
+			return fmt.Errorf("could not write to sink %q: %v", s.name, err)
+		}
+	}
+	return nil
+}
+
+// WithIncludeTrailingNewline sets whether the newline right after the last
+// match of the regular expressions delimiting the embedded content is part of
+// it. By default it is only included if the regular expression matches it.
+// Either way the closing fence of the code block goes in its own line, as a
+// newline is added to the content when it doesn't end with one.
+func WithIncludeTrailingNewline(include bool) Option {
+	return Option{func(e *embedder) { e.newline = include }}
+}
+
+// WithSafeMode locks down the commands so they can be run on untrusted
+// markdown: fetching urls is not allowed, nor reading files that are not in
+// the root directory once symbolic links have been resolved, nor running
+// other programs even if WithExec is used.
+func WithSafeMode(root string) Option {
+	return Option{func(e *embedder) { e.safe, e.root = true, root }}
+}
+
+// WithExec allows the commands that run other programs, such as blame which
+// runs git, go:vet and go:build, the ones using extractors, or exec: which runs
+// any program named in the markdown, so it is unsafe for untrusted documents.
+func WithExec() Option {
+	return Option{func(e *embedder) { e.exec = true }}
+}
+
+// WithStrictChecks makes the commands embedding the output of go vet or go
+// build fail when the package does not pass, instead of embedding the errors
+// and warning about them.
+func WithStrictChecks() Option {
+	return Option{func(e *embedder) { e.strictChecks = true }}
+}
+
+// WithRedact replaces every match of the given patterns in the embedded
+// content with REDACTED, or only the text matched by their first group if
+// they have one, so secrets that slipped into the sources are never
+// published. If there are no patterns, DefaultSecrets are used.
+func WithRedact(patterns []*regexp.Regexp) Option {
+	if len(patterns) == 0 {
+		patterns = DefaultSecrets
+	}
+	return Option{func(e *embedder) { e.secrets = patterns }}
+}
+
+// WithTrimTrailingSpace sets whether the whitespace at the end of each
+// embedded line is removed, together with the empty lines at the end of the
+// content, so code blocks always finish with a single newline. It is enabled
+// unless given false. Indentation and the empty lines between others are kept.
+// Commands with the no-trim flag are not affected.
+func WithTrimTrailingSpace(trim bool) Option {
+	return Option{func(e *embedder) { e.trimSpace = trim }}
+}
+
+// WithNormalizedText replaces typographic characters with their ASCII
+// equivalents in the content of prose files, whose language is text, txt,
+// plain, plaintext, markdown, or md. Code is never changed. The replacements
+// are:
+//
+//     ‘ ’ ‚ ‛ with '
+//     “ ” „ ‟ with "
+//     non-breaking spaces (U+00A0, U+2007, and U+202F) with a space
+//     – (en dash) with -
+//     — (em dash) with --
+//     … with ...
+func WithNormalizedText() Option {
+	return Option{func(e *embedder) { e.normalize = true }}
+}
+
+// WithRequireTracked makes the commands fail when they embed a local file
+// that is not tracked by git, such as a temporary or ignored file that will
+// not exist on another checkout. URLs are not checked. Files that are not in
+// a git repository are not checked either, unless strict is true, in which
+// case they make the commands fail too.
+func WithRequireTracked(strict bool) Option {
+	return Option{func(e *embedder) { e.tracked, e.trackedStrict = true, strict }}
+}
+
+// WithLangAlias makes the code blocks whose language is name, usually because
+// it is the extension of the embedded file, use lang instead. These aliases
+// take precedence over the built-in ones.
+func WithLangAlias(name, lang string) Option {
+	return Option{func(e *embedder) {
+		if e.langs == nil {
+			e.langs = make(map[string]string)
+		}
+		e.langs[name] = lang
+	}}
+}
+
+// langAliases maps file extensions to the language used in their code blocks
+// when the names differ.
+var langAliases = map[string]string{
+	"mmd":  "mermaid",
+	"puml": "plantuml",
+}
+
 type embedder struct {
 	Fetcher
-	baseDir string
+	baseDir   string
+	repoRoot  string
+	lookahead int
+	pretty    map[string]bool
+	sorted    map[string]bool
+	stale     func(line int)
+	confirm   func(line int, old, new string) bool
+	safe      bool
+	root      string
+	langs     map[string]string
+	stats     *Stats
+	tabWidth  int
+	trimSpace bool
+	normalize bool
+	newline   bool
+	maxSize   int
+	exec      bool
+	sinks     []*sink
+
+	warn        func(line int, msg string)
+	checkIndent bool
+	widths      map[string]int
+	ranges      map[string][]lineRange // nil unless checking overlaps.
+
+	forbidden      []string // substrings the embedded content cannot contain.
+	forbiddenFatal bool     // whether they are errors rather than warnings.
+
+	tracked, trackedStrict bool
+
+	blankAfter bool
+
+	sourceLinks, blobLinks bool
+	pinURLs                bool
+	placeholder            string
+
+	// anchors counts the anchors generated with WithAnchors for each id, so
+	// they are unique in the markdown.
+	anchors map[string]int
+
+	// guessLang enables guessing the language of files with no extension.
+	guessLang bool
+
+	// names maps file names to the language of their code blocks.
+	names map[string]string
+
+	// caption, if not empty, is the format of the captions before code blocks.
+	caption string
+
+	// strictChecks makes the packages failing go vet or go build an error.
+	strictChecks bool
+
+	// bundle, if not nil, collects the embedded sources.
+	bundle *Bundle
+
+	// secrets, if not nil, are the patterns redacted from embedded content.
+	secrets []*regexp.Regexp
+
+	// cache, if not nil, keeps the content extracted across runs.
+	cache *cache
+
+	// fetchOnce shares the content fetched between the commands using it.
+	fetchOnce bool
+
+	// httpClient fetches the urls, unless a Fetcher is given.
+	httpClient *http.Client
+
+	// keepGoing, if not nil, is called with the errors of the commands, which
+	// are skipped instead of stopping.
+	keepGoing func(line int, err error)
+
+	// prefix, if not empty, starts the command lines instead of [embedmd]:#.
+	prefix string
+
+	// format is the markup language of the documents processed.
+	format Format
+
+	// embedded, if not nil, is called with every command run.
+	embedded func(cmd Command, size int)
+
+	// header holds the headers added to the requests fetching urls, with
+	// references to environment variables not yet replaced.
+	header http.Header
+
+	// restrict refuses the local paths escaping the base directory.
+	restrict bool
+
+	// ssh allows reading the files on ssh remotes.
+	ssh bool
+
+	// log, if not nil, gets a line about every command run.
+	log io.Writer
+
+	// wrap, if positive, is the width at which long embedded lines are wrapped.
+	wrap int
+
+	// rootFallback is the root of the paths starting with // outside of any
+	// repository, or the current directory if empty.
+	rootFallback string
 }
 
 func (e *embedder) runCommand(w io.Writer, cmd *command) error {
-	b, err := e.Fetch(e.baseDir, cmd.path)
+	if cmd.sink != "" {
+		s := e.sink(cmd.sink)
+		if s == nil {
+			return fmt.Errorf("unknown sink %q", cmd.sink)
+		}
+		w = &s.buf
+	}
+	if err := e.checkFormat(cmd); err != nil {
+		return err
+	}
+	if cmd.collapse {
+		return e.runCollapsed(w, cmd)
+	}
+	if cmd.blame {
+		return e.runBlame(w, cmd)
+	}
+	if cmd.diffFrom != "" {
+		return e.runRefDiff(w, cmd)
+	}
+	if cmd.index {
+		return e.runIndex(w, cmd)
+	}
+	if cmd.tree {
+		return e.runTree(w, cmd)
+	}
+	if cmd.goTool != "" {
+		return e.runGoTool(w, cmd)
+	}
+	if len(cmd.run) > 0 {
+		return e.runExec(w, cmd)
+	}
+
+	if _, _, ok := splitGitPath(cmd.path); ok && !e.exec {
+		return fmt.Errorf("could not read %s: running git is not allowed", cmd.path)
+	}
+	if isSSHPath(cmd.path) && !e.ssh {
+		return fmt.Errorf("could not read %s: reading files over ssh is not allowed", cmd.path)
+	}
+	dir, rel, err := e.resolve(cmd.path)
 	if err != nil {
 		return fmt.Errorf("could not read %s: %v", cmd.path, err)
 	}
+	b, err := e.Fetch(dir, rel)
+	if me, ok := err.(missingError); ok {
+		return e.writePlaceholder(w, cmd, me.err)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", cmd.path, err)
+	}
+
+	max := e.maxSize
+	if cmd.image && max == 0 {
+		max = defaultMaxImageSize
+	}
+	if max > 0 && len(b) > max {
+		return fmt.Errorf("%s is %d bytes, more than the maximum of %d", cmd.path, len(b), max)
+	}
+	if cmd.image {
+		return e.inlineImage(w, cmd, b)
+	}
+	if cmd.lang == "" && cmd.fence == 0 {
+		if cmd.lang = shebangLang(b); cmd.lang == "" && e.guessLang {
+			cmd.lang = guessLang(b)
+		}
+		if cmd.lang == "" {
+			return errNoLang
+		}
+	}
+	if e.bundle != nil {
+		lang := cmd.lang
+		if cmd.fence > 0 {
+			lang = "markdown" // cmd.lang is the one of the embedded code block.
+		}
+		e.bundle.add(bundlePath(dir, rel), e.fenceLang(lang), b)
+	}
 
-	b, err = extract(b, cmd.start, cmd.end)
+	if e.cache != nil && !isURL(cmd.path) {
+		b, err = e.cache.transform(cmd, b, e.transform)
+	} else {
+		b, err = e.transform(cmd, b)
+	}
 	if err != nil {
-		return fmt.Errorf("could not extract content from %s: %v", cmd.path, err)
+		return err
 	}
 
+	// the closing fence always goes in its own line, whether the extracted
+	// content ends with a newline or not.
 	if len(b) > 0 && b[len(b)-1] != '\n' {
-		b = append(b, '\n')
+		// limit the capacity so the fetched content is never overwritten.
+		b = append(b[:len(b):len(b)], '\n')
 	}
+	lang := e.fenceLang(cmd.lang)
+	e.lint(cmd, lang, b)
+	if err := checkContent(cmd, b); err != nil {
+		return fmt.Errorf("unexpected content from %s: %v", cmd.path, err)
+	}
+	if e.forbiddenFatal {
+		var err error
+		checkForbidden(b, cmd.path, e.forbidden, func(format string, args ...interface{}) {
+			if err == nil {
+				err = fmt.Errorf(format, args...)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	e.record(cmd, b)
 
-	fmt.Fprintln(w, "```"+cmd.lang)
-	w.Write(b)
-	fmt.Fprintln(w, "```")
+	if id := e.anchor(cmd); id != "" {
+		fmt.Fprintf(w, "%s%s\"></a>\n", anchorPrefix, id)
+	}
+	if e.caption != "" {
+		fmt.Fprintln(w, strings.Replace(e.caption, "{path}", cmd.path, -1))
+	}
+	e.writeBlock(w, cmd, lang, b)
+	if e.sourceLinks && isURL(cmd.path) {
+		fmt.Fprintln(w, e.sourceLink(cmd))
+	}
 	return nil
 }
 
-func extract(b []byte, start, end *string) ([]byte, error) {
+// transform extracts the content embedded by cmd from the content b of its
+// file, applying the enabled transformations, such as formatting it.
+func (e *embedder) transform(cmd *command, b []byte) ([]byte, error) {
+	var err error
+	if cmd.fence > 0 {
+		var lang string
+		b, lang, err = extractFence(b, cmd.fence)
+		if err != nil {
+			return nil, fmt.Errorf("could not extract content from %s: %v", cmd.path, err)
+		}
+		if cmd.lang == "" {
+			cmd.lang = lang
+		}
+	}
+	src, first := b, 1 // first is the number of the first line embedded.
+	switch {
+	case cmd.extractor != "":
+		if !e.exec {
+			return nil, fmt.Errorf("could not extract content from %s: running %s%s is not allowed", cmd.path, extractorPrefix, cmd.extractor)
+		}
+		b, err = runExtractor(cmd.extractor, cmd.extractorArgs, b)
+	case cmd.exported:
+		b, err = exportedDecls(b, !cmd.noBodies)
+	case cmd.docPath != "":
+		b, err = selectPath(cmd.lang, b, cmd.docKeys)
+	case cmd.funcName != "":
+		var offset int
+		b, offset, err = funcDecl(b, cmd.funcName)
+		first += bytes.Count(src[:offset], []byte("\n"))
+	case cmd.firstLines != "":
+		b, err = extractFirstLines(b, cmd.firstLines)
+	case cmd.startLine > 0:
+		b, err = extractLines(b, cmd.startLine, cmd.endLine)
+		first = cmd.startLine
+	default:
+		var offset int
+		b, offset, err = extractAt(b, cmd.start, cmd.end, e.newline)
+		first += bytes.Count(src[:offset], []byte("\n"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not extract content from %s: %v", cmd.path, err)
+	}
+	if len(cmd.grep) > 0 || len(cmd.grepV) > 0 {
+		b, err = filterLines(b, cmd.grep, cmd.grepV)
+		if err != nil {
+			return nil, fmt.Errorf("could not filter lines from %s: %v", cmd.path, err)
+		}
+	}
+
+	if cmd.stripShebang && bytes.HasPrefix(b, []byte("#!")) {
+		b = stripShebang(b)
+		first++
+	}
+	if cmd.stripLicense {
+		b = stripLicense(b, cmd.lang)
+	}
+	if len(cmd.strip) > 0 {
+		b, err = stripLines(b, cmd.strip)
+		if err != nil {
+			return nil, fmt.Errorf("could not strip lines from %s: %v", cmd.path, err)
+		}
+	}
+	if e.secrets != nil {
+		b = redact(b, e.secrets)
+	}
+
+	if cmd.numbered && (e.sorted[cmd.lang] || e.pretty[cmd.lang]) {
+		return nil, fmt.Errorf("could not number the lines of %s: its content is formatted", cmd.path)
+	}
+	if e.sorted[cmd.lang] {
+		b, err = sortKeys(cmd.lang, b)
+		if err != nil {
+			return nil, fmt.Errorf("could not sort keys of content from %s: %v", cmd.path, err)
+		}
+	} else if e.pretty[cmd.lang] {
+		b, err = prettyPrint(cmd.lang, b)
+		if err != nil {
+			return nil, fmt.Errorf("could not format content from %s: %v", cmd.path, err)
+		}
+	}
+
+	if e.trimSpace && !cmd.noTrim {
+		b = trimTrailingSpace(b)
+	}
+	if e.normalize && textLangs[cmd.lang] {
+		b = normalizeText(b)
+	}
+	if e.tabWidth > 0 && !cmd.rawIndent && !tabLangs[strings.ToLower(cmd.lang)] {
+		b = expandLeadingTabs(b, e.tabWidth)
+	}
+	if cmd.numbered {
+		b = numberLines(b, first)
+	}
+	return wrapLines(b, e.wrapWidth(cmd)), nil
+}
+
+// wrapWidth returns the width at which the lines embedded by cmd are wrapped,
+// which is the one given to the command, if any, or to WithWrap.
+func (e *embedder) wrapWidth(cmd *command) int {
+	if cmd.wrap > 0 {
+		return cmd.wrap
+	}
+	return e.wrap
+}
+
+// fenceLang returns the language used in code blocks for the given one,
+// resolving its aliases.
+func (e *embedder) fenceLang(lang string) string {
+	if l, ok := e.langs[lang]; ok {
+		return l
+	}
+	if l, ok := langAliases[lang]; ok {
+		return l
+	}
+	return lang
+}
+
+// writePlaceholder writes a code block with the placeholder for the content
+// of cmd, which could not be fetched because of err, and warns about it.
+func (e *embedder) writePlaceholder(w io.Writer, cmd *command, err error) error {
+	if e.warn != nil {
+		e.warn(cmd.line, fmt.Sprintf("could not read %s: %v", cmd.path, err))
+	}
+	e.writeBlock(w, cmd, e.fenceLang(cmd.lang), []byte(strings.Replace(e.placeholder, "{path}", cmd.path, -1)))
+	return nil
+}
+
+// captionMatcher returns a function reporting whether a line is a caption with
+// the given format, whatever its path.
+func captionMatcher(format string) func(line string) bool {
+	i := strings.Index(format, "{path}")
+	if i < 0 {
+		return func(line string) bool { return line == format }
+	}
+	prefix, suffix := format[:i], format[i+len("{path}"):]
+	return func(line string) bool {
+		return len(line) > len(prefix)+len(suffix) && strings.HasPrefix(line, prefix) && strings.HasSuffix(line, suffix)
+	}
+}
+
+// anchorPrefix starts the anchors before code blocks.
+const anchorPrefix = "<a id=\""
+
+// anchor returns the id of the anchor before the code block generated by cmd,
+// or an empty string if there is none.
+func (e *embedder) anchor(cmd *command) string {
+	if cmd.anchor != "" || e.anchors == nil {
+		return cmd.anchor
+	}
+	parts := []string{path.Base(cmd.path)}
+	switch {
+	case cmd.startLine > 0:
+		parts = append(parts, fmt.Sprintf("L%d-L%d", cmd.startLine, cmd.endLine))
+	case cmd.start != nil:
+		parts = append(parts, *cmd.start)
+		if cmd.end != nil {
+			parts = append(parts, *cmd.end)
+		}
+	}
+	id := slug(strings.Join(parts, " "))
+	e.anchors[id]++
+	if n := e.anchors[id]; n > 1 {
+		id = fmt.Sprintf("%s-%d", id, n)
+	}
+	return id
+}
+
+// slug returns s in lower case with every run of characters other than
+// letters and digits replaced by a single dash.
+func slug(s string) string {
+	f := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !('a' <= r && r <= 'z' || '0' <= r && r <= '9')
+	})
+	return strings.Join(f, "-")
+}
+
+// sourceLinkPrefix starts the links to the source of embedded urls.
+const sourceLinkPrefix = "[(source)]("
+
+// sourceLink returns a markdown link to the url embedded by cmd, selecting the
+// same lines if any.
+func (e *embedder) sourceLink(cmd *command) string {
+	url := cmd.path
+	if e.blobLinks {
+		url = blobURL(url)
+	}
+	return sourceLinkPrefix + url + cmd.lineRange() + ")"
+}
+
+// extract returns the content of b from the first match of start to the first
+// match of end after it, or only the first match of start if end is nil. If
+// start has groups, the content starts where the first one matches instead,
+// unless it doesn't take part in the match. The content finishes right where
+// the last match does, so the newline after it is not included unless the
+// regular expression matches it, or newline is true, in which case a newline
+// right after the last match is included too. An end like +3 selects the line
+// where start finishes matching and the three lines after it instead.
+func extract(b []byte, start, end *string, newline bool) ([]byte, error) {
+	b, _, err := extractAt(b, start, end, newline)
+	return b, err
+}
+
+// extractAt returns the content extracted like extract, and its offset in b.
+func extractAt(b []byte, start, end *string, newline bool) ([]byte, int, error) {
 	if start == nil && end == nil {
-		return b, nil
+		return b, 0, nil
+	}
+	// upTo returns b up to i, including the newline after it if needed.
+	upTo := func(b []byte, i int) []byte {
+		if newline && i < len(b) && b[i] == '\n' {
+			i++
+		}
+		return b[:i]
 	}
 
-	match := func(s string) ([]int, error) {
-		if len(s) <= 2 || s[0] != '/' || s[len(s)-1] != '/' {
-			return nil, fmt.Errorf("missing slashes (/) around %q", s)
+	// match returns the location of the match of s, searching from the offset
+	// from, followed by the locations of its groups, as in FindSubmatchIndex.
+	// With an occurrence index, the match is the one with that index in the
+	// whole content instead, which must come after the offset after.
+	match := func(s string, from, after int) ([]int, error) {
+		s, n, err := parseOccurrence(s)
+		if err != nil {
+			return nil, err
 		}
-		re, err := regexp.CompilePOSIX(s[1 : len(s)-1])
+		re, err := compileRegexp(s)
 		if err != nil {
 			return nil, err
 		}
-		loc := re.FindIndex(b)
-		if loc == nil {
-			return nil, fmt.Errorf("could not match %q", s)
+		if n == 0 {
+			loc := re.FindSubmatchIndex(b[from:])
+			if loc == nil {
+				return nil, fmt.Errorf("could not match %q", s)
+			}
+			for i := range loc {
+				if loc[i] >= 0 {
+					loc[i] += from
+				}
+			}
+			return loc, nil
+		}
+		locs := re.FindAllSubmatchIndex(b, n)
+		if len(locs) < n {
+			return nil, fmt.Errorf("could not match %q %d times", s, n)
+		}
+		loc := locs[n-1]
+		if loc[0] < after {
+			return nil, fmt.Errorf("match %d of %q is before the start", n, s)
 		}
 		return loc, nil
 	}
 
+	from, after := 0, 0
 	if *start != "" {
-		loc, err := match(*start)
+		loc, err := match(*start, 0, 0)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
+		}
+		// the content starts at the first group, if the regexp has one.
+		from = loc[0]
+		if len(loc) > 2 && loc[2] >= 0 {
+			from = loc[2]
 		}
 		if end == nil {
-			return b[loc[0]:loc[1]], nil
+			return upTo(b, loc[1])[from:], from, nil
 		}
-		b = b[loc[0]:]
+		after = loc[1]
 	}
 
-	if *end != "$" {
-		loc, err := match(*end)
+	switch *end {
+	case "$":
+		b = b[from:]
+	case "blank":
+		b = untilBlankLine(b[from:])
+	default:
+		if strings.HasPrefix(*end, "+") {
+			n, err := parseLineCount(*end)
+			if err != nil {
+				return nil, 0, err
+			}
+			var ok bool
+			if b, ok = linesAfter(b[from:], after-from, n); !ok {
+				return nil, 0, fmt.Errorf("could not find %d lines after %q", n, *start)
+			}
+			break
+		}
+		loc, err := match(*end, from, after)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
+		}
+		b = upTo(b, loc[1])[from:]
+	}
+
+	return b, from, nil
+}
+
+// parseOccurrence splits a regular expression followed by an occurrence
+// index, as in /---/[2] or /---/2, returning the index or zero if there is
+// none.
+func parseOccurrence(s string) (string, int, error) {
+	if i := len(strings.TrimRight(s, "0123456789")); i < len(s) {
+		n, err := strconv.Atoi(s[i:])
+		if err != nil || n < 1 {
+			return "", 0, fmt.Errorf("bad occurrence in %q", s)
+		}
+		return s[:i], n, nil
+	}
+	i := strings.LastIndexByte(s, '[')
+	if !strings.HasSuffix(s, "]") || i < strings.LastIndexByte(s, '/') {
+		return s, 0, nil
+	}
+	n, err := strconv.Atoi(s[i+1 : len(s)-1])
+	if err != nil || n < 1 {
+		return "", 0, fmt.Errorf("bad occurrence in %q", s)
+	}
+	return s[:i], n, nil
+}
+
+// parseLineCount parses a number of lines given as an end, such as +3.
+func parseLineCount(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(s, "+"))
+	if err != nil || n < 1 || !strings.HasPrefix(s, "+") {
+		return 0, fmt.Errorf("bad line count %q, expected +N with N positive", s)
+	}
+	return n, nil
+}
+
+// linesAfter returns b up to the end of the nth line after the one where the
+// match ending at offset i finishes, including its newline if it has one, and
+// whether b has that many lines.
+func linesAfter(b []byte, i, n int) ([]byte, bool) {
+	if i > 0 && b[i-1] == '\n' {
+		i-- // the newline matched ends the line of the match.
+	}
+	for line := 0; line <= n; line++ {
+		if line > 0 && i == len(b) {
+			return nil, false
+		}
+		if j := bytes.IndexByte(b[i:], '\n'); j >= 0 {
+			i += j + 1
+		} else {
+			i = len(b)
 		}
-		b = b[:loc[1]]
 	}
+	return b[:i], true
+}
 
-	return b, nil
+// untilBlankLine returns b up to the first blank line after its first line,
+// including the newline before it, or the whole of b if there is none.
+func untilBlankLine(b []byte) []byte {
+	for i := bytes.IndexByte(b, '\n'); i >= 0 && i+1 < len(b); {
+		line := b[i+1:]
+		j := bytes.IndexByte(line, '\n')
+		if j >= 0 {
+			line = line[:j]
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			return b[:i+1]
+		}
+		if j < 0 {
+			break
+		}
+		i += j + 1
+	}
+	return b
+}
+
+// runBlame writes a code block with the summary of git blame for the file
+// used by the command.
+func (e *embedder) runBlame(w io.Writer, cmd *command) error {
+	if !e.exec {
+		return fmt.Errorf("could not blame %s: running git is not allowed", cmd.path)
+	}
+	if isURL(cmd.path) {
+		return fmt.Errorf("could not blame %s: only local files can be blamed", cmd.path)
+	}
+	dir, rel, err := e.resolve(cmd.path)
+	if err != nil {
+		return fmt.Errorf("could not blame %s: %v", cmd.path, err)
+	}
+	b, err := blame(filepath.Join(dir, filepath.FromSlash(rel)), cmd.startLine, cmd.endLine)
+	if err != nil {
+		return fmt.Errorf("could not blame %s: %v", cmd.path, err)
+	}
+	e.record(cmd, b)
+	e.writeBlock(w, cmd, "text", b)
+	return nil
+}
+
+// resolve returns the directory the path used by a command is relative to,
+// and the path relative to it. Paths starting with // are relative to the root
+// of the repository, or the fallback root outside of one, and any other path
+// to the base directory. With
+// WithRestrictToBaseDir, local paths escaping the base directory are an error.
+func (e *embedder) resolve(path string) (dir, rel string, err error) {
+	dir, rel = e.baseDir, path
+	if strings.HasPrefix(path, "//") {
+		if dir = e.repoRoot; dir == "" {
+			if dir, err = findRepoRoot(e.baseDir); err != nil {
+				dir = e.rootFallback
+			}
+		}
+		rel = path[2:]
+	}
+	if e.restrict && !isURL(rel) && !isSSHPath(rel) {
+		file := rel
+		if _, f, ok := splitGitPath(rel); ok {
+			file = f
+		}
+		if err := inBaseDir(e.baseDir, filepath.Join(dir, filepath.FromSlash(file))); err != nil {
+			return "", "", err
+		}
+	}
+	return dir, rel, nil
+}
+
+// defaultMaxImageSize is the size of the largest image inlined when no maximum
+// file size is set.
+const defaultMaxImageSize = 64 << 10
+
+// inlineImage writes a markdown image of the content b, inlined as a data URI.
+func (e *embedder) inlineImage(w io.Writer, cmd *command, b []byte) error {
+	typ := mime.TypeByExtension(path.Ext(cmd.path))
+	if i := strings.IndexByte(typ, ';'); i >= 0 {
+		typ = typ[:i]
+	}
+	if !strings.HasPrefix(typ, "image/") {
+		return fmt.Errorf("%s is not an image", cmd.path)
+	}
+	e.record(cmd, b)
+	alt := strings.TrimSuffix(path.Base(cmd.path), path.Ext(cmd.path))
+	_, err := fmt.Fprintf(w, "![%s](data:%s;base64,%s)\n", alt, typ, base64.StdEncoding.EncodeToString(b))
+	return err
+}
+
+// checkContent returns an error if b does not have the number of lines or the
+// hash expected by the command.
+func checkContent(cmd *command, b []byte) error {
+	if n := bytes.Count(b, []byte("\n")); cmd.expectLines > 0 && n != cmd.expectLines {
+		return fmt.Errorf("expected %d lines; got %d", cmd.expectLines, n)
+	}
+	if cmd.expectSHA == "" {
+		return nil
+	}
+	if sum := fmt.Sprintf("%x", sha256.Sum256(b)); !strings.HasPrefix(sum, cmd.expectSHA) {
+		return fmt.Errorf("expected sha %s; got %s", cmd.expectSHA, sum)
+	}
+	return nil
+}
+
+// compileRegexp compiles a regular expression surrounded by slashes, which can
+// be followed by flags: i makes it case-insensitive, s lets . match newlines,
+// and m makes ^ and $ match at line boundaries, which they already do without
+// flags, so it's only accepted for those used to writing it.
+func compileRegexp(s string) (*regexp.Regexp, error) {
+	end := strings.LastIndexByte(s, '/')
+	if len(s) <= 2 || s[0] != '/' || end <= 1 {
+		return nil, fmt.Errorf("missing slashes (/) around %q", s)
+	}
+	expr, flags := s[1:end], s[end+1:]
+	if flags == "" {
+		return regexp.CompilePOSIX(expr)
+	}
+
+	mode := syntax.POSIX
+	for _, f := range flags {
+		switch f {
+		case 'i':
+			mode |= syntax.FoldCase
+		case 's':
+			mode |= syntax.DotNL
+		case 'm':
+			// POSIX mode has no OneLine, so ^ and $ match at line boundaries.
+		default:
+			return nil, fmt.Errorf("unknown flag %q in %q", f, s)
+		}
+	}
+	// regexp.CompilePOSIX accepts no flags, so parse the expression with
+	// them and compile the result matching the leftmost-longest way too.
+	re, err := syntax.Parse(expr, mode)
+	if err != nil {
+		return nil, err
+	}
+	r, err := regexp.Compile(re.String())
+	if err != nil {
+		return nil, err
+	}
+	r.Longest()
+	return r, nil
+}
+
+// extractFirstLines returns, in order, the line where each match of the
+// regular expression re starts. Lines with several matches appear only once.
+func extractFirstLines(b []byte, re string) ([]byte, error) {
+	r, err := compileRegexp(re)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	next := 0 // offset of the line after the last one added.
+	for _, loc := range r.FindAllIndex(b, -1) {
+		if loc[0] < next {
+			continue
+		}
+		start := bytes.LastIndexByte(b[:loc[0]], '\n') + 1
+		next = len(b)
+		if i := bytes.IndexByte(b[loc[0]:], '\n'); i >= 0 {
+			next = loc[0] + i + 1
+		}
+		out = append(out, b[start:next]...)
+	}
+	if out == nil {
+		return nil, fmt.Errorf("could not match %q", re)
+	}
+	return out, nil
+}
+
+// extractLines returns the lines from start to end, both included and
+// counting from one.
+func extractLines(b []byte, start, end int) ([]byte, error) {
+	if start > end {
+		return nil, fmt.Errorf("line range L%d-L%d is inverted", start, end)
+	}
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if end > len(lines) {
+		return nil, fmt.Errorf("line range L%d-L%d is out of bounds, there are only %d lines", start, end, len(lines))
+	}
+	return bytes.Join(lines[start-1:end], nil), nil
 }
@@ -0,0 +1,199 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+)
+
+// exportedDecls returns the declarations of exported functions, methods,
+// types, variables, and constants in the Go source b, with their doc comments,
+// separated by blank lines. Function bodies are omitted unless bodies is true.
+// The declarations are copied from the source, so their formatting is kept.
+func exportedDecls(b []byte, bodies bool) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := goparser.ParseFile(fset, "", b, goparser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	offset := func(p token.Pos) int { return fset.Position(p).Offset }
+	// lineStart returns the offset of the start of the line containing p, so
+	// the indentation is kept.
+	lineStart := func(p token.Pos) int { return bytes.LastIndexByte(b[:offset(p)], '\n') + 1 }
+
+	var out bytes.Buffer
+	add := func(s []byte) {
+		if out.Len() > 0 {
+			out.WriteByte('\n')
+		}
+		out.Write(s)
+		out.WriteByte('\n')
+	}
+
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if !decl.Name.IsExported() || (decl.Recv != nil && !exportedRecv(decl.Recv)) {
+				continue
+			}
+			end := decl.End()
+			if !bodies {
+				end = decl.Type.End()
+			}
+			add(b[offset(docStart(decl.Doc, decl.Pos())):offset(end)])
+		case *ast.GenDecl:
+			if decl.Tok == token.IMPORT {
+				continue
+			}
+			var specs []ast.Spec
+			for _, spec := range decl.Specs {
+				if exportedSpec(spec) {
+					specs = append(specs, spec)
+				}
+			}
+			switch {
+			case len(specs) == 0:
+			case len(specs) == len(decl.Specs):
+				add(b[offset(docStart(decl.Doc, decl.Pos())):offset(decl.End())])
+			default:
+				// only some of the grouped specs are exported.
+				var group bytes.Buffer
+				group.Write(b[offset(docStart(decl.Doc, decl.Pos())):offset(decl.Lparen)])
+				group.WriteString("(\n")
+				for _, spec := range specs {
+					start, end := specRange(spec)
+					group.Write(b[lineStart(start):offset(end)])
+					group.WriteByte('\n')
+				}
+				group.WriteString(")")
+				add(group.Bytes())
+			}
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// docStart returns the position where a declaration starts, including its doc
+// comment if any.
+func docStart(doc *ast.CommentGroup, pos token.Pos) token.Pos {
+	if doc != nil {
+		return doc.Pos()
+	}
+	return pos
+}
+
+// specRange returns the positions where a spec starts and ends, including its
+// doc and line comments.
+func specRange(spec ast.Spec) (start, end token.Pos) {
+	var doc, comment *ast.CommentGroup
+	switch spec := spec.(type) {
+	case *ast.TypeSpec:
+		doc, comment = spec.Doc, spec.Comment
+	case *ast.ValueSpec:
+		doc, comment = spec.Doc, spec.Comment
+	}
+	start, end = docStart(doc, spec.Pos()), spec.End()
+	if comment != nil {
+		end = comment.End()
+	}
+	return start, end
+}
+
+// exportedSpec reports whether the spec declares an exported type, or any
+// exported variable or constant.
+func exportedSpec(spec ast.Spec) bool {
+	switch spec := spec.(type) {
+	case *ast.TypeSpec:
+		return spec.Name.IsExported()
+	case *ast.ValueSpec:
+		for _, name := range spec.Names {
+			if name.IsExported() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exportedRecv reports whether the type of a method receiver is exported.
+func exportedRecv(recv *ast.FieldList) bool {
+	if len(recv.List) == 0 {
+		return false
+	}
+	t := recv.List[0].Type
+	for {
+		switch e := t.(type) {
+		case *ast.StarExpr:
+			t = e.X
+		case *ast.IndexExpr:
+			t = e.X
+		case *ast.ParenExpr:
+			t = e.X
+		case *ast.Ident:
+			return e.IsExported()
+		default:
+			return false
+		}
+	}
+}
+
+// funcDecl returns the declaration of the function or method with the given
+// name in the Go source b, with its doc comment, and its offset in b. Methods
+// are named after their receiver type, as in (*Server).Serve or (T).String,
+// and functions by their name alone.
+func funcDecl(b []byte, name string) ([]byte, int, error) {
+	fset := token.NewFileSet()
+	f, err := goparser.ParseFile(fset, "", b, goparser.ParseComments)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || funcName(fn) != name {
+			continue
+		}
+		start := fset.Position(docStart(fn.Doc, fn.Pos())).Offset
+		return b[start:fset.Position(fn.End()).Offset], start, nil
+	}
+	return nil, 0, fmt.Errorf("could not find func %s", name)
+}
+
+// funcName returns the name of a function declaration as given to func:, with
+// the type of the receiver in parenthesis for methods, without its type
+// parameters.
+func funcName(fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return fn.Name.Name
+	}
+	recv, t := "", fn.Recv.List[0].Type
+	for t != nil {
+		switch e := t.(type) {
+		case *ast.StarExpr:
+			recv, t = "*", e.X
+		case *ast.IndexExpr:
+			t = e.X
+		case *ast.ParenExpr:
+			t = e.X
+		case *ast.Ident:
+			recv, t = recv+e.Name, nil
+		default:
+			t = nil
+		}
+	}
+	return "(" + recv + ")." + fn.Name.Name
+}
@@ -0,0 +1,160 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import "testing"
+
+const api = `package api
+
+import "fmt"
+
+// Version is the version of the API.
+const Version = "1.0"
+
+const (
+	// Red is red.
+	Red = iota
+	green
+	Blue // Blue is blue.
+)
+
+var hidden = 1
+
+// Server serves.
+type Server struct {
+	Addr string
+}
+
+type handler struct{}
+
+// Serve starts serving.
+func (s *Server) Serve() error {
+	return fmt.Errorf("not implemented")
+}
+
+func (h handler) Serve() {}
+
+func helper() {}
+
+// New returns a Server.
+func New(addr string) *Server { return &Server{addr} }
+`
+
+func TestExportedDecls(t *testing.T) {
+	tc := []struct {
+		name   string
+		in     string
+		bodies bool
+		out    string
+		err    string
+	}{
+		{name: "with bodies",
+			in:     api,
+			bodies: true,
+			out: "// Version is the version of the API.\nconst Version = \"1.0\"\n\n" +
+				"const (\n\t// Red is red.\n\tRed = iota\n\tBlue // Blue is blue.\n)\n\n" +
+				"// Server serves.\ntype Server struct {\n\tAddr string\n}\n\n" +
+				"// Serve starts serving.\nfunc (s *Server) Serve() error {\n\treturn fmt.Errorf(\"not implemented\")\n}\n\n" +
+				"// New returns a Server.\nfunc New(addr string) *Server { return &Server{addr} }\n"},
+		{name: "without bodies",
+			in: api,
+			out: "// Version is the version of the API.\nconst Version = \"1.0\"\n\n" +
+				"const (\n\t// Red is red.\n\tRed = iota\n\tBlue // Blue is blue.\n)\n\n" +
+				"// Server serves.\ntype Server struct {\n\tAddr string\n}\n\n" +
+				"// Serve starts serving.\nfunc (s *Server) Serve() error\n\n" +
+				"// New returns a Server.\nfunc New(addr string) *Server\n"},
+		{name: "nothing exported",
+			in:  "package p\n\nfunc f() {}\n",
+			out: ""},
+		{name: "not go",
+			in:  "print hello\n",
+			err: "1:1: expected 'package', found print"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := exportedDecls([]byte(tt.in), tt.bodies)
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			if got := string(b); got != tt.out {
+				t.Errorf("case [%s]: expected %q; got %q", tt.name, tt.out, got)
+			}
+		})
+	}
+}
+
+func TestFuncDecl(t *testing.T) {
+	tc := []struct {
+		name   string
+		in     string
+		fn     string
+		out    string
+		offset int
+		err    string
+	}{
+		{name: "function",
+			in:     api,
+			fn:     "helper",
+			out:    "func helper() {}",
+			offset: 379},
+		{name: "function with a doc comment",
+			in:     api,
+			fn:     "New",
+			out:    "// New returns a Server.\nfunc New(addr string) *Server { return &Server{addr} }",
+			offset: 397},
+		{name: "method with a pointer receiver",
+			in:     api,
+			fn:     "(*Server).Serve",
+			out:    "// Serve starts serving.\nfunc (s *Server) Serve() error {\n\treturn fmt.Errorf(\"not implemented\")\n}",
+			offset: 251},
+		{name: "method with a value receiver",
+			in:     api,
+			fn:     "(handler).Serve",
+			out:    "func (h handler) Serve() {}",
+			offset: 350},
+		{name: "method of a generic type",
+			in:     "package p\n\nfunc (l *List[T]) Len() int { return 0 }\n",
+			fn:     "(*List).Len",
+			out:    "func (l *List[T]) Len() int { return 0 }",
+			offset: 11},
+		{name: "method named as a function",
+			in:  api,
+			fn:  "Serve",
+			err: "could not find func Serve"},
+		{name: "missing receiver pointer",
+			in:  api,
+			fn:  "(Server).Serve",
+			err: "could not find func (Server).Serve"},
+		{name: "not go",
+			in:  "print hello\n",
+			fn:  "main",
+			err: "1:1: expected 'package', found print"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			b, offset, err := funcDecl([]byte(tt.in), tt.fn)
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			if got := string(b); got != tt.out {
+				t.Errorf("case [%s]: expected %q; got %q", tt.name, tt.out, got)
+			}
+			if offset != tt.offset {
+				t.Errorf("case [%s]: expected offset %d; got %d", tt.name, tt.offset, offset)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// extractorPrefix prefixes the names of the programs run as extractors, so
+// ext:name runs embedmd-name.
+const extractorPrefix = "embedmd-"
+
+// runExtractor runs the extractor program with the given name and arguments,
+// passing it the content on its standard input, and returns its standard
+// output. The extractor fails if the program exits with a non zero status.
+func runExtractor(name string, args []string, content []byte) ([]byte, error) {
+	cmd := exec.Command(extractorPrefix+name, args...)
+	cmd.Stdin = bytes.NewReader(content)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s%s failed: %v: %s", extractorPrefix, name, err, msg)
+		}
+		return nil, fmt.Errorf("%s%s failed: %v", extractorPrefix, name, err)
+	}
+	return out, nil
+}
+
+// execPrefix starts the commands embedding the output of a program, as in
+// (exec: mytool --help).
+const execPrefix = "exec:"
+
+// runProgram runs the program with the given arguments in dir and returns its
+// standard output. It fails with the standard error of the program if it exits
+// with a non zero status.
+func runProgram(dir string, args []string) ([]byte, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// runExec writes a code block with the output of the program run by the
+// command in the base directory.
+func (e *embedder) runExec(w io.Writer, cmd *command) error {
+	if !e.exec {
+		return fmt.Errorf("could not run %s: running programs is not allowed", cmd.path)
+	}
+	b, err := runProgram(e.baseDir, cmd.run)
+	if err != nil {
+		return fmt.Errorf("could not run %s: %v", cmd.path, err)
+	}
+	if e.trimSpace && !cmd.noTrim {
+		b = trimTrailingSpace(b)
+	}
+	b = wrapLines(b, e.wrapWidth(cmd))
+	e.record(cmd, b)
+	e.writeBlock(w, cmd, cmd.lang, b)
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// extractor is an extractor program printing its arguments followed by the
+// lines of its input containing the first one, failing if there are none.
+const extractor = `#!/bin/sh
+echo "args: $*"
+grep -e "$1" || { echo "nothing matches $1" >&2; exit 1; }
+`
+
+func TestRunExtractor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("extractors in tests are shell scripts")
+	}
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "embedmd-grep"), []byte(extractor), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tc := []struct {
+		name   string
+		cmd    command
+		noExec bool
+		out    string
+		err    string
+	}{
+		{name: "matching lines",
+			cmd: command{path: "code.go", lang: "go", extractor: "grep", extractorArgs: []string{"fmt", "x"}},
+			out: "```go\nargs: fmt x\nimport \"fmt\"\n        fmt.Println(\"hello, test\")\n```\n"},
+		{name: "failing extractor",
+			cmd: command{path: "code.go", lang: "go", extractor: "grep", extractorArgs: []string{"gopher"}},
+			err: "could not extract content from code.go: embedmd-grep failed: exit status 1: nothing matches gopher"},
+		{name: "missing extractor",
+			cmd: command{path: "code.go", lang: "go", extractor: "missing"},
+			err: "could not extract content from code.go: embedmd-missing failed: exec: \"embedmd-missing\": executable file not found in $PATH"},
+		{name: "running programs not allowed",
+			cmd:    command{path: "code.go", lang: "go", extractor: "grep"},
+			noExec: true,
+			err:    "could not extract content from code.go: running embedmd-grep is not allowed"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			e := embedder{
+				Fetcher: fakeFileProvider{"code.go": []byte(content)},
+				exec:    !tt.noExec,
+			}
+			var out bytes.Buffer
+			err := e.runCommand(&out, &tt.cmd)
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			if got := out.String(); got != tt.out {
+				t.Errorf("case [%s]: expected output %q; got %q", tt.name, tt.out, got)
+			}
+		})
+	}
+}
+
+func TestRunExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("programs in tests are shell scripts")
+	}
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "embedmd-grep"), []byte(extractor), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tc := []struct {
+		name   string
+		in     string
+		noExec bool
+		out    string
+		err    string
+	}{
+		{name: "program output",
+			in:  "(exec: echo hello,   world  )",
+			out: "```text\nhello, world\n```\n"},
+		{name: "run in the base directory",
+			in:  "(exec: ls)",
+			out: "```text\nembedmd-grep\nnotes.txt\n```\n"},
+		{name: "failing program",
+			in:  "(exec: embedmd-grep gopher)",
+			err: "could not run embedmd-grep gopher: exit status 1: nothing matches gopher"},
+		{name: "missing program",
+			in:  "(exec: embedmd-missing)",
+			err: "could not run embedmd-missing: exec: \"embedmd-missing\": executable file not found in $PATH"},
+		{name: "running programs not allowed",
+			in:     "(exec: echo hello)",
+			noExec: true,
+			err:    "could not run echo hello: running programs is not allowed"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := parseCommand(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := embedder{baseDir: dir, exec: !tt.noExec, trimSpace: true}
+			var out bytes.Buffer
+			err = e.runCommand(&out, cmd)
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			if got := out.String(); got != tt.out {
+				t.Errorf("case [%s]: expected output %q; got %q", tt.name, tt.out, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// extractFence returns the content of the nth code block in the markdown b,
+// counting from one, and the language given in its opening fence, if any.
+func extractFence(b []byte, n int) (content []byte, lang string, err error) {
+	count := 0
+	start := -1 // offset of the content of the current code block.
+	fence := "" // fence of the current code block.
+	for off := 0; off < len(b); {
+		end := bytes.IndexByte(b[off:], '\n') + 1
+		if end == 0 {
+			end = len(b) - off
+		}
+		line := strings.TrimRight(string(b[off:off+end]), "\r\n")
+		switch {
+		case start < 0 && isFence(line):
+			count++
+			start = off + end
+			fence = fenceOf(line)
+			if count == n {
+				if f := strings.Fields(line[len(fence):]); len(f) > 0 {
+					lang = f[0]
+				}
+			}
+		case start >= 0 && closesFence(line, fence):
+			if count == n {
+				return b[start:off], lang, nil
+			}
+			start = -1
+		}
+		off += end
+	}
+	if start >= 0 {
+		return nil, "", fmt.Errorf("unbalanced code section")
+	}
+	return nil, "", fmt.Errorf("code block %d not found, there are %d", n, count)
+}
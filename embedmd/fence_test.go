@@ -0,0 +1,52 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import "testing"
+
+const doc = "# Examples\n" +
+	"```go\nfmt.Println(1)\n```\n" +
+	"Some text.\n" +
+	"```\nplain\n```\n" +
+	"``` sh extra\necho hi\n\necho bye\n```"
+
+func TestExtractFence(t *testing.T) {
+	tc := []struct {
+		name string
+		in   string
+		n    int
+		out  string
+		lang string
+		err  string
+	}{
+		{name: "first code block", in: doc, n: 1, out: "fmt.Println(1)\n", lang: "go"},
+		{name: "code block without language", in: doc, n: 2, out: "plain\n"},
+		{name: "last code block", in: doc, n: 3, out: "echo hi\n\necho bye\n", lang: "sh"},
+		{name: "out of range", in: doc, n: 4, err: "code block 4 not found, there are 3"},
+		{name: "unbalanced", in: "```go\ncode\n", n: 2, err: "unbalanced code section"},
+		{name: "tilde code block", in: "~~~md\n```go\ncode\n```\n~~~\n", n: 1, out: "```go\ncode\n```\n", lang: "md"},
+		{name: "code block after a tilde one", in: "~~~\n```\n~~~\n```go\ncode\n```\n", n: 2, out: "code\n", lang: "go"},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			b, lang, err := extractFence([]byte(tt.in), tt.n)
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			if string(b) != tt.out || lang != tt.lang {
+				t.Errorf("case [%s]: expected %q in %q; got %q in %q", tt.name, tt.out, tt.lang, b, lang)
+			}
+		})
+	}
+}
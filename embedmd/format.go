@@ -0,0 +1,72 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// formatters contains the pretty printers available per language.
+var formatters = map[string]func([]byte) ([]byte, error){
+	"json": formatJSON,
+}
+
+func prettyPrint(lang string, b []byte) ([]byte, error) {
+	f, ok := formatters[lang]
+	if !ok {
+		return nil, fmt.Errorf("no pretty printer for language %q", lang)
+	}
+	return f(b)
+}
+
+func formatJSON(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, bytes.TrimSpace(b), "", "  "); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// sortKeys reformats the content like prettyPrint, sorting the keys of every
+// object too. Only json is supported.
+func sortKeys(lang string, b []byte) ([]byte, error) {
+	if lang != "json" {
+		return nil, fmt.Errorf("cannot sort keys for language %q", lang)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	// keep numbers as they are written instead of converting them to float64.
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if err := dec.Decode(&v); err != io.EOF {
+		return nil, errors.New("invalid content after the top-level value")
+	}
+
+	// encoding/json writes the keys of maps sorted.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
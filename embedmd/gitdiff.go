@@ -0,0 +1,100 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// refDiff returns the unified diff between the versions of the file at path
+// in the git refs from and to, with label as the name of the file.
+func refDiff(path, label, from, to string) ([]byte, error) {
+	if _, inRepo := gitTracked(path); !inRepo {
+		return nil, fmt.Errorf("%s is not in a git repository", filepath.ToSlash(path))
+	}
+	dir, file := filepath.Split(path)
+	a, err := gitShow(dir, file, from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := gitShow(dir, file, to)
+	if err != nil {
+		return nil, err
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(a),
+		B:        splitLines(b),
+		FromFile: label + "@" + from,
+		ToFile:   label + "@" + to,
+		Context:  3,
+	})
+	return []byte(diff), err
+}
+
+// splitLines splits b after each newline, unlike difflib.SplitLines, which
+// adds an empty line to content ending with a newline.
+func splitLines(b []byte) []string {
+	lines := strings.SplitAfter(string(b), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// gitShow returns the content in the given git ref of the file at path, which
+// is relative to dir. The directory must exist, but not the file.
+func gitShow(dir, path, ref string) ([]byte, error) {
+	cmd := exec.Command(gitCommand, "show", ref+":./"+filepath.ToSlash(path))
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// runRefDiff writes a code block with the differences between the versions
+// of the file used by the command in two git refs.
+func (e *embedder) runRefDiff(w io.Writer, cmd *command) error {
+	if !e.exec {
+		return fmt.Errorf("could not diff %s: running git is not allowed", cmd.path)
+	}
+	if isURL(cmd.path) {
+		return fmt.Errorf("could not diff %s: only local files can be compared", cmd.path)
+	}
+	dir, rel, err := e.resolve(cmd.path)
+	if err != nil {
+		return fmt.Errorf("could not diff %s: %v", cmd.path, err)
+	}
+	b, err := refDiff(filepath.Join(dir, filepath.FromSlash(rel)), cmd.path, cmd.diffFrom, cmd.diffTo)
+	if err != nil {
+		return fmt.Errorf("could not diff %s: %v", cmd.path, err)
+	}
+	e.record(cmd, b)
+	e.writeBlock(w, cmd, "diff", b)
+	return nil
+}
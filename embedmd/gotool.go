@@ -0,0 +1,81 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// goToolArgs holds the arguments of the go commands that can check a package,
+// which print nothing but the problems found.
+var goToolArgs = map[string][]string{
+	"vet":   {"vet", "."},
+	"build": {"build", "-o", os.DevNull, "."},
+}
+
+// goTool runs the go command with the given name on the package in dir, and
+// returns its output and whether the package passed. The error is only set if
+// the command could not be run at all.
+func goTool(dir, name string) (out []byte, ok bool, err error) {
+	cmd := exec.Command("go", goToolArgs[name]...)
+	cmd.Dir = dir
+	out, err = cmd.CombinedOutput()
+	if _, failed := err.(*exec.ExitError); failed {
+		return out, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
+
+// runGoTool writes a code block with the output of go vet or go build on the
+// package used by the command, or a success marker if there is none.
+func (e *embedder) runGoTool(w io.Writer, cmd *command) error {
+	if !e.exec {
+		return fmt.Errorf("could not check %s: running go is not allowed", cmd.path)
+	}
+	if isURL(cmd.path) {
+		return fmt.Errorf("could not check %s: only local packages can be checked", cmd.path)
+	}
+	dir, rel, err := e.resolve(cmd.path)
+	if err != nil {
+		return fmt.Errorf("could not check %s: %v", cmd.path, err)
+	}
+	b, ok, err := goTool(filepath.Join(dir, filepath.FromSlash(rel)), cmd.goTool)
+	if err != nil {
+		return fmt.Errorf("could not check %s: %v", cmd.path, err)
+	}
+	if !ok {
+		msg := fmt.Sprintf("go %s failed on %s: %s", cmd.goTool, cmd.path, bytes.TrimSpace(b))
+		if e.strictChecks {
+			return errors.New(msg)
+		}
+		if e.warn != nil {
+			e.warn(cmd.line, msg)
+		}
+	}
+	if len(b) == 0 {
+		b = []byte(fmt.Sprintf("go %s: ok\n", cmd.goTool))
+	}
+	e.record(cmd, b)
+	e.writeBlock(w, cmd, "text", b)
+	return nil
+}
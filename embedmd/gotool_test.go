@@ -0,0 +1,112 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGoTool(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"go.mod":        "module example.com/docs\n",
+		"good/main.go":  "package main\n\nfunc main() {}\n",
+		"vet/main.go":   "package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Printf(\"%d\\n\", \"one\") }\n",
+		"build/main.go": "package main\n\nfunc main() { undefined() }\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tc := []struct {
+		name string
+		in   string
+		opts []Option
+		out  string
+		warn string
+		err  string
+	}{
+		{name: "vet passing",
+			in:   "[embedmd]:# (good go:vet)\n",
+			opts: []Option{WithExec()},
+			out:  "[embedmd]:# (good go:vet)\n```text\ngo vet: ok\n```\n"},
+		{name: "build passing",
+			in:   "[embedmd]:# (good go:build)\n",
+			opts: []Option{WithExec()},
+			out:  "[embedmd]:# (good go:build)\n```text\ngo build: ok\n```\n"},
+		{name: "vet failing",
+			in:   "[embedmd]:# (vet go:vet)\n",
+			opts: []Option{WithExec()},
+			out:  "fmt.Printf format %d has arg \"one\" of wrong type string",
+			warn: "1: go vet failed on vet: "},
+		{name: "build failing",
+			in:   "[embedmd]:# (build go:build)\n",
+			opts: []Option{WithExec()},
+			out:  "undefined: undefined",
+			warn: "1: go build failed on build: "},
+		{name: "strict checks",
+			in:   "[embedmd]:# (vet go:vet)\n",
+			opts: []Option{WithExec(), WithStrictChecks()},
+			err:  "1: go vet failed on vet: "},
+		{name: "running go not allowed",
+			in:  "[embedmd]:# (good go:vet)\n",
+			err: "1: could not check good: running go is not allowed"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			var warnings []string
+			warn := func(line int, msg string) { warnings = append(warnings, fmt.Sprintf("%d: %s", line, msg)) }
+			opts := append([]Option{WithBaseDir(dir), WithWarnings(warn)}, tt.opts...)
+			var out bytes.Buffer
+			err := Process(&out, strings.NewReader(tt.in), opts...)
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("case [%s]: expected error starting with %q; got %v", tt.name, tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("case [%s]: unexpected error: %v", tt.name, err)
+			}
+			if !strings.Contains(out.String(), tt.out) {
+				t.Errorf("case [%s]: expected output containing %q; got %q", tt.name, tt.out, out.String())
+			}
+			if got := strings.Join(warnings, "\n"); !strings.HasPrefix(got, tt.warn) || tt.warn == "" && got != "" {
+				t.Errorf("case [%s]: expected warning starting with %q; got %q", tt.name, tt.warn, got)
+			}
+		})
+	}
+}
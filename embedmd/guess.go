@@ -0,0 +1,147 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// nameLangs maps the names of well-known files with no helpful extension to
+// the language of their code blocks.
+var nameLangs = map[string]string{
+	"Dockerfile":    "dockerfile",
+	"Containerfile": "dockerfile",
+	"Makefile":      "makefile",
+	"GNUmakefile":   "makefile",
+	"makefile":      "makefile",
+	"Gemfile":       "ruby",
+	"Rakefile":      "ruby",
+	"Vagrantfile":   "ruby",
+	"Podfile":       "ruby",
+	"Jenkinsfile":   "groovy",
+	"Justfile":      "just",
+	"BUILD":         "starlark",
+	"WORKSPACE":     "starlark",
+	".bashrc":       "bash",
+	".bash_profile": "bash",
+	".zshrc":        "zsh",
+	".profile":      "sh",
+	".gitignore":    "gitignore",
+	".editorconfig": "ini",
+}
+
+// fileLang returns the language of the file at the given path: the one of its
+// name in names or in nameLangs, if any, or else its extension.
+func fileLang(p string, names map[string]string) string {
+	name := path.Base(p)
+	// drop the host or git ref, as in user@host:Makefile or git:v1:Makefile.
+	if i := strings.LastIndexByte(name, ':'); i >= 0 {
+		name = name[i+1:]
+	}
+	if lang, ok := names[name]; ok {
+		return lang
+	}
+	if lang, ok := nameLangs[name]; ok {
+		return lang
+	}
+	return extLang(p)
+}
+
+// interpreterLangs maps the interpreters found in shebang lines, with no
+// version numbers, to the language of their scripts.
+var interpreterLangs = map[string]string{
+	"sh":     "sh",
+	"bash":   "bash",
+	"zsh":    "zsh",
+	"python": "python",
+	"node":   "javascript",
+	"ruby":   "ruby",
+	"perl":   "perl",
+	"php":    "php",
+}
+
+// langSyntax lists the languages that can be told apart by their syntax, each
+// with the patterns that must all match for the content to be written in it.
+var langSyntax = []struct {
+	lang     string
+	patterns []*regexp.Regexp
+}{
+	{"go", []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^package \w+\s*$`),
+		regexp.MustCompile(`(?m)^func .*\{\s*$`),
+	}},
+	{"python", []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^\s*def \w+\(.*\)(\s*->.*)?:\s*$`),
+	}},
+}
+
+// shebangLang returns the language of the script b according to the
+// interpreter in its shebang line, or an empty string if it has none or the
+// interpreter is unknown.
+func shebangLang(b []byte) string {
+	if !bytes.HasPrefix(b, []byte("#!")) {
+		return ""
+	}
+	line := string(b[2:])
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return interpreterLang(strings.Fields(line))
+}
+
+// guessLang returns the language the content is written in, according to its
+// shebang line or its syntax, or an empty string if it's not clear.
+func guessLang(b []byte) string {
+	if bytes.HasPrefix(b, []byte("#!")) {
+		return shebangLang(b)
+	}
+
+	lang := ""
+	for _, s := range langSyntax {
+		matches := true
+		for _, re := range s.patterns {
+			matches = matches && re.Match(b)
+		}
+		if !matches {
+			continue
+		}
+		if lang != "" {
+			return "" // the content looks like more than one language.
+		}
+		lang = s.lang
+	}
+	return lang
+}
+
+// interpreterLang returns the language of the scripts run by the command in a
+// shebang line, such as /usr/bin/env python3, or an empty string if unknown.
+func interpreterLang(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	name := path.Base(args[0])
+	if name == "env" {
+		// skip the options of env, as in /usr/bin/env -S node --harmony.
+		for _, arg := range args[1:] {
+			if !strings.HasPrefix(arg, "-") {
+				return interpreterLang([]string{arg})
+			}
+		}
+		return ""
+	}
+	return interpreterLangs[strings.TrimRight(name, "0123456789.")]
+}
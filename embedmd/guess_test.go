@@ -0,0 +1,64 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import "testing"
+
+func TestFileLang(t *testing.T) {
+	names := map[string]string{"Jenkinsfile": "groovy", "Makefile": "make", "CMakeLists.txt": "cmake"}
+	tc := []struct {
+		path string
+		lang string
+	}{
+		{"code.go", "go"},
+		{"docker/Dockerfile", "dockerfile"},
+		{"GNUmakefile", "makefile"},
+		{"Makefile", "make"},
+		{".bashrc", "bash"},
+		{"home/.bashrc", "bash"},
+		{"ci/Jenkinsfile", "groovy"},
+		{"CMakeLists.txt", "cmake"},
+		{"git:v1.0:Dockerfile", "dockerfile"},
+		{"https://example.com/repo/Gemfile", "ruby"},
+		{"LICENSE", ""},
+	}
+	for _, tt := range tc {
+		if got := fileLang(tt.path, names); got != tt.lang {
+			t.Errorf("language of %s: expected %q; got %q", tt.path, tt.lang, got)
+		}
+	}
+}
+
+func TestGuessLang(t *testing.T) {
+	tc := []struct {
+		name string
+		in   string
+		lang string
+	}{
+		{name: "shebang", in: "#!/bin/bash\necho hi\n", lang: "bash"},
+		{name: "shebang with env", in: "#!/usr/bin/env -S node --harmony\nconsole.log(1)\n", lang: "javascript"},
+		{name: "shebang with a version", in: "#!/usr/bin/python3.11\nprint(1)\n", lang: "python"},
+		{name: "unknown interpreter", in: "#!/usr/bin/awk -f\n{ print }\n"},
+		{name: "go", in: "package main\n\nfunc main() {\n\tprintln(1)\n}\n", lang: "go"},
+		{name: "package without functions", in: "package main\n\nvar x = 1\n"},
+		{name: "python", in: "import os\n\ndef main(args) -> int:\n    return 0\n", lang: "python"},
+		{name: "prose", in: "Define a function: it's easy.\n"},
+		{name: "more than one language", in: "package main\n\nfunc main() {\n}\n\ndef main():\n"},
+	}
+	for _, tt := range tc {
+		if got := guessLang([]byte(tt.in)); got != tt.lang {
+			t.Errorf("case [%s]: expected language %q; got %q", tt.name, tt.lang, got)
+		}
+	}
+}
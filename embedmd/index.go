@@ -0,0 +1,99 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// runIndex writes a list linking to every markdown file in the directory used
+// by the command, with their titles.
+func (e *embedder) runIndex(w io.Writer, cmd *command) error {
+	if isURL(cmd.path) {
+		return fmt.Errorf("could not index %s: only local directories can be indexed", cmd.path)
+	}
+	if strings.HasPrefix(cmd.path, "//") {
+		// the links must be relative to the markdown file.
+		return fmt.Errorf("could not index %s: paths from the repository root cannot be indexed", cmd.path)
+	}
+	dir := filepath.Join(e.baseDir, filepath.FromSlash(cmd.path))
+	if e.restrict {
+		if err := inBaseDir(e.baseDir, dir); err != nil {
+			return fmt.Errorf("could not index %s: %v", cmd.path, err)
+		}
+	}
+	if e.safe {
+		if err := within(e.root, dir); err != nil {
+			return fmt.Errorf("could not index %s: %v", cmd.path, err)
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not index %s: %v", cmd.path, err)
+	}
+
+	var b bytes.Buffer
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".md" {
+			continue
+		}
+		link := path.Join(cmd.path, f.Name())
+		content, err := e.Fetch(e.baseDir, link)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", link, err)
+		}
+		title := markdownTitle(content)
+		if title == "" {
+			title = f.Name()
+		}
+		fmt.Fprintf(&b, "- [%s](%s)\n", title, link)
+	}
+	e.record(cmd, b.Bytes())
+	_, err = w.Write(b.Bytes())
+	return err
+}
+
+// markdownTitle returns the text of the first level one heading in the
+// markdown b, ignoring the ones in code blocks, or "" if there is none.
+func markdownTitle(b []byte) string {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	fence := "" // the fence of the current code block, if any.
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case fence != "":
+			if closesFence(line, fence) {
+				fence = ""
+			}
+		case isFence(line):
+			fence = fenceOf(line)
+		case strings.HasPrefix(line, "# "):
+			return strings.TrimSpace(strings.TrimRight(line[2:], "#"))
+		}
+	}
+	return ""
+}
+
+// isIndexEntry reports whether the line is an entry of a list generated by an
+// index command.
+func isIndexEntry(line string) bool {
+	return strings.HasPrefix(line, "- [") && strings.HasSuffix(line, ".md)")
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMarkdownTitle(t *testing.T) {
+	tc := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{name: "title",
+			in: "# Getting started\n\ntext\n", out: "Getting started"},
+		{name: "title after text",
+			in: "intro\n\n# Usage #\n", out: "Usage"},
+		{name: "only level one headings",
+			in: "## Details\n# Reference\n", out: "Reference"},
+		{name: "headings in code blocks are ignored",
+			in: "```sh\n# comment\n```\n# Shell\n", out: "Shell"},
+		{name: "no title",
+			in: "just text\n", out: ""},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := markdownTitle([]byte(tt.in)); got != tt.out {
+				t.Errorf("case [%s]: expected title %q; got %q", tt.name, tt.out, got)
+			}
+		})
+	}
+}
+
+func TestIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"docs/intro.md":       "# Introduction\n\ntext\n",
+		"docs/notitle.md":     "text\n",
+		"docs/code.go":        "package main\n",
+		"docs/guide/index.md": "# Guide\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	in := "# Index\n" +
+		"[embedmd]:# (docs/ index)\n" +
+		"- [Old title](docs/old.md)\n" +
+		"\n" +
+		"The end.\n"
+	out := "# Index\n" +
+		"[embedmd]:# (docs/ index)\n" +
+		"- [Introduction](docs/intro.md)\n" +
+		"- [notitle.md](docs/notitle.md)\n" +
+		"\n" +
+		"The end.\n"
+
+	var buf bytes.Buffer
+	if err := Process(&buf, strings.NewReader(in), WithBaseDir(dir)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := buf.String(); got != out {
+		t.Errorf("expected output\n%q\n; got \n%q\n", out, got)
+	}
+
+	// running it again must not change anything.
+	var stale []int
+	buf.Reset()
+	if err := Process(&buf, strings.NewReader(out), WithBaseDir(dir), WithStaleBlocks(func(line int) { stale = append(stale, line) })); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := buf.String(); got != out || len(stale) > 0 {
+		t.Errorf("expected the same output with no stale blocks; got %q and stale lines %v", got, stale)
+	}
+
+	err = Process(&buf, strings.NewReader("[embedmd]:# (missing/ index)\n"), WithBaseDir(dir))
+	if err == nil || !strings.HasPrefix(err.Error(), "1: could not index missing/: ") {
+		t.Errorf("expected an error indexing a missing directory; got %v", err)
+	}
+	docs := filepath.Join(dir, "docs")
+	err = Process(&buf, strings.NewReader("[embedmd]:# (../ index)\n"), WithBaseDir(docs), WithSafeMode(docs))
+	eqErr(t, "outside of the root in safe mode", err, "1: could not index ../: "+filepath.ToSlash(dir)+" is outside of "+filepath.ToSlash(docs))
+	err = Process(&buf, strings.NewReader("[embedmd]:# (../ index)\n"), WithBaseDir(docs), WithRestrictToBaseDir())
+	eqErr(t, "outside of the restricted base directory", err, "1: could not index ../: path escapes base directory")
+}
@@ -0,0 +1,156 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+// WithWarnings calls f for every problem found in the embedded content by the
+// enabled checks, such as WithIndentCheck, with the line of the command that
+// embedded it. Warnings never stop the processing.
+func WithWarnings(f func(line int, msg string)) Option {
+	return Option{func(e *embedder) { e.warn = f }}
+}
+
+// WithIndentCheck warns about embedded content mixing tabs and spaces in its
+// indentation, either in a single line or by indenting some lines with tabs
+// and others with spaces, which often comes from copy and pasting code.
+func WithIndentCheck() Option {
+	return Option{func(e *embedder) { e.checkIndent = true }}
+}
+
+// WithMaxWidth warns about embedded lines longer than the width given for the
+// language of their code block, as in {"go": 100, "python": 79}. The width is
+// counted in characters, with tabs counting as a single one.
+func WithMaxWidth(widths map[string]int) Option {
+	return Option{func(e *embedder) { e.widths = widths }}
+}
+
+// WithOverlapCheck warns about commands embedding line ranges of a file that
+// overlap with the ones embedded by previous commands in the same markdown,
+// which is often a mistake.
+func WithOverlapCheck() Option {
+	return Option{func(e *embedder) { e.ranges = make(map[string][]lineRange) }}
+}
+
+// DefaultForbidden are the substrings that WithForbiddenCheck looks for when
+// none are given, which usually mark unfinished code.
+var DefaultForbidden = []string{"TODO", "FIXME", "XXX"}
+
+// WithForbiddenCheck warns about embedded lines containing any of the given
+// substrings, or DefaultForbidden if there are none, so unfinished code does
+// not leak into published docs. If fatal is set, they make the command fail
+// instead.
+func WithForbiddenCheck(fatal bool, substrings ...string) Option {
+	if len(substrings) == 0 {
+		substrings = DefaultForbidden
+	}
+	return Option{func(e *embedder) { e.forbidden, e.forbiddenFatal = substrings, fatal }}
+}
+
+// lineRange is a range of lines of a file embedded by the command in line.
+type lineRange struct {
+	line       int
+	start, end int
+}
+
+func (r lineRange) String() string {
+	if r.start == r.end {
+		return fmt.Sprintf("line %d", r.start)
+	}
+	return fmt.Sprintf("lines %d-%d", r.start, r.end)
+}
+
+// lint runs the enabled checks on the content b embedded by cmd in a code
+// block of the given language.
+func (e *embedder) lint(cmd *command, lang string, b []byte) {
+	if e.warn == nil {
+		return
+	}
+	warn := func(format string, args ...interface{}) {
+		e.warn(cmd.line, fmt.Sprintf(format, args...))
+	}
+	if e.checkIndent {
+		checkIndent(b, cmd.path, warn)
+	}
+	if max, ok := e.widths[lang]; ok {
+		checkWidth(b, cmd.path, lang, max, warn)
+	}
+	if e.ranges != nil && cmd.startLine > 0 {
+		r := lineRange{cmd.line, cmd.startLine, cmd.endLine}
+		checkOverlap(r, e.ranges[cmd.path], cmd.path, warn)
+		e.ranges[cmd.path] = append(e.ranges[cmd.path], r)
+	}
+	if !e.forbiddenFatal {
+		checkForbidden(b, cmd.path, e.forbidden, warn)
+	}
+}
+
+// checkForbidden reports the lines containing any of the forbidden substrings.
+func checkForbidden(b []byte, path string, forbidden []string, report func(format string, args ...interface{})) {
+	for i, line := range bytes.Split(b, []byte("\n")) {
+		for _, s := range forbidden {
+			if bytes.Contains(line, []byte(s)) {
+				report("line %d of %s contains %s", i+1, path, s)
+			}
+		}
+	}
+}
+
+// checkOverlap warns about the previous ranges of lines overlapping with r.
+func checkOverlap(r lineRange, prev []lineRange, path string, warn func(format string, args ...interface{})) {
+	for _, p := range prev {
+		if r.start <= p.end && p.start <= r.end {
+			warn("%s of %s and %s embedded in line %d overlap", r, path, p, p.line)
+		}
+	}
+}
+
+// checkIndent warns about lines whose indentation mixes tabs and spaces, and
+// about content indenting some lines with tabs and others with spaces.
+func checkIndent(b []byte, path string, warn func(format string, args ...interface{})) {
+	tabLine, spaceLine := 0, 0
+	for i, line := range bytes.Split(b, []byte("\n")) {
+		indent := line[:len(line)-len(bytes.TrimLeft(line, " \t"))]
+		if len(indent) == len(line) {
+			continue // blank lines have no indentation.
+		}
+		tabs, spaces := bytes.Contains(indent, []byte("\t")), bytes.Contains(indent, []byte(" "))
+		if tabs && spaces {
+			warn("line %d of %s mixes tabs and spaces in its indentation", i+1, path)
+			continue
+		}
+		if tabs && tabLine == 0 {
+			tabLine = i + 1
+		}
+		if spaces && spaceLine == 0 {
+			spaceLine = i + 1
+		}
+	}
+	if tabLine > 0 && spaceLine > 0 {
+		warn("%s indents line %d with tabs and line %d with spaces", path, tabLine, spaceLine)
+	}
+}
+
+// checkWidth warns about lines longer than max characters.
+func checkWidth(b []byte, path, lang string, max int, warn func(format string, args ...interface{})) {
+	for i, line := range bytes.Split(b, []byte("\n")) {
+		if n := utf8.RuneCount(line); n > max {
+			warn("line %d of %s is %d characters long, more than %d for %s", i+1, path, n, max, lang)
+		}
+	}
+}
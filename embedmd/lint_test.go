@@ -0,0 +1,141 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCheckIndent(t *testing.T) {
+	tc := []struct {
+		name     string
+		in       string
+		warnings []string
+	}{
+		{name: "tabs",
+			in: "func main() {\n\tif ok {\n\t\treturn\n\t}\n}\n"},
+		{name: "spaces",
+			in: "def main():\n    if ok:\n        return\n"},
+		{name: "blank lines are ignored",
+			in: "a\n\t\n  \n\tb\n"},
+		{name: "tabs and spaces in a line",
+			in:       "a\n\t b\n \tc\n",
+			warnings: []string{"line 2 of code.go mixes tabs and spaces in its indentation", "line 3 of code.go mixes tabs and spaces in its indentation"}},
+		{name: "tabs and spaces in different lines",
+			in:       "a\n\tb\n\tc\n    d\n",
+			warnings: []string{"code.go indents line 2 with tabs and line 4 with spaces"}},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			var warnings []string
+			checkIndent([]byte(tt.in), "code.go", func(format string, args ...interface{}) {
+				warnings = append(warnings, fmt.Sprintf(format, args...))
+			})
+			if fmt.Sprint(warnings) != fmt.Sprint(tt.warnings) {
+				t.Errorf("case [%s]: expected warnings %q; got %q", tt.name, tt.warnings, warnings)
+			}
+		})
+	}
+}
+
+func TestCheckWidth(t *testing.T) {
+	var warnings []string
+	in := "short\n" + strings.Repeat("x", 11) + "\n" + strings.Repeat("é", 10) + "\n\t" + strings.Repeat("x", 10) + "\n"
+	checkWidth([]byte(in), "code.go", "go", 10, func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	})
+	want := []string{
+		"line 2 of code.go is 11 characters long, more than 10 for go",
+		"line 4 of code.go is 11 characters long, more than 10 for go",
+	}
+	if fmt.Sprint(warnings) != fmt.Sprint(want) {
+		t.Errorf("expected warnings %q; got %q", want, warnings)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	in := "# Code\n" +
+		"[embedmd]:# (good.go)\n" +
+		"[embedmd]:# (bad.go)\n"
+	files := fakeFileProvider{
+		"good.go": []byte("a\n\tb\n"),
+		"bad.go":  []byte("a\n\tb\n  c\n"),
+	}
+
+	var warnings []string
+	warn := WithWarnings(func(line int, msg string) {
+		warnings = append(warnings, fmt.Sprintf("%d: %s", line, msg))
+	})
+	if err := Process(ioutil.Discard, strings.NewReader(in), WithFetcher(files), warn); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(warnings) > 0 {
+		t.Errorf("expected no warnings without checks; got %q", warnings)
+	}
+
+	if err := Process(ioutil.Discard, strings.NewReader(in), WithFetcher(files), warn, WithIndentCheck()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"3: bad.go indents line 2 with tabs and line 3 with spaces"}
+	if fmt.Sprint(warnings) != fmt.Sprint(want) {
+		t.Errorf("expected warnings %q; got %q", want, warnings)
+	}
+
+	// widths apply to the language of the code block, once aliases are resolved.
+	warnings = nil
+	in = "[embedmd]:# (long.py)\n[embedmd]:# (long.go)\n"
+	files = fakeFileProvider{"long.py": []byte("a = 12345\n"), "long.go": []byte("a := 12345\n")}
+	widths := WithMaxWidth(map[string]int{"python": 8, "go": 20})
+	if err := Process(ioutil.Discard, strings.NewReader(in), WithFetcher(files), warn, widths, WithLangAlias("py", "python")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = []string{"1: line 1 of long.py is 9 characters long, more than 8 for python"}
+	if fmt.Sprint(warnings) != fmt.Sprint(want) {
+		t.Errorf("expected warnings %q; got %q", want, warnings)
+	}
+
+	// overlaps are only checked between line ranges of the same file.
+	warnings = nil
+	in = "[embedmd]:# (https://x.com/a.go#L1-L3)\n" +
+		"[embedmd]:# (https://x.com/b.go#L2-L4)\n" +
+		"[embedmd]:# (https://x.com/a.go#L4-L6)\n" +
+		"[embedmd]:# (https://x.com/a.go#L3)\n"
+	code := []byte("1\n2\n3\n4\n5\n6\n")
+	urls := mixedContentProvider{urls: map[string][]byte{"https://x.com/a.go": code, "https://x.com/b.go": code}}
+	if err := Process(ioutil.Discard, strings.NewReader(in), WithFetcher(urls), warn, WithOverlapCheck()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = []string{"4: line 3 of https://x.com/a.go and lines 1-3 embedded in line 1 overlap"}
+	if fmt.Sprint(warnings) != fmt.Sprint(want) {
+		t.Errorf("expected warnings %q; got %q", want, warnings)
+	}
+
+	// forbidden substrings are warnings unless they are fatal.
+	warnings = nil
+	in = "[embedmd]:# (todo.go)\n[embedmd]:# (custom.go)\n"
+	files = fakeFileProvider{"todo.go": []byte("a\n// TODO: b\n// FIXME\n"), "custom.go": []byte("// HACK\n")}
+	if err := Process(ioutil.Discard, strings.NewReader(in), WithFetcher(files), warn, WithForbiddenCheck(false)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = []string{"1: line 2 of todo.go contains TODO", "1: line 3 of todo.go contains FIXME"}
+	if fmt.Sprint(warnings) != fmt.Sprint(want) {
+		t.Errorf("expected warnings %q; got %q", want, warnings)
+	}
+	err := Process(ioutil.Discard, strings.NewReader(in), WithFetcher(files), WithForbiddenCheck(true, "HACK"))
+	eqErr(t, "fatal forbidden substrings", err, "2: line 1 of custom.go contains HACK")
+}
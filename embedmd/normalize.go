@@ -0,0 +1,70 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Normalize reads markdown from the given io.Reader and writes it to the given
+// io.Writer with every embedmd command rewritten in its canonical form, with
+// single spaces between the arguments, the language only if it differs from
+// the one implied by the file extension, and the flags in a fixed order. The
+// meaning of the commands doesn't change, and neither does anything else, so
+// the code blocks are not generated again. Commands shown in code blocks are
+// not commands, so they are kept as they are.
+func Normalize(out io.Writer, in io.Reader) error {
+	var p parser // with the default prefix.
+	s := bufio.NewScanner(in)
+	fence := "" // the fence of the current code block, if any.
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		switch {
+		case fence != "":
+			if closesFence(line, fence) {
+				fence = ""
+			}
+		case isFence(line):
+			fence = fenceOf(line)
+		case p.isCommand(line):
+			normalized, err := normalizeCommand(p.commandArgs(line))
+			if err != nil {
+				return fmt.Errorf("%d: %v", n, err)
+			}
+			line = normalized
+		}
+		fmt.Fprintln(out, line)
+	}
+	return s.Err()
+}
+
+// normalizeCommand returns the canonical form of the command line with the
+// given arguments.
+func normalizeCommand(args string) (string, error) {
+	const prefix = defaultPrefix + " "
+	switch args {
+	case tabsStart, tabsEnd:
+		return prefix + args, nil
+	default:
+		// the language of files with no extension can be found from their
+		// content, which is not fetched.
+		cmd, err := parseCommandLang(args, true, nil)
+		if err != nil {
+			return "", err
+		}
+		return prefix + cmd.String(), nil
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCommandString(t *testing.T) {
+	tc := []struct {
+		in, out string
+	}{
+		{"(code.go)", "(code.go)"},
+		{"(  code.go   go  )", "(code.go)"},
+		{"(code.go golang /start/   EOF)", "(code.go golang /start/ $)"},
+		{"(Makefile make /all:/)", "(Makefile make /all:/)"},
+		{"(code.go sink=all /func main/ strip-license)", "(code.go /func main/ strip-license sink=all)"},
+		{"(code.go expect-sha=ABC firstlines:/^func/ expect-lines=2)", "(code.go firstlines:/^func/ expect-lines=2 expect-sha=abc)"},
+		{"(https://x.com/a.go#L3-L4  strip-license)", "(https://x.com/a.go#L3-L4 strip-license)"},
+		{"(code.go /a b/s[2])", "(code.go /a b/s[2])"},
+		{"(Makefile #L3-L4 make)", "(Makefile make #L3-L4)"},
+		{"(code.go #L3 strip-license)", "(code.go #L3 strip-license)"},
+		{"(code.go numbered strip-shebang /a/ $)", "(code.go /a/ $ strip-shebang numbered)"},
+		{"(https://x.com/a.go#L3)", "(https://x.com/a.go#L3)"},
+		{"(docs/ index)", "(docs/ index)"},
+		{"( ./sample   go:vet )", "(./sample go:vet)"},
+		{"(examples/ depth=2 tree hidden)", "(examples/ tree hidden depth=2)"},
+		{"(api.go diff:v1.0..HEAD)", "(api.go diff:v1.0..HEAD)"},
+		{"(other.md  fence:2)", "(other.md fence:2)"},
+		{"(code.go strip=/^$/ /a/  strip=/ x /)", "(code.go /a/ strip=/^$/ strip=/ x /)"},
+		{"(code.go  numbered func:(*Server).Handle)", "(code.go func:(*Server).Handle numbered)"},
+		{"( exec:mytool  --help )", "(exec: mytool --help)"},
+		{"(env.sh strip=/x/ grep-v=/ y/ /a/ grep=/z /)", "(env.sh /a/ grep=/z / grep-v=/ y/ strip=/x/)"},
+		{"(other.md md fence:2)", "(other.md md fence:2)"},
+		{"(data.xyz raw-indent ext:parser  a  /b c/)", "(data.xyz raw-indent ext:parser a /b c/)"},
+		{"(run.sh  wrap=80 strip-shebang)", "(run.sh strip-shebang wrap=80)"},
+		{"(code.go collapse  numbered)", "(code.go numbered collapse)"},
+		{`(code.go collapse="Show  the code" /a/)`, `(code.go /a/ collapse="Show  the code")`},
+		{"(code.go collapse=Code)", `(code.go collapse="Code")`},
+	}
+	for _, tt := range tc {
+		cmd, err := parseCommand(tt.in)
+		if err != nil {
+			t.Errorf("case [%s]: unexpected error: %v", tt.in, err)
+			continue
+		}
+		if got := cmd.String(); got != tt.out {
+			t.Errorf("case [%s]: expected %q; got %q", tt.in, tt.out, got)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	in := "# Docs\n" +
+		"[embedmd]:# (code.go  go /func main/   $)\n" +
+		"```go\nold\n```\n" +
+		"[embedmd]:#   (tabs)\n" +
+		"[embedmd]:# (hello.py  strip-shebang python)\n" +
+		"[embedmd]:# (/tabs)\n" +
+		"```markdown\n[embedmd]:# (shown.go  go)\n```\n" +
+		"~~~markdown\n```\n[embedmd]:# (shown.go  go)\n~~~\n"
+	want := "# Docs\n" +
+		"[embedmd]:# (code.go /func main/ $)\n" +
+		"```go\nold\n```\n" +
+		"[embedmd]:# (tabs)\n" +
+		"[embedmd]:# (hello.py python strip-shebang)\n" +
+		"[embedmd]:# (/tabs)\n" +
+		"```markdown\n[embedmd]:# (shown.go  go)\n```\n" +
+		"~~~markdown\n```\n[embedmd]:# (shown.go  go)\n~~~\n"
+
+	var out bytes.Buffer
+	if err := Normalize(&out, strings.NewReader(in)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := out.String(); got != want {
+		t.Errorf("expected output:\n%s\ngot:\n%s", want, got)
+	}
+
+	var again bytes.Buffer
+	if err := Normalize(&again, strings.NewReader(want)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if again.String() != want {
+		t.Errorf("normalizing again changed the output:\n%s", again.String())
+	}
+
+	err := Normalize(&out, strings.NewReader("text\n[embedmd]:# (code.go /start)\n"))
+	eqErr(t, "bad command", err, "2: unbalanced /")
+}
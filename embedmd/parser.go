@@ -15,22 +15,97 @@ package embedmd
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"strings"
+	"unicode"
 )
 
 type commandRunner func(io.Writer, *command) error
 
 func process(out io.Writer, in io.Reader, run commandRunner) error {
+	return (&parser{run: run, guessLang: true}).process(out, in)
+}
+
+// A parser holds the configuration used while processing markdown.
+type parser struct {
+	run commandRunner
+
+	// lookahead is the maximum number of lines that can appear between a
+	// command and the code block it manages.
+	lookahead int
+
+	// stale, if not nil, is called with the line of every command
+	// whose generated block differs from the one found in the input.
+	stale func(line int)
+
+	// confirm, if not nil, is called for every command whose generated
+	// content differs from the one found in the input, which is kept unless
+	// confirm returns true.
+	confirm func(line int, old, new string) bool
+
+	// blankAfter indicates that generated blocks should be followed by a
+	// blank line.
+	blankAfter bool
+
+	// pinned, if not nil, reports whether the block of a command is kept as
+	// it is when found, without running the command.
+	pinned func(cmd *command) bool
+
+	// isCaption, if not nil, reports whether a line is a caption, as generated
+	// before code blocks with WithCaption.
+	isCaption func(line string) bool
+
+	// anchors indicates that anchors are generated before every code block,
+	// rather than only for the commands with the anchor flag.
+	anchors bool
+
+	// fenceLang, if not nil, returns the language written in the code blocks
+	// of the commands with the given one.
+	fenceLang func(lang string) string
+
+	// guessLang indicates that the commands embedding files with no extension
+	// need no language, since it's found from their content.
+	guessLang bool
+
+	// names maps file names to the language of their code blocks, instead of
+	// the built-in one, if any.
+	names map[string]string
+
+	// keepGoing, if not nil, is called with the error of every command that
+	// fails, which is skipped, leaving its block as it is, instead of stopping.
+	keepGoing func(line int, err error)
+
+	// prefix, if not empty, starts the command lines instead of [embedmd]:#.
+	prefix string
+
+	// format is the markup language of the documents, which determines how
+	// commands and code blocks are written.
+	format Format
+}
+
+// lineError is an error found in a line other than the current one.
+type lineError struct {
+	line int
+	err  error
+}
+
+func (e lineError) Error() string { return e.err.Error() }
+
+func (p *parser) process(out io.Writer, in io.Reader) error {
 	s := &countingScanner{bufio.NewScanner(in), 0}
 
-	state := parsingText
+	state := p.parsingText
 	var err error
 	for state != nil {
-		state, err = state(out, s, run)
+		state, err = state(out, s)
 		if err != nil {
-			return fmt.Errorf("%d: %v", s.line, err)
+			line := s.line
+			if le, ok := err.(lineError); ok {
+				line = le.line
+			}
+			return fmt.Errorf("%d: %v", line, err)
 		}
 	}
 
@@ -53,65 +128,476 @@ func (c *countingScanner) Scan() bool {
 	return b
 }
 
+func (c *countingScanner) Line() int { return c.line }
+
 type textScanner interface {
 	Text() string
 	Scan() bool
+	Line() int
 }
 
-type state func(io.Writer, textScanner, commandRunner) (state, error)
+type state func(io.Writer, textScanner) (state, error)
 
-func parsingText(out io.Writer, s textScanner, run commandRunner) (state, error) {
+func (p *parser) parsingText(out io.Writer, s textScanner) (state, error) {
 	if !s.Scan() {
 		return nil, nil // end of file, which is fine.
 	}
+	return p.parsingLine(out, s)
+}
+
+// parsingLine handles the line the scanner is currently on.
+func (p *parser) parsingLine(out io.Writer, s textScanner) (state, error) {
 	switch line := s.Text(); {
-	case strings.HasPrefix(line, "[embedmd]:#"):
-		return parsingCmd, nil
-	case strings.HasPrefix(line, "```"):
-		return codeParser{print: true}.parse, nil
+	case p.isCommand(line):
+		return p.parsingCmd, nil
+	case p.format == Markdown && isEmbedmdFence(line):
+		return p.parsingEmbedmdFence, nil
+	case p.opensBlock(line):
+		return p.codeBlock(out, line, p.parsingText).parse, nil
 	default:
 		fmt.Fprintln(out, s.Text())
-		return parsingText, nil
+		return p.parsingText, nil
 	}
 }
 
-func parsingCmd(out io.Writer, s textScanner, run commandRunner) (state, error) {
+// defaultPrefix starts the command lines unless WithCommandPrefix is used.
+const defaultPrefix = "[embedmd]:#"
+
+// commandPrefix returns the prefix of the command lines.
+func (p *parser) commandPrefix() string {
+	switch {
+	case p.prefix != "":
+		return p.prefix
+	case p.format == AsciiDoc:
+		return asciidocPrefix
+	}
+	return defaultPrefix
+}
+
+func (p *parser) isCommand(line string) bool { return strings.HasPrefix(line, p.commandPrefix()) }
+
+func isFence(line string) bool { return fenceOf(line) != "" }
+
+// fenceOf returns the fence opening a code block in the line, which is a run
+// of three or more backticks or tildes, or an empty string if the line doesn't
+// open a code block. As in CommonMark, the info string after a fence of
+// backticks cannot contain backticks.
+func fenceOf(line string) string {
+	if !strings.HasPrefix(line, "```") && !strings.HasPrefix(line, "~~~") {
+		return ""
+	}
+	fence := line[:len(line)-len(strings.TrimLeft(line, line[:1]))]
+	if fence[0] == '`' && strings.Contains(line[len(fence):], "`") {
+		return ""
+	}
+	return fence
+}
+
+// closesFence reports whether the line closes a code block opened with the
+// given fence, which takes a fence of the same character, at least as long,
+// and nothing else but spaces.
+func closesFence(line, fence string) bool {
+	line = strings.TrimSpace(line)
+	return strings.HasPrefix(line, fence) && strings.Trim(line, fence[:1]) == ""
+}
+
+// blockAttrs returns the attributes of a code block opened by the given line
+// after its head, which follow its language: the rest of the info string of a
+// fence, as in ```go {.line-numbers}, or the attributes after the language in
+// AsciiDoc, as in [source,go,linenums].
+func (p *parser) blockAttrs(head []string, open string) string {
+	if p.format == AsciiDoc {
+		if len(head) == 0 || !isSourceAttributes(head[len(head)-1]) {
+			return ""
+		}
+		attrs := strings.TrimSuffix(strings.TrimPrefix(head[len(head)-1], "[source"), "]")
+		if parts := strings.SplitN(attrs, ",", 3); len(parts) == 3 {
+			return "," + parts[2]
+		}
+		return ""
+	}
+	info := strings.TrimRightFunc(open[len(fenceOf(open)):], unicode.IsSpace)
+	if strings.HasPrefix(strings.TrimSpace(info), "{") {
+		return " " + strings.TrimSpace(info) // there is no language, only attributes.
+	}
+	if i := strings.IndexFunc(info, unicode.IsSpace); i >= 0 {
+		return info[i:]
+	}
+	return ""
+}
+
+// opensBlock reports whether the line opens a code block in the format of the
+// documents.
+func (p *parser) opensBlock(line string) bool {
+	if p.format == AsciiDoc {
+		return isListingDelimiter(line)
+	}
+	return isFence(line)
+}
+
+// codeBlock returns a parser for the code block opened by the given line,
+// which is followed by next.
+func (p *parser) codeBlock(out io.Writer, open string, next state) codeParser {
+	if p.format == AsciiDoc {
+		// listing blocks are only closed by a line equal to the opening one.
+		return codeParser{out, next, func(line string) bool { return line == open }}
+	}
+	fence := fenceOf(open)
+	return codeParser{out, next, func(line string) bool { return closesFence(line, fence) }}
+}
+
+// isEmbedmdFence reports whether the line opens a code block whose commands
+// are processed too, since its info string has the embedmd flag, as in
+// ````md embedmd.
+func isEmbedmdFence(line string) bool {
+	fence := fenceOf(line)
+	if fence == "" {
+		return false
+	}
+	for _, f := range strings.Fields(line[len(fence):]) {
+		if f == "embedmd" {
+			return true
+		}
+	}
+	return false
+}
+
+// parsingEmbedmdFence processes the commands in a code block opened with the
+// embedmd flag, up to the fence closing it. The block must be opened with a
+// longer fence than the code blocks generated in it, as in ````md embedmd.
+func (p *parser) parsingEmbedmdFence(out io.Writer, s textScanner) (state, error) {
+	open := s.Text()
+	fmt.Fprintln(out, open)
+	inner := &fencedScanner{textScanner: s, fence: fenceOf(open)}
+	for state := p.parsingText; state != nil; {
+		var err error
+		if state, err = state(out, inner); err != nil {
+			return nil, err
+		}
+	}
+	if !inner.closed {
+		return nil, fmt.Errorf("unbalanced code section")
+	}
+	fmt.Fprintln(out, s.Text())
+	return p.parsingText, nil
+}
+
+// fencedScanner scans the lines of a code block, stopping at the line closing
+// its fence.
+type fencedScanner struct {
+	textScanner
+	fence  string
+	closed bool
+}
+
+func (f *fencedScanner) Scan() bool {
+	if f.closed || !f.textScanner.Scan() {
+		return false
+	}
+	if closesFence(f.Text(), f.fence) {
+		f.closed = true
+		return false
+	}
+	return true
+}
+
+// generatedMarkdown describes the markdown generated by the commands that do
+// not generate code blocks.
+type generatedMarkdown struct {
+	is        func(line string) bool // whether the line was generated.
+	multiline bool                   // whether more than one line is generated.
+}
+
+// generatedBy returns the markdown generated by the command, or nil if the
+// command generates a code block.
+func generatedBy(cmd *command) *generatedMarkdown {
+	switch {
+	case cmd.image:
+		return &generatedMarkdown{is: isDataImage}
+	case cmd.index:
+		return &generatedMarkdown{is: isIndexEntry, multiline: true}
+	}
+	return nil
+}
+
+// isDataImage reports whether the line is an image inlined with a data URI.
+func isDataImage(line string) bool {
+	return strings.HasPrefix(line, "![") && strings.Contains(line, "](data:image/")
+}
+
+// isAnchor reports whether the line is an anchor, as generated before code
+// blocks with WithAnchors or the anchor flag.
+func isAnchor(line string) bool {
+	return strings.HasPrefix(line, anchorPrefix) && strings.HasSuffix(line, "\"></a>")
+}
+
+// isSourceLink reports whether the line is a link to the source of the code
+// block before it, as generated with WithSourceLinks.
+func isSourceLink(line string) bool {
+	return strings.HasPrefix(line, sourceLinkPrefix) && strings.HasSuffix(line, ")")
+}
+
+// isHead reports whether the line can follow the given ones in the head of the
+// code block of cmd, which is an optional anchor followed by an optional
+// caption, and the attributes of the block in AsciiDoc. Anchors are only part
+// of it when they are generated, so other ones are kept. In markdown, all of
+// them can be in the <details> element of a collapsed block, whose opening
+// lines, up to the blank line after the summary, are in the head too.
+func (p *parser) isHead(cmd *command, head []string, line string) bool {
+	if p.format == Markdown && cmd.collapse {
+		switch {
+		case len(head) == 0 && line == detailsOpen:
+			return true
+		case len(head) == 1 && head[0] == detailsOpen:
+			return isSummary(line)
+		case len(head) == 2 && head[0] == detailsOpen:
+			return strings.TrimSpace(line) == ""
+		case collapsed(head):
+			head = head[3:]
+		}
+	}
+	switch {
+	case p.format == AsciiDoc && isSourceAttributes(line):
+		return len(head) == 0 || !isSourceAttributes(head[len(head)-1])
+	case len(head) == 0 && isAnchor(line):
+		return p.anchors || cmd.anchor != ""
+	case p.isCaption != nil && p.isCaption(line):
+		return len(head) == 0 || len(head) == 1 && isAnchor(head[0])
+	}
+	return false
+}
+
+// collapsed reports whether the head of a code block opens a <details>
+// element, which the block is in, even with no blank line after the summary.
+func collapsed(head []string) bool {
+	return len(head) >= 2 && head[0] == detailsOpen && isSummary(head[1])
+}
+
+// commandArgs returns the argument list of a command line.
+func (p *parser) commandArgs(line string) string {
+	return strings.TrimSpace(strings.TrimPrefix(line, p.commandPrefix()))
+}
+
+func (p *parser) parsingCmd(out io.Writer, s textScanner) (state, error) {
 	line := s.Text()
+	switch p.commandArgs(line) {
+	case tabsStart:
+		if p.format != Markdown {
+			return nil, fmt.Errorf("groups of tabs are only supported in markdown")
+		}
+		return p.parsingTabs(out, s)
+	case tabsEnd:
+		return nil, fmt.Errorf("%s without a matching %s", tabsEnd, tabsStart)
+	}
+
+	cmdLine := s.Line()
 	fmt.Fprintln(out, line)
-	args := line[strings.Index(line, "#")+1:]
-	cmd, err := parseCommand(args)
+	cmd, err := parseCommandLang(p.commandArgs(line), p.guessLang, p.names)
 	if err != nil {
-		return nil, err
+		if p.keepGoing == nil {
+			return nil, err
+		}
+		// the block of the command, if any, is kept as any other text.
+		p.keepGoing(cmdLine, err)
+		return p.parsingText, nil
+	}
+	cmd.line = cmdLine
+	pinned := p.pinned != nil && cmd.sink == "" && p.pinned(cmd)
+	var block bytes.Buffer
+	failed := false // whether the command failed, keeping its block.
+	run := func() error {
+		err := p.run(&block, cmd)
+		if err != nil && p.keepGoing != nil {
+			block.Reset()
+			p.keepGoing(cmdLine, err)
+			failed, err = true, nil
+		}
+		return err
+	}
+	if cmd.sink != "" {
+		// the code block goes to a sink, so the markdown is left as is.
+		if err := run(); err != nil {
+			return nil, err
+		}
+		return p.parsingText, nil
+	}
+	// commands run once the block they manage is found, so they can keep its
+	// attributes, and pinned commands only run when there is no block to keep.
+	generate := func() error {
+		if err := run(); err != nil {
+			return lineError{cmdLine, err}
+		}
+		return nil
+	}
+	update := func(out io.Writer, old []byte) error {
+		if !pinned {
+			if err := generate(); err != nil {
+				return err
+			}
+		}
+		if pinned || failed {
+			out.Write(old)
+			return nil
+		}
+		p.update(out, cmdLine, old, block.Bytes())
+		return nil
 	}
-	if err := run(out, cmd); err != nil {
+
+	// Look for the code block managed by this command, which might be
+	// preceded by up to p.lookahead lines of text. Commands generating
+	// markdown instead manage the lines it recognizes as generated.
+	generated := generatedBy(cmd)
+	var between []string
+	// head holds the last lines if they are an anchor and a caption, which are
+	// generated too when they go right before the code block.
+	var head []string
+	for s.Scan() {
+		line := s.Text()
+		if generated == nil && p.isHead(cmd, head, line) {
+			head = append(head, line)
+			continue
+		}
+		if generated == nil && p.opensBlock(line) {
+			printLines(out, between)
+			cmd.attrs = p.blockAttrs(head, line)
+			// keep the previous code block around to compare it to the new one.
+			old := new(bytes.Buffer)
+			printLines(old, head)
+			next := func(out io.Writer, s textScanner) (state, error) {
+				more := s.Scan()
+				// the link to the source of the block is generated too.
+				if more && isSourceLink(s.Text()) {
+					fmt.Fprintln(old, s.Text())
+					more = s.Scan()
+				}
+				// and so is the end of the <details> element the block is in,
+				// usually after a blank line, which is kept if it's not there.
+				var after []string
+				if collapsed(head) {
+					if more && strings.TrimSpace(s.Text()) == "" {
+						after, more = append(after, s.Text()), s.Scan()
+					}
+					if more && s.Text() == detailsClose {
+						printLines(old, append(after, s.Text()))
+						after, more = nil, s.Scan()
+					}
+				}
+				if err := update(out, old.Bytes()); err != nil {
+					return nil, err
+				}
+				if len(after) > 0 {
+					p.separate(out, after[0])
+					printLines(out, after)
+				}
+				if !more {
+					return nil, nil // end of file, which is fine.
+				}
+				if len(after) == 0 {
+					p.separate(out, s.Text())
+				}
+				return p.parsingLine(out, s)
+			}
+			return p.codeBlock(old, line, next).parse, nil
+		}
+		if len(head) > 0 {
+			// the head is not followed by a code block, so it's kept as text.
+			between, head = append(between, head...), nil
+			if len(between) > p.lookahead {
+				if err := generate(); err != nil {
+					return nil, err
+				}
+				p.update(out, cmdLine, nil, block.Bytes())
+				p.separate(out, between[0])
+				printLines(out, between)
+				return p.parsingLine(out, s)
+			}
+		}
+		if generated != nil && generated.is(line) {
+			printLines(out, between)
+			old := line + "\n"
+			more := s.Scan()
+			for ; more && generated.multiline && generated.is(s.Text()); more = s.Scan() {
+				old += s.Text() + "\n"
+			}
+			if err := update(out, []byte(old)); err != nil {
+				return nil, err
+			}
+			if !more {
+				return nil, nil // end of file, which is fine.
+			}
+			p.separate(out, s.Text())
+			return p.parsingLine(out, s)
+		}
+		if p.isCommand(line) || len(between) == p.lookahead {
+			// No code block was found, so the generated one goes right
+			// after the command.
+			if err := generate(); err != nil {
+				return nil, err
+			}
+			p.update(out, cmdLine, nil, block.Bytes())
+			p.separate(out, append(between, line)[0])
+			printLines(out, between)
+			return p.parsingLine(out, s)
+		}
+		between = append(between, line)
+	}
+	between = append(between, head...)
+	if err := generate(); err != nil {
 		return nil, err
 	}
-	if !s.Scan() {
-		return nil, nil // end of file, which is fine.
+	p.update(out, cmdLine, nil, block.Bytes())
+	if len(between) > 0 {
+		p.separate(out, between[0])
 	}
-	if strings.HasPrefix(s.Text(), "```") {
-		return codeParser{print: false}.parse, nil
+	printLines(out, between)
+	return nil, nil // end of file, which is fine.
+}
+
+// separate writes an empty line between a generated block and the next line
+// if blank lines are expected after blocks and the next line is not blank.
+func (p *parser) separate(out io.Writer, next string) {
+	if p.blankAfter && strings.TrimSpace(next) != "" {
+		fmt.Fprintln(out)
 	}
-	fmt.Fprintln(out, s.Text())
-	return parsingText, nil
 }
 
-type codeParser struct{ print bool }
+// update writes the content generated by the command in the given line, which
+// replaces the old one, unless the change is not confirmed.
+func (p *parser) update(out io.Writer, line int, old, generated []byte) {
+	if !bytes.Equal(old, generated) {
+		if p.stale != nil {
+			p.stale(line)
+		}
+		if p.confirm != nil && !p.confirm(line, string(old), string(generated)) {
+			generated = old
+		}
+	}
+	out.Write(generated)
+}
 
-func (c codeParser) parse(out io.Writer, s textScanner, run commandRunner) (state, error) {
-	if c.print {
-		fmt.Fprintln(out, s.Text())
+func printLines(out io.Writer, lines []string) {
+	for _, line := range lines {
+		fmt.Fprintln(out, line)
 	}
+}
+
+// codeParser consumes a code section, writing its lines into out.
+type codeParser struct {
+	out    io.Writer
+	next   state
+	closes func(line string) bool // whether the line closes the section.
+}
+
+func (c codeParser) parse(_ io.Writer, s textScanner) (state, error) {
+	fmt.Fprintln(c.out, s.Text())
 	if !s.Scan() {
 		return nil, fmt.Errorf("unbalanced code section")
 	}
-	if !strings.HasPrefix(s.Text(), "```") {
+	if !c.closes(s.Text()) {
 		return c.parse, nil
 	}
 
-	// print the end of the code section if needed and go back to parsing text.
-	if c.print {
-		fmt.Fprintln(out, s.Text())
-	}
-	return parsingText, nil
+	// print the end of the code section and go back to parsing text.
+	fmt.Fprintln(c.out, s.Text())
+	return c.next, nil
 }
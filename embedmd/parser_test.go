@@ -17,17 +17,24 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strings"
 	"testing"
 )
 
 func TestParser(t *testing.T) {
 	tc := []struct {
-		name string
-		in   string
-		out  string
-		run  commandRunner
-		err  string
+		name       string
+		in         string
+		out        string
+		run        commandRunner
+		lookahead  int
+		blankAfter bool
+		pinned     bool
+		caption    string
+		prefix     string
+		anchors    bool
+		err        string
 	}{
 		{
 			name: "empty file",
@@ -73,11 +80,48 @@ func TestParser(t *testing.T) {
 			in:   "one\n```\n[embedmd]:# (code.go)\n```\n",
 			out:  "one\n```\n[embedmd]:# (code.go)\n```\n",
 		},
+		{
+			name: "a command ignored in a tilde code section",
+			in:   "one\n~~~\n[embedmd]:# (code.go)\n~~~\n",
+			out:  "one\n~~~\n[embedmd]:# (code.go)\n~~~\n",
+		},
+		{
+			name: "a tilde code section with backtick fences",
+			in:   "~~~md\n```go\n[embedmd]:# (code.go)\n```\n~~~\n",
+			out:  "~~~md\n```go\n[embedmd]:# (code.go)\n```\n~~~\n",
+		},
+		{
+			name: "a code section with a shorter fence",
+			in:   "````md\n```\n[embedmd]:# (code.go)\n````\n",
+			out:  "````md\n```\n[embedmd]:# (code.go)\n````\n",
+		},
+		{
+			name: "a code section with an info string in its closing fence",
+			in:   "```\n```go\n[embedmd]:# (code.go)\n```\n",
+			out:  "```\n```go\n[embedmd]:# (code.go)\n```\n",
+		},
 		{
 			name: "unbalanced code section",
 			in:   "one\n```\nsome code\n",
 			err:  "3: unbalanced code section",
 		},
+		{
+			name: "unbalanced tilde code section",
+			in:   "one\n~~~\nsome code\n```\n",
+			err:  "4: unbalanced code section",
+		},
+		{
+			name: "a command replacing a tilde code section",
+			in:   "[embedmd]:# (code.go)\n~~~go\n```\nold\n~~~\nYay\n",
+			out:  "[embedmd]:# (code.go)\nOK\nYay\n",
+			run:  fakeRunner("OK\n"),
+		},
+		{
+			name: "not a fence, since backticks follow",
+			in:   "```inline``` code\n[embedmd]:# (code.go)\n",
+			out:  "```inline``` code\n[embedmd]:# (code.go)\nOK\n",
+			run:  fakeRunner("OK\n"),
+		},
 		{
 			name: "two contiguous code sections",
 			in:   "\n```go\nhello\n```\n```go\nbye\n```\n",
@@ -88,12 +132,282 @@ func TestParser(t *testing.T) {
 			in:   "```go\nhello\n```\n\n```go\nbye\n```\n",
 			out:  "```go\nhello\n```\n\n```go\nbye\n```\n",
 		},
+		{
+			name: "a caption without lookahead",
+			in:   "[embedmd]:# (code.go)\nA caption\n```go\nold\n```\n",
+			out:  "[embedmd]:# (code.go)\nOK\nA caption\n```go\nold\n```\n",
+			run:  fakeRunner("OK\n"),
+		},
+		{
+			name:      "a caption within lookahead",
+			in:        "[embedmd]:# (code.go)\nA caption\n```go\nold\n```\nYay\n",
+			out:       "[embedmd]:# (code.go)\nA caption\nOK\nYay\n",
+			run:       fakeRunner("OK\n"),
+			lookahead: 1,
+		},
+		{
+			name:      "a caption and a blank line within lookahead",
+			in:        "[embedmd]:# (code.go)\nA caption\n\n```go\nold\n```\n",
+			out:       "[embedmd]:# (code.go)\nA caption\n\nOK\n",
+			run:       fakeRunner("OK\n"),
+			lookahead: 2,
+		},
+		{
+			name:      "a code block beyond lookahead",
+			in:        "[embedmd]:# (code.go)\nA caption\n\n```go\nold\n```\n",
+			out:       "[embedmd]:# (code.go)\nOK\nA caption\n\n```go\nold\n```\n",
+			run:       fakeRunner("OK\n"),
+			lookahead: 1,
+		},
+		{
+			name:      "lookahead stops at the next command",
+			in:        "[embedmd]:# (code.go)\nA caption\n[embedmd]:# (code.go)\n```go\nold\n```\n",
+			out:       "[embedmd]:# (code.go)\nOK\nA caption\n[embedmd]:# (code.go)\nOK\n",
+			run:       fakeRunner("OK\n"),
+			lookahead: 3,
+		},
+		{
+			name:      "lookahead reaching end of file",
+			in:        "[embedmd]:# (code.go)\nA caption\n",
+			out:       "[embedmd]:# (code.go)\nOK\nA caption\n",
+			run:       fakeRunner("OK\n"),
+			lookahead: 3,
+		},
+		{
+			name:       "blank line inserted after a new block",
+			in:         "[embedmd]:# (code.go)\nYay\n",
+			out:        "[embedmd]:# (code.go)\nOK\n\nYay\n",
+			run:        fakeRunner("OK\n"),
+			blankAfter: true,
+		},
+		{
+			name:       "blank line inserted after an existing block",
+			in:         "[embedmd]:# (code.go)\n```go\nold\n```\nYay\n",
+			out:        "[embedmd]:# (code.go)\nOK\n\nYay\n",
+			run:        fakeRunner("OK\n"),
+			blankAfter: true,
+		},
+		{
+			name:       "blank line not duplicated",
+			in:         "[embedmd]:# (code.go)\n```go\nold\n```\n\nYay\n",
+			out:        "[embedmd]:# (code.go)\nOK\n\nYay\n",
+			run:        fakeRunner("OK\n"),
+			blankAfter: true,
+		},
+		{
+			name:       "blank line before the next command",
+			in:         "[embedmd]:# (code.go)\n[embedmd]:# (code.go)\n",
+			out:        "[embedmd]:# (code.go)\nOK\n\n[embedmd]:# (code.go)\nOK\n",
+			run:        fakeRunner("OK\n"),
+			blankAfter: true,
+		},
+		{
+			name:       "blank line before the text within lookahead",
+			in:         "[embedmd]:# (code.go)\nA caption\n",
+			out:        "[embedmd]:# (code.go)\nOK\n\nA caption\n",
+			run:        fakeRunner("OK\n"),
+			lookahead:  1,
+			blankAfter: true,
+		},
+		{
+			name:       "no blank line at the end of the file",
+			in:         "[embedmd]:# (code.go)\n```go\nold\n```\n",
+			out:        "[embedmd]:# (code.go)\nOK\n",
+			run:        fakeRunner("OK\n"),
+			blankAfter: true,
+		},
+		{
+			name:    "an anchor before the code block is replaced",
+			in:      "[embedmd]:# (code.go)\n<a id=\"old\"></a>\n```go\nold\n```\nYay\n",
+			out:     "[embedmd]:# (code.go)\nOK\nYay\n",
+			run:     fakeRunner("OK\n"),
+			anchors: true,
+		},
+		{
+			name: "an anchor before the code block of a command with one is replaced",
+			in:   "[embedmd]:# (code.go anchor=new)\n<a id=\"old\"></a>\n```go\nold\n```\nYay\n",
+			out:  "[embedmd]:# (code.go anchor=new)\nOK\nYay\n",
+			run:  fakeRunner("OK\n"),
+		},
+		{
+			name:      "an anchor is kept when anchors are not generated",
+			in:        "[embedmd]:# (code.go)\n<a id=\"mine\"></a>\n```go\nold\n```\nYay\n",
+			out:       "[embedmd]:# (code.go)\n<a id=\"mine\"></a>\nOK\nYay\n",
+			run:       fakeRunner("OK\n"),
+			lookahead: 1,
+		},
+		{
+			name: "an anchor not followed by a code block is kept",
+			in:   "[embedmd]:# (code.go)\n<a id=\"mine\"></a>\nYay\n",
+			out:  "[embedmd]:# (code.go)\nOK\n<a id=\"mine\"></a>\nYay\n",
+			run:  fakeRunner("OK\n"),
+		},
+		{
+			name: "an anchor at the end of the file is kept",
+			in:   "[embedmd]:# (code.go)\n<a id=\"mine\"></a>\n",
+			out:  "[embedmd]:# (code.go)\nOK\n<a id=\"mine\"></a>\n",
+			run:  fakeRunner("OK\n"),
+		},
+		{
+			name:    "an anchor and a caption before the code block are replaced",
+			in:      "[embedmd]:# (code.go)\n<a id=\"old\"></a>\n> from old.go\n```go\nold\n```\nYay\n",
+			out:     "[embedmd]:# (code.go)\nOK\nYay\n",
+			run:     fakeRunner("OK\n"),
+			caption: "> from {path}",
+			anchors: true,
+		},
+		{
+			name:    "a caption not followed by a code block is kept",
+			in:      "[embedmd]:# (code.go)\n> from a quote\nYay\n",
+			out:     "[embedmd]:# (code.go)\nOK\n> from a quote\nYay\n",
+			run:     fakeRunner("OK\n"),
+			caption: "> from {path}",
+		},
+		{
+			name: "captions are not generated without a format",
+			in:   "[embedmd]:# (code.go)\n> from old.go\n```go\nold\n```\n",
+			out:  "[embedmd]:# (code.go)\nOK\n> from old.go\n```go\nold\n```\n",
+			run:  fakeRunner("OK\n"),
+		},
+		{
+			name: "commands in a code block with the embedmd flag",
+			in:   "````md embedmd\n[embedmd]:# (code.go)\n```go\nold\n```\n````\nYay\n",
+			out:  "````md embedmd\n[embedmd]:# (code.go)\nOK\n````\nYay\n",
+			run:  fakeRunner("OK\n"),
+		},
+		{
+			name: "commands in a code block with the embedmd flag and no code block",
+			in:   "````md embedmd\n[embedmd]:# (code.go)\n````\n",
+			out:  "````md embedmd\n[embedmd]:# (code.go)\nOK\n````\n",
+			run:  fakeRunner("OK\n"),
+		},
+		{
+			name: "commands in other code blocks are ignored",
+			in:   "````md\n[embedmd]:# (code.go)\n````\n",
+			out:  "````md\n[embedmd]:# (code.go)\n````\n",
+			run:  failingRunner,
+		},
+		{
+			name: "commands in a tilde code block with the embedmd flag",
+			in:   "~~~md embedmd\n[embedmd]:# (code.go)\n```go\nold\n```\n~~~\n",
+			out:  "~~~md embedmd\n[embedmd]:# (code.go)\nOK\n~~~\n",
+			run:  fakeRunner("OK\n"),
+		},
+		{
+			name: "unbalanced code block with the embedmd flag",
+			in:   "````md embedmd\n[embedmd]:# (code.go)\n```go\nold\n```\n",
+			run:  fakeRunner("OK\n"),
+			err:  "5: unbalanced code section",
+		},
+		{
+			name:   "a pinned command keeps its code block",
+			in:     "[embedmd]:# (code.go)\n```go\nold\n```\n",
+			out:    "[embedmd]:# (code.go)\n```go\nold\n```\n",
+			run:    failingRunner,
+			pinned: true,
+		},
+		{
+			name:   "a pinned command without a code block",
+			in:     "[embedmd]:# (code.go)\nYay\n",
+			out:    "[embedmd]:# (code.go)\nOK\nYay\n",
+			run:    fakeRunner("OK\n"),
+			pinned: true,
+		},
+		{
+			name:   "a pinned command failing",
+			in:     "[embedmd]:# (code.go)\nYay\n",
+			run:    failingRunner,
+			pinned: true,
+			err:    "1: failed",
+		},
+		{
+			name: "a command writing to a sink",
+			in:   "[embedmd]:# (code.go sink=all.md)\n```go\nmine\n```\n",
+			out:  "[embedmd]:# (code.go sink=all.md)\n```go\nmine\n```\n",
+			run:  fakeRunner(""),
+		},
+		{
+			name: "a new inlined image",
+			in:   "[embedmd]:# (logo.png image)\ntext\n",
+			out:  "[embedmd]:# (logo.png image)\n![logo](data:image/png;base64,new)\ntext\n",
+			run:  fakeRunner("![logo](data:image/png;base64,new)\n"),
+		},
+		{
+			name: "an inlined image replaced",
+			in:   "[embedmd]:# (logo.png image)\n![logo](data:image/png;base64,old)\ntext\n",
+			out:  "[embedmd]:# (logo.png image)\n![logo](data:image/png;base64,new)\ntext\n",
+			run:  fakeRunner("![logo](data:image/png;base64,new)\n"),
+		},
+		{
+			name: "other images are not replaced",
+			in:   "[embedmd]:# (logo.png image)\n![logo](logo.png)\n",
+			out:  "[embedmd]:# (logo.png image)\n![logo](data:image/png;base64,new)\n![logo](logo.png)\n",
+			run:  fakeRunner("![logo](data:image/png;base64,new)\n"),
+		},
+		{
+			name: "code blocks are not replaced by images",
+			in:   "[embedmd]:# (logo.png image)\n```go\nOK\n```\n",
+			out:  "[embedmd]:# (logo.png image)\n![logo](data:image/png;base64,new)\n```go\nOK\n```\n",
+			run:  fakeRunner("![logo](data:image/png;base64,new)\n"),
+		},
+		{
+			name: "only one inlined image replaced",
+			in:   "[embedmd]:# (logo.png image)\n![logo](data:image/png;base64,old)\n![logo](data:image/png;base64,other)\n",
+			out:  "[embedmd]:# (logo.png image)\n![logo](data:image/png;base64,new)\n![logo](data:image/png;base64,other)\n",
+			run:  fakeRunner("![logo](data:image/png;base64,new)\n"),
+		},
+		{
+			name: "an index replaced",
+			in:   "[embedmd]:# (docs/ index)\n- [A](docs/a.md)\n- [B](docs/b.md)\n- not generated\n",
+			out:  "[embedmd]:# (docs/ index)\n- [C](docs/c.md)\n- not generated\n",
+			run:  fakeRunner("- [C](docs/c.md)\n"),
+		},
+		{
+			name: "an index at the end of the file",
+			in:   "[embedmd]:# (docs/ index)\n- [A](docs/a.md)",
+			out:  "[embedmd]:# (docs/ index)\n- [C](docs/c.md)\n",
+			run:  fakeRunner("- [C](docs/c.md)\n"),
+		},
+		{
+			name:   "a command with a custom prefix",
+			in:     "[embed]:# (code.go)\n```go\nold\n```\n",
+			out:    "[embed]:# (code.go)\nOK\n",
+			prefix: "[embed]:#",
+			run:    fakeRunner("OK\n"),
+		},
+		{
+			name:   "default commands are text with a custom prefix",
+			in:     "[embedmd]:# (code.go)\n```go\nold\n```\n",
+			out:    "[embedmd]:# (code.go)\n```go\nold\n```\n",
+			prefix: "[embed]:#",
+			run:    failingRunner,
+		},
+		{
+			name:   "tabs with a custom prefix",
+			in:     "[embed]:# (tabs)\n[embed]:# (a.go)\n[embed]:# (/tabs)\n",
+			out:    "[embed]:# (tabs)\n<Tabs>\n<TabItem value=\"go\" label=\"go\">\n\n[embed]:# (a.go)\nOK\n\n</TabItem>\n</Tabs>\n[embed]:# (/tabs)\n",
+			prefix: "[embed]:#",
+			run:    fakeRunner("OK\n"),
+		},
+		{
+			name: "inlined images only replaced by images",
+			in:   "[embedmd]:# (code.go)\n![logo](data:image/png;base64,old)\n",
+			out:  "[embedmd]:# (code.go)\nOK\n![logo](data:image/png;base64,old)\n",
+			run:  fakeRunner("OK\n"),
+		},
 	}
 
 	for _, tt := range tc {
 		t.Run(tt.name, func(t *testing.T) {
 			var out bytes.Buffer
-			err := process(&out, strings.NewReader(tt.in), tt.run)
+			p := &parser{run: tt.run, lookahead: tt.lookahead, blankAfter: tt.blankAfter, prefix: tt.prefix, anchors: tt.anchors}
+			if tt.pinned {
+				p.pinned = func(*command) bool { return true }
+			}
+			if tt.caption != "" {
+				p.isCaption = captionMatcher(tt.caption)
+			}
+			err := p.process(&out, strings.NewReader(tt.in))
 			if !eqErr(t, tt.name, err, tt.err) {
 				return
 			}
@@ -103,3 +417,105 @@ func TestParser(t *testing.T) {
 		})
 	}
 }
+
+func fakeRunner(out string) commandRunner {
+	return func(w io.Writer, cmd *command) error {
+		fmt.Fprint(w, out)
+		return nil
+	}
+}
+
+func failingRunner(io.Writer, *command) error { return fmt.Errorf("failed") }
+
+func TestStaleBlocks(t *testing.T) {
+	tc := []struct {
+		name  string
+		in    string
+		stale []int
+	}{
+		{
+			name: "up to date",
+			in:   "one\n[embedmd]:# (code.go)\n```go\nOK\n```\n",
+		},
+		{
+			name:  "out of date",
+			in:    "one\n[embedmd]:# (code.go)\n```go\nold\n```\n",
+			stale: []int{2},
+		},
+		{
+			name:  "missing blocks",
+			in:    "[embedmd]:# (code.go)\ntext\n[embedmd]:# (code.go)\n",
+			stale: []int{1, 3},
+		},
+		{
+			name:  "only some blocks out of date",
+			in:    "[embedmd]:# (code.go)\n```go\nOK\n```\n[embedmd]:# (code.go)\n```go\nold\n```\n",
+			stale: []int{5},
+		},
+		{
+			name:  "inlined image out of date",
+			in:    "[embedmd]:# (logo.png image)\n![logo](data:image/png;base64,old)\n",
+			stale: []int{1},
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			var stale []int
+			p := &parser{
+				run:   fakeRunner("```go\nOK\n```\n"),
+				stale: func(line int) { stale = append(stale, line) },
+			}
+			if err := p.process(ioutil.Discard, strings.NewReader(tt.in)); err != nil {
+				t.Fatalf("case [%s]: unexpected error: %v", tt.name, err)
+			}
+			if fmt.Sprint(stale) != fmt.Sprint(tt.stale) {
+				t.Errorf("case [%s]: expected stale lines %v; got %v", tt.name, tt.stale, stale)
+			}
+		})
+	}
+}
+
+func TestConfirmation(t *testing.T) {
+	in := "[embedmd]:# (code.go)\n```go\nOK\n```\n" +
+		"[embedmd]:# (code.go)\n```go\nold\n```\n" +
+		"[embedmd]:# (code.go)\n" +
+		"text\n"
+	tc := []struct {
+		name   string
+		accept bool
+		out    string
+	}{
+		{name: "accepted",
+			accept: true,
+			out: "[embedmd]:# (code.go)\n```go\nOK\n```\n" +
+				"[embedmd]:# (code.go)\n```go\nOK\n```\n" +
+				"[embedmd]:# (code.go)\n```go\nOK\n```\n" +
+				"text\n"},
+		{name: "rejected",
+			out: in},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			var asked []string
+			p := &parser{
+				run: fakeRunner("```go\nOK\n```\n"),
+				confirm: func(line int, old, new string) bool {
+					asked = append(asked, fmt.Sprintf("%d:%q", line, old))
+					return tt.accept
+				},
+			}
+			var out bytes.Buffer
+			if err := p.process(&out, strings.NewReader(in)); err != nil {
+				t.Fatalf("case [%s]: unexpected error: %v", tt.name, err)
+			}
+			if got := out.String(); got != tt.out {
+				t.Errorf("case [%s]: expected %q; got %q", tt.name, tt.out, got)
+			}
+			if want := `[5:"` + "```go\\nold\\n```\\n" + `" 9:""]`; fmt.Sprint(asked) != want {
+				t.Errorf("case [%s]: expected to be asked about %s; got %v", tt.name, want, asked)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+)
+
+// sshCommand is the ssh binary run to read the files on ssh remotes.
+var sshCommand = "ssh" // replaced by testing functions.
+
+// scpPrefix starts the paths of files on ssh remotes written as urls, as in
+// scp://user@host:2222/path.
+const scpPrefix = "scp://"
+
+// An sshPath is the location of a file on an ssh remote.
+type sshPath struct {
+	host string // as given to ssh, with the user if any, as in user@host.
+	port string // empty for the default one.
+	file string // relative to the home directory unless absolute.
+}
+
+// splitSSHPath splits a path to a file on an ssh remote, written either as
+// scp://user@host:port/path or as user@host:path, and reports whether it's
+// such a path. As in scp, the path is relative to the home directory of the
+// user, unless it's absolute, as in scp://host//etc/hosts or host:/etc/hosts.
+func splitSSHPath(path string) (sshPath, bool) {
+	if strings.HasPrefix(path, scpPrefix) {
+		u, err := url.Parse(path)
+		if err != nil || u.Hostname() == "" || len(u.Path) < 2 {
+			return sshPath{}, false
+		}
+		host := u.Hostname()
+		if u.User != nil {
+			host = u.User.Username() + "@" + host
+		}
+		return sshPath{host, u.Port(), u.Path[1:]}, true
+	}
+	// the user is required, so the paths of local files with a colon, such as
+	// C:\code.go or git:ref:path, are never taken for remote ones.
+	i := strings.IndexByte(path, ':')
+	if i < 0 || i == len(path)-1 || strings.ContainsAny(path[:i], `/\`) {
+		return sshPath{}, false
+	}
+	if at := strings.IndexByte(path[:i], '@'); at <= 0 || at == i-1 {
+		return sshPath{}, false
+	}
+	return sshPath{path[:i], "", path[i+1:]}, true
+}
+
+// isSSHPath reports whether the path is the one of a file on an ssh remote.
+func isSSHPath(path string) bool {
+	_, ok := splitSSHPath(path)
+	return ok
+}
+
+// WithSSH allows the commands to read files on ssh remotes, given as
+// user@host:path or scp://user@host:port/path, by running ssh, which must be
+// able to log in without asking for a password, as with an ssh agent. Since
+// it connects to any host named in the markdown, it has no effect together
+// with WithSafeMode.
+func WithSSH() Option {
+	return Option{func(e *embedder) { e.ssh = true }}
+}
+
+// sshCat returns the content of the file on the ssh remote. Failing to connect
+// to the remote, which makes ssh exit with status 255, is reported as such.
+func sshCat(p sshPath) ([]byte, error) {
+	args := []string{"-o", "BatchMode=yes"}
+	if p.port != "" {
+		args = append(args, "-p", p.port)
+	}
+	args = append(args, "--", p.host, "cat -- "+shellQuote(p.file))
+	cmd := exec.Command(sshCommand, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err == nil {
+		return out, nil
+	}
+	msg := strings.TrimSpace(stderr.String())
+	if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 255 {
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("could not connect to %s: %s", p.host, msg)
+	}
+	if msg != "" {
+		return nil, errors.New(msg)
+	}
+	return nil, err
+}
+
+// shellQuote quotes s for the shell running the commands given to ssh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,127 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSplitSSHPath(t *testing.T) {
+	tc := []struct {
+		path string
+		out  sshPath
+		ok   bool
+	}{
+		{path: "gopher@build.internal:src/code.go", out: sshPath{"gopher@build.internal", "", "src/code.go"}, ok: true},
+		{path: "gopher@build.internal:/etc/hosts", out: sshPath{"gopher@build.internal", "", "/etc/hosts"}, ok: true},
+		{path: "scp://gopher@build.internal/src/code.go", out: sshPath{"gopher@build.internal", "", "src/code.go"}, ok: true},
+		{path: "scp://build.internal:2222//etc/hosts", out: sshPath{"build.internal", "2222", "/etc/hosts"}, ok: true},
+		{path: "scp://build.internal/"},
+		{path: "build.internal:src/code.go"},
+		{path: "gopher@build.internal:"},
+		{path: "@build.internal:code.go"},
+		{path: "docs/gopher@host:code.go"},
+		{path: `C:\code.go`},
+		{path: "git:v1.0:code.go"},
+		{path: "https://gopher@golang.org/code.go"},
+		{path: "code.go"},
+	}
+
+	for _, tt := range tc {
+		out, ok := splitSSHPath(tt.path)
+		if out != tt.out || ok != tt.ok {
+			t.Errorf("splitting %q: expected %+v, %v; got %+v, %v", tt.path, tt.out, tt.ok, out, ok)
+		}
+	}
+}
+
+// fakeSSH is a program run instead of ssh, which prints its arguments followed
+// by the output of the remote command, run in the directory given, unless it
+// connects to down.example.
+const fakeSSH = `#!/bin/sh
+case "$*" in
+*down.example*) echo "ssh: connect to host down.example port 22: Connection refused" >&2; exit 255;;
+esac
+for last; do :; done
+echo "args: $*"
+cd %q && sh -c "$last"
+`
+
+func TestSSHFetch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ssh is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "ssh"), []byte(fmt.Sprintf(fakeSSH, dir)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "it's.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(ssh string) { sshCommand = ssh }(sshCommand)
+	sshCommand = filepath.Join(dir, "ssh")
+
+	tc := []struct {
+		name  string
+		cmd   command
+		noSSH bool
+		out   string
+		err   string
+	}{
+		{name: "scp-like path",
+			cmd: command{path: "gopher@build.internal:it's.txt", lang: "text"},
+			out: "```text\nargs: -o BatchMode=yes -- gopher@build.internal cat -- 'it'\\''s.txt'\nhello\n```\n"},
+		{name: "scp url with a port",
+			cmd: command{path: "scp://gopher@build.internal:2222/it's.txt", lang: "text"},
+			out: "```text\nargs: -o BatchMode=yes -p 2222 -- gopher@build.internal cat -- 'it'\\''s.txt'\nhello\n```\n"},
+		{name: "missing file",
+			cmd: command{path: "gopher@build.internal:missing.txt", lang: "text"},
+			err: "could not read gopher@build.internal:missing.txt: cat: missing.txt: No such file or directory"},
+		{name: "failed connection",
+			cmd: command{path: "gopher@down.example:it's.txt", lang: "text"},
+			err: "could not read gopher@down.example:it's.txt: could not connect to gopher@down.example: ssh: connect to host down.example port 22: Connection refused"},
+		{name: "ssh not allowed",
+			cmd:   command{path: "gopher@build.internal:it's.txt", lang: "text"},
+			noSSH: true,
+			err:   "could not read gopher@build.internal:it's.txt: reading files over ssh is not allowed"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			e := embedder{Fetcher: fetcher{client: defaultClient}, ssh: !tt.noSSH}
+			var out bytes.Buffer
+			err := e.runCommand(&out, &tt.cmd)
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			if got := out.String(); got != tt.out {
+				t.Errorf("case [%s]: expected output %q; got %q", tt.name, tt.out, got)
+			}
+		})
+	}
+
+	err = Process(ioutil.Discard, strings.NewReader("[embedmd]:# (gopher@build.internal:it's.txt)\n"), WithSSH(), WithSafeMode(dir))
+	eqErr(t, "ssh in safe mode", err, "1: could not read gopher@build.internal:it's.txt: reading files over ssh is not allowed")
+}
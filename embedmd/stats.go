@@ -0,0 +1,123 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Stats describes how the processed markdown references code.
+type Stats struct {
+	Commands int `json:"commands"` // number of commands run.
+
+	// How the content was extracted.
+	Regexp    int `json:"regexp"`    // with regular expressions.
+	WholeFile int `json:"wholeFile"` // embedding the whole source.
+	LineRange int `json:"lineRange"` // with a range of line numbers.
+
+	// Where the content was extracted from.
+	URL   int `json:"url"`   // fetched from a url.
+	Local int `json:"local"` // read from a local file.
+
+	Lines int `json:"lines"` // number of lines embedded.
+}
+
+// WithStats adds the statistics of the processed commands to s, so the same
+// Stats can be used to aggregate them across several calls to Process.
+func WithStats(s *Stats) Option {
+	return Option{func(e *embedder) { e.stats = s }}
+}
+
+// WithEmbedded calls f for every command run, with the size in bytes of the
+// content it embedded, once extracted and transformed, or of the image it
+// inlined. The commands generating a placeholder are not reported.
+func WithEmbedded(f func(cmd Command, size int)) Option {
+	return Option{func(e *embedder) { e.embedded = f }}
+}
+
+// WithLog writes a line to w for every command run, with the line of the
+// command, the path it uses, where the content came from, and the number of
+// lines and bytes it embedded, or the bytes of the image it inlined, as in:
+//
+//     12: code.go (docs/code.go): 8 lines, 213 bytes
+//
+// Local files are given joined to their directory, and urls as fetched. Each
+// line is written with a single call to w.Write. Nothing is logged by default.
+func WithLog(w io.Writer) Option {
+	return Option{func(e *embedder) { e.log = w }}
+}
+
+// record reports a command that embedded b to the statistics, to the function
+// given with WithEmbedded, and to the log, if any.
+func (e *embedder) record(cmd *command, b []byte) {
+	if e.stats != nil {
+		e.stats.record(cmd, b)
+	}
+	if e.embedded != nil {
+		e.embedded(exportCommand(cmd), len(b))
+	}
+	if e.log == nil {
+		return
+	}
+	if cmd.image {
+		fmt.Fprintf(e.log, "%d: %s (%s): %d bytes\n", cmd.line, cmd.path, e.source(cmd), len(b))
+		return
+	}
+	lines := bytes.Count(b, []byte("\n"))
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		lines++
+	}
+	unit := "lines"
+	if lines == 1 {
+		unit = "line"
+	}
+	fmt.Fprintf(e.log, "%d: %s (%s): %d %s, %d bytes\n", cmd.line, cmd.path, e.source(cmd), lines, unit, len(b))
+}
+
+// source returns where the content embedded by cmd came from: the path joined
+// to its directory for local files, the raw url for urls, and the path as
+// given for anything else.
+func (e *embedder) source(cmd *command) string {
+	if len(cmd.run) > 0 {
+		return cmd.path
+	}
+	dir, rel, err := e.resolve(cmd.path)
+	if err != nil {
+		return cmd.path
+	}
+	return bundlePath(dir, rel)
+}
+
+// record adds a command that embedded b to the statistics.
+func (s *Stats) record(cmd *command, b []byte) {
+	s.Commands++
+	switch {
+	case cmd.startLine > 0:
+		s.LineRange++
+	case cmd.start != nil || cmd.firstLines != "":
+		s.Regexp++
+	default:
+		s.WholeFile++
+	}
+	if isURL(cmd.path) {
+		s.URL++
+	} else {
+		s.Local++
+	}
+	if !cmd.image {
+		s.Lines += bytes.Count(b, []byte("\n"))
+	}
+}
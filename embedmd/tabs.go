@@ -0,0 +1,111 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// The arguments of the commands delimiting a group of tabs.
+const (
+	tabsStart = "(tabs)"
+	tabsEnd   = "(/tabs)"
+)
+
+// A tab is one of the code blocks in a group of tabs.
+type tab struct {
+	cmd   string // the line of the command generating the block.
+	lang  string // the language of the code block, which labels the tab.
+	block []byte // the generated code block.
+}
+
+// parsingTabs handles a group of tabs, where only the commands are kept and
+// everything else is generated again.
+func (p *parser) parsingTabs(out io.Writer, s textScanner) (state, error) {
+	fmt.Fprintln(out, s.Text())
+	start := s.Line()
+
+	var tabs []tab
+	var old bytes.Buffer
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case p.isCommand(line) && p.commandArgs(line) == tabsEnd:
+			var group bytes.Buffer
+			renderTabs(&group, tabs)
+			p.update(out, start, old.Bytes(), group.Bytes())
+			fmt.Fprintln(out, line)
+			return p.parsingText, nil
+		case p.isCommand(line) && p.commandArgs(line) == tabsStart:
+			return nil, fmt.Errorf("groups of tabs cannot be nested")
+		case p.isCommand(line):
+			fmt.Fprintln(&old, line)
+			cmd, err := parseCommandLang(p.commandArgs(line), p.guessLang, p.names)
+			if err != nil {
+				return nil, err
+			}
+			cmd.line = s.Line()
+			if cmd.collapse {
+				return nil, fmt.Errorf("code blocks in tabs cannot be collapsed")
+			}
+			var block bytes.Buffer
+			if err := p.run(&block, cmd); err != nil {
+				return nil, err
+			}
+			// tabs are labeled after the language of their code block, which
+			// is only known once the command runs if it's found from a shebang.
+			lang := cmd.lang
+			if p.fenceLang != nil {
+				lang = p.fenceLang(lang)
+			}
+			tabs = append(tabs, tab{line, lang, block.Bytes()})
+		case isFence(line):
+			// skip the old code block, so commands in it are ignored.
+			fmt.Fprintln(&old, line)
+			fence := fenceOf(line)
+			for {
+				if !s.Scan() {
+					return nil, fmt.Errorf("unbalanced code section")
+				}
+				fmt.Fprintln(&old, s.Text())
+				if closesFence(s.Text(), fence) {
+					break
+				}
+			}
+		default:
+			fmt.Fprintln(&old, line)
+		}
+	}
+	return nil, fmt.Errorf("missing %s for the group of tabs in line %d", tabsEnd, start)
+}
+
+// renderTabs writes the tabs using the syntax of Docusaurus, where each tab is
+// labeled with the language of its code block.
+func renderTabs(w io.Writer, tabs []tab) {
+	fmt.Fprintln(w, "<Tabs>")
+	seen := make(map[string]int)
+	for _, t := range tabs {
+		value := t.lang
+		if seen[t.lang]++; seen[t.lang] > 1 {
+			value = fmt.Sprintf("%s-%d", t.lang, seen[t.lang])
+		}
+		fmt.Fprintf(w, "<TabItem value=%q label=%q>\n\n", value, t.lang)
+		fmt.Fprintln(w, t.cmd)
+		w.Write(t.block)
+		fmt.Fprint(w, "\n</TabItem>\n")
+	}
+	fmt.Fprintln(w, "</Tabs>")
+}
@@ -0,0 +1,166 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+const tabsOut = "[embedmd]:# (tabs)\n" +
+	"<Tabs>\n" +
+	"<TabItem value=\"go\" label=\"go\">\n\n" +
+	"[embedmd]:# (hello.go)\n" +
+	"```go\nhello.go\n```\n\n" +
+	"</TabItem>\n" +
+	"<TabItem value=\"py\" label=\"py\">\n\n" +
+	"[embedmd]:# (hello.py)\n" +
+	"```py\nhello.py\n```\n\n" +
+	"</TabItem>\n" +
+	"</Tabs>\n" +
+	"[embedmd]:# (/tabs)\n"
+
+func TestTabs(t *testing.T) {
+	tc := []struct {
+		name string
+		in   string
+		out  string
+		err  string
+	}{
+		{
+			name: "generating a group of tabs",
+			in: "[embedmd]:# (tabs)\n" +
+				"[embedmd]:# (hello.go)\n" +
+				"[embedmd]:# (hello.py)\n" +
+				"[embedmd]:# (/tabs)\n" +
+				"Yay\n",
+			out: tabsOut + "Yay\n",
+		},
+		{
+			name: "regenerating a group of tabs",
+			in:   tabsOut,
+			out:  tabsOut,
+		},
+		{
+			name: "updating a group of tabs",
+			in: "[embedmd]:# (tabs)\n" +
+				"<Tabs>\n" +
+				"[embedmd]:# (hello.go)\n" +
+				"```go\nold\n[embedmd]:# (ignored.go)\n```\n" +
+				"some text\n" +
+				"[embedmd]:# (hello.py)\n" +
+				"[embedmd]:# (/tabs)\n",
+			out: tabsOut,
+		},
+		{
+			name: "tabs with the same language",
+			in: "[embedmd]:# (tabs)\n" +
+				"[embedmd]:# (a.go)\n" +
+				"[embedmd]:# (b.go)\n" +
+				"[embedmd]:# (/tabs)\n",
+			out: "[embedmd]:# (tabs)\n" +
+				"<Tabs>\n" +
+				"<TabItem value=\"go\" label=\"go\">\n\n" +
+				"[embedmd]:# (a.go)\n" +
+				"```go\na.go\n```\n\n" +
+				"</TabItem>\n" +
+				"<TabItem value=\"go-2\" label=\"go\">\n\n" +
+				"[embedmd]:# (b.go)\n" +
+				"```go\nb.go\n```\n\n" +
+				"</TabItem>\n" +
+				"</Tabs>\n" +
+				"[embedmd]:# (/tabs)\n",
+		},
+		{
+			name: "missing end of the group",
+			in:   "[embedmd]:# (tabs)\n[embedmd]:# (hello.go)\n",
+			err:  "2: missing (/tabs) for the group of tabs in line 1",
+		},
+		{
+			name: "end of a group without a start",
+			in:   "text\n[embedmd]:# (/tabs)\n",
+			err:  "2: (/tabs) without a matching (tabs)",
+		},
+		{
+			name: "nested groups",
+			in:   "[embedmd]:# (tabs)\n[embedmd]:# (tabs)\n",
+			err:  "2: groups of tabs cannot be nested",
+		},
+		{
+			name: "collapsed tab",
+			in:   "[embedmd]:# (tabs)\n[embedmd]:# (hello.go collapse)\n",
+			err:  "2: code blocks in tabs cannot be collapsed",
+		},
+	}
+
+	run := func(w io.Writer, cmd *command) error {
+		fmt.Fprintf(w, "```%s\n%s\n```\n", cmd.lang, cmd.path)
+		return nil
+	}
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := process(&out, strings.NewReader(tt.in), run)
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			if got := out.String(); got != tt.out {
+				t.Errorf("case [%s] expected %q; got %q", tt.name, tt.out, got)
+			}
+		})
+	}
+}
+
+func TestTabsWithCaptions(t *testing.T) {
+	files := mixedContentProvider{files: map[string][]byte{"code.go": []byte("package main\n"), "conf.yml": []byte("a: 1\n")}}
+	in := "[embedmd]:# (tabs)\n" +
+		"[embedmd]:# (code.go)\n" +
+		"[embedmd]:# (conf.yml)\n" +
+		"[embedmd]:# (/tabs)\n"
+	want := "[embedmd]:# (tabs)\n" +
+		"<Tabs>\n" +
+		"<TabItem value=\"go\" label=\"go\">\n\n" +
+		"[embedmd]:# (code.go)\n" +
+		"> from code.go\n" +
+		"```go\npackage main\n```\n\n" +
+		"</TabItem>\n" +
+		"<TabItem value=\"yaml\" label=\"yaml\">\n\n" +
+		"[embedmd]:# (conf.yml)\n" +
+		"> from conf.yml\n" +
+		"```yaml\na: 1\n```\n\n" +
+		"</TabItem>\n" +
+		"</Tabs>\n" +
+		"[embedmd]:# (/tabs)\n"
+
+	opts := []Option{WithFetcher(files), WithCaption("> from {path}"), WithLangAlias("yml", "yaml")}
+	var out bytes.Buffer
+	if err := Process(&out, strings.NewReader(in), opts...); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := out.String(); got != want {
+		t.Errorf("expected %q; got %q", want, got)
+	}
+
+	// the tabs are labeled the same way when generated again.
+	var again bytes.Buffer
+	if err := Process(&again, strings.NewReader(want), opts...); err != nil {
+		t.Fatalf("unexpected error processing again: %v", err)
+	}
+	if got := again.String(); got != want {
+		t.Errorf("expected the same output processing again; got %q", got)
+	}
+}
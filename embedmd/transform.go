@@ -0,0 +1,348 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// stripShebang removes the first line of b if it is a shebang, such as
+// #!/bin/sh.
+func stripShebang(b []byte) []byte {
+	if !bytes.HasPrefix(b, []byte("#!")) {
+		return b
+	}
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		return b[i+1:]
+	}
+	return nil
+}
+
+// stripLines removes from b the lines matching any of the regular expressions
+// in res, which are written between slashes, as in /^\/\/ nolint/.
+func stripLines(b []byte, res []string) ([]byte, error) {
+	return filterLines(b, nil, res)
+}
+
+// filterLines returns the lines of b matching all the regular expressions in
+// keep and none of the ones in drop, which are written between slashes.
+func filterLines(b []byte, keep, drop []string) ([]byte, error) {
+	compile := func(res []string) ([]*regexp.Regexp, error) {
+		var compiled []*regexp.Regexp
+		for _, s := range res {
+			re, err := compileRegexp(s)
+			if err != nil {
+				return nil, err
+			}
+			compiled = append(compiled, re)
+		}
+		return compiled, nil
+	}
+	keepRes, err := compile(keep)
+	if err != nil {
+		return nil, err
+	}
+	dropRes, err := compile(drop)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n') + 1
+		if i == 0 {
+			i = len(b)
+		}
+		line := b[:i]
+		b = b[i:]
+		text := bytes.TrimSuffix(line, []byte("\n"))
+		kept := true
+		for _, re := range keepRes {
+			kept = kept && re.Match(text)
+		}
+		for _, re := range dropRes {
+			kept = kept && !re.Match(text)
+		}
+		if kept {
+			out = append(out, line...)
+		}
+	}
+	return out, nil
+}
+
+// numberLines prefixes each line in b with its number, counting from first,
+// right-aligned to the width of the last one.
+func numberLines(b []byte, first int) []byte {
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	width := len(strconv.Itoa(first + len(lines) - 1))
+	var out bytes.Buffer
+	for i, line := range lines {
+		text := bytes.TrimSuffix(line, []byte("\n"))
+		fmt.Fprintf(&out, "%*d", width, first+i)
+		if len(text) > 0 {
+			fmt.Fprintf(&out, "  %s", text)
+		}
+		out.Write(line[len(text):])
+	}
+	return out.Bytes()
+}
+
+// hashComments contains the languages using # for comments.
+var hashComments = map[string]bool{
+	"bash": true, "dockerfile": true, "make": true, "makefile": true,
+	"perl": true, "pl": true, "py": true, "python": true, "r": true,
+	"rb": true, "ruby": true, "sh": true, "shell": true, "toml": true,
+	"yaml": true, "yml": true, "zsh": true,
+}
+
+// stripLicense removes the first comment block in b, which is usually a
+// license header, and the blank lines following it. The comment block must
+// start at the top of b, or right after a shebang line, and is either a
+// /* */ comment or a run of lines starting with //. For languages using #
+// for comments, a run of lines starting with # is also a comment block.
+func stripLicense(b []byte, lang string) []byte {
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	var shebang []byte
+	if len(lines) > 0 && bytes.HasPrefix(lines[0], []byte("#!")) {
+		shebang, lines = lines[0], lines[1:]
+	}
+
+	if len(lines) == 0 {
+		return b
+	}
+
+	trimmed := func(i int) string { return strings.TrimSpace(string(lines[i])) }
+	i := 0
+	if first := trimmed(0); strings.HasPrefix(first, "/*") {
+		for i < len(lines) && !strings.Contains(trimmed(i), "*/") {
+			i++
+		}
+		if i == len(lines) {
+			return b // the comment is never closed.
+		}
+		i++
+	} else {
+		prefix := "//"
+		if hashComments[lang] && strings.HasPrefix(first, "#") {
+			prefix = "#"
+		}
+		for i < len(lines) && strings.HasPrefix(trimmed(i), prefix) {
+			i++
+		}
+	}
+	if i == 0 {
+		return b
+	}
+	for i < len(lines) && trimmed(i) == "" {
+		i++
+	}
+	return append(shebang[:len(shebang):len(shebang)], bytes.Join(lines[i:], nil)...)
+}
+
+// expandLeadingTabs replaces the tabs in the indentation of every line in b,
+// that is the tabs before the first character that is neither a tab nor a
+// space, with as many spaces as needed to reach the next multiple of width.
+// Tabs after that character, as found in aligned comments, are kept.
+func expandLeadingTabs(b []byte, width int) []byte {
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		col, i := 0, 0
+		for ; i < len(line) && (line[i] == '\t' || line[i] == ' '); i++ {
+			if line[i] == ' ' {
+				col++
+				continue
+			}
+			col += width - col%width
+		}
+		out.WriteString(strings.Repeat(" ", col))
+		out.Write(line[i:])
+	}
+	return out.Bytes()
+}
+
+// wrapIndent is added to the indentation of a wrapped line to indent the
+// lines continuing it.
+const wrapIndent = "    "
+
+// wrapLines wraps every line in b longer than width characters at the last
+// space that keeps it within width, continuing it in lines indented like it
+// plus wrapIndent. Spaces within quotes are never used, unless the quotes of
+// the line are unbalanced, as in prose, and a line with no space to wrap at
+// is kept whole, so some lines can still be longer than width.
+func wrapLines(b []byte, width int) []byte {
+	if width <= 0 {
+		return b
+	}
+	var out bytes.Buffer
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		text := strings.TrimSuffix(line, "\n")
+		out.WriteString(wrapLine(text, width))
+		out.WriteString(line[len(text):])
+	}
+	return out.Bytes()
+}
+
+// wrapLine wraps a single line as wrapLines does.
+func wrapLine(line string, width int) string {
+	if utf8.RuneCountInString(line) <= width {
+		return line
+	}
+	indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	breaks := wrapPoints(line, len(indent))
+
+	var lines []string
+	prefix, start := "", 0
+	for utf8.RuneCountInString(prefix+line[start:]) > width {
+		// the last space keeping the line within width, or the first one
+		// after it if none does.
+		end := -1
+		for _, p := range breaks {
+			if p <= start {
+				continue
+			}
+			if end >= 0 && utf8.RuneCountInString(prefix+line[start:p]) > width {
+				break
+			}
+			end = p
+		}
+		if end < 0 {
+			break
+		}
+		lines = append(lines, prefix+strings.TrimRight(line[start:end], " "))
+		prefix, start = indent+wrapIndent, end+len(line[end:])-len(strings.TrimLeft(line[end:], " "))
+	}
+	if start < len(line) {
+		lines = append(lines, prefix+line[start:])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// wrapPoints returns the offsets of the spaces in line, after its indentation,
+// where it can be wrapped, which are the ones out of quotes unless the quotes
+// are unbalanced. Only the spaces following other characters are returned,
+// so wrapping at them never leaves an empty line.
+func wrapPoints(line string, indent int) []int {
+	var points, all []int
+	var quote rune
+	for i := indent; i < len(line); i++ {
+		c := rune(line[i])
+		switch {
+		case quote != 0 && c == '\\' && quote != '\'':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == ' ' && line[i-1] != ' ':
+			points = append(points, i)
+		}
+		if c == ' ' && line[i-1] != ' ' {
+			all = append(all, i)
+		}
+	}
+	if quote != 0 {
+		return all
+	}
+	return points
+}
+
+// trimTrailingSpace removes the spaces, tabs, and carriage returns at the end
+// of every line in b, and the empty lines at its end, keeping the newline of
+// the last line left if it has one.
+func trimTrailingSpace(b []byte) []byte {
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		text := bytes.TrimSuffix(line, []byte("\n"))
+		out.Write(bytes.TrimRight(text, " \t\r"))
+		out.Write(line[len(text):])
+	}
+	trimmed := bytes.TrimRight(out.Bytes(), "\n")
+	if len(trimmed) > 0 && len(trimmed) < out.Len() {
+		trimmed = out.Bytes()[:len(trimmed)+1]
+	}
+	return trimmed
+}
+
+// textLangs contains the languages of prose, rather than code.
+var textLangs = map[string]bool{
+	"markdown": true, "md": true, "plain": true, "plaintext": true,
+	"text": true, "txt": true,
+}
+
+// tabLangs contains the languages where tabs are meaningful, so expanding
+// them would break the code if it were copied.
+var tabLangs = map[string]bool{
+	"make": true, "makefile": true, "mk": true,
+}
+
+// asciiReplacer replaces typographic characters with their ASCII equivalents.
+var asciiReplacer = strings.NewReplacer(
+	"‘", "'", "’", "'", "‚", "'", "‛", "'", // ‘ ’ ‚ ‛
+	"“", `"`, "”", `"`, "„", `"`, "‟", `"`, // “ ” „ ‟
+	"\u00a0", " ", "\u2007", " ", "\u202f", " ", // non-breaking spaces
+	"–", "-", "—", "--", // – —
+	"…", "...", // …
+)
+
+// normalizeText replaces the typographic characters in b, such as curly
+// quotes and non-breaking spaces, with their ASCII equivalents.
+func normalizeText(b []byte) []byte {
+	return []byte(asciiReplacer.Replace(string(b)))
+}
+
+// redacted replaces the secrets found in embedded content.
+const redacted = "REDACTED"
+
+// DefaultSecrets are the patterns of the secrets redacted by WithRedact when
+// none are given: cloud and chat tokens, private keys, and values assigned to
+// names such as password or api_key.
+var DefaultSecrets = []*regexp.Regexp{
+	regexp.MustCompile(`AKIA[0-9A-Z]{16}`),
+	regexp.MustCompile(`AIza[0-9A-Za-z_-]{35}`),
+	regexp.MustCompile(`gh[pousr]_[0-9A-Za-z]{36,}`),
+	regexp.MustCompile(`xox[abprs]-[0-9A-Za-z-]{10,}`),
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`),
+	regexp.MustCompile(`(?i)(?:api_?key|secret|token|password|passwd)["']?\s*[:=]\s*["']([^"'\s]{8,})["']`),
+}
+
+// redact replaces every match of the patterns in b with REDACTED, or only the
+// text matched by their first group if they have one.
+func redact(b []byte, patterns []*regexp.Regexp) []byte {
+	for _, re := range patterns {
+		var out []byte
+		last := 0
+		for _, m := range re.FindAllSubmatchIndex(b, -1) {
+			start, end := m[0], m[1]
+			if len(m) > 2 && m[2] >= 0 {
+				start, end = m[2], m[3]
+			}
+			out = append(append(out, b[last:start]...), redacted...)
+			last = end
+		}
+		if out != nil {
+			b = append(out, b[last:]...)
+		}
+	}
+	return b
+}
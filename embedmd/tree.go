@@ -0,0 +1,88 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// runTree writes a code block listing the files in the directory used by the
+// command as a tree.
+func (e *embedder) runTree(w io.Writer, cmd *command) error {
+	if isURL(cmd.path) {
+		return fmt.Errorf("could not list %s: only local directories can be listed", cmd.path)
+	}
+	dir, rel, err := e.resolve(cmd.path)
+	if err != nil {
+		return fmt.Errorf("could not list %s: %v", cmd.path, err)
+	}
+	dir = filepath.Join(dir, filepath.FromSlash(rel))
+	if e.safe {
+		if err := within(e.root, dir); err != nil {
+			return fmt.Errorf("could not list %s: %v", cmd.path, err)
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintln(&b, path.Base(cmd.path)+"/")
+	if err := listTree(&b, dir, "", cmd.depth, cmd.hidden); err != nil {
+		return fmt.Errorf("could not list %s: %v", cmd.path, err)
+	}
+	e.record(cmd, b.Bytes())
+	e.writeBlock(w, cmd, "text", b.Bytes())
+	return nil
+}
+
+// listTree writes a line for each file in dir, sorted by name, followed by
+// the files in it if it's a directory, up to depth levels deep unless depth
+// is zero. Each line starts with the given prefix, and files whose name
+// starts with a dot are skipped unless hidden is set.
+func listTree(w io.Writer, dir, prefix string, depth int, hidden bool) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if !hidden {
+		visible := files[:0]
+		for _, f := range files {
+			if !strings.HasPrefix(f.Name(), ".") {
+				visible = append(visible, f)
+			}
+		}
+		files = visible
+	}
+	for i, f := range files {
+		branch, indent := "├── ", "│   "
+		if i == len(files)-1 {
+			branch, indent = "└── ", "    "
+		}
+		if !f.IsDir() {
+			fmt.Fprintf(w, "%s%s%s\n", prefix, branch, f.Name())
+			continue
+		}
+		fmt.Fprintf(w, "%s%s%s/\n", prefix, branch, f.Name())
+		if depth != 1 {
+			if err := listTree(w, filepath.Join(dir, f.Name()), prefix+indent, depth-1, hidden); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
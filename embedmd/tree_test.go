@@ -0,0 +1,85 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"examples/main.go", "examples/.env", "examples/hello/hello.go", "examples/hello/data/x.txt", "examples/web/index.html"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tc := []struct {
+		name string
+		in   string
+		out  string
+		err  string
+	}{
+		{name: "whole tree",
+			in: "[embedmd]:# (examples/ tree)\n",
+			out: "[embedmd]:# (examples/ tree)\n```text\nexamples/\n" +
+				"├── hello/\n" +
+				"│   ├── data/\n" +
+				"│   │   └── x.txt\n" +
+				"│   └── hello.go\n" +
+				"├── main.go\n" +
+				"└── web/\n" +
+				"    └── index.html\n```\n"},
+		{name: "limited depth with hidden files",
+			in: "[embedmd]:# (examples tree depth=1 hidden)\n",
+			out: "[embedmd]:# (examples tree depth=1 hidden)\n```text\nexamples/\n" +
+				"├── .env\n" +
+				"├── hello/\n" +
+				"├── main.go\n" +
+				"└── web/\n```\n"},
+		{name: "missing directory",
+			in:  "[embedmd]:# (missing/ tree)\n",
+			err: "1: could not list missing/: open " + filepath.Join(dir, "missing") + ": no such file or directory"},
+		{name: "url",
+			in:  "[embedmd]:# (https://example.com/ tree)\n",
+			err: "1: could not list https://example.com/: only local directories can be listed"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := Process(&out, strings.NewReader(tt.in), WithBaseDir(dir))
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			if got := out.String(); got != tt.out {
+				t.Errorf("case [%s]: expected output\n%s\ngot\n%s", tt.name, tt.out, got)
+			}
+		})
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/campoy/embedmd
 
+go 1.16
+
 require github.com/pmezard/go-difflib v1.0.0
@@ -22,24 +22,180 @@
 // The command receives a list of markdown files, if none is given it
 // reads from the standard input.
 //
-// embedmd supports two flags:
+// embedmd supports these flags:
 // -d: will print the difference of the input file with what the output
-//     would have been if executed.
+//     would have been if executed, naming the files a/docs.md and b/docs.md,
+//     so the diff can be applied with patch -p1.
 // -w: rewrites the given files rather than writing the output to the standard
-//     output.
+//     output. Each file is replaced atomically, keeping its mode, so it is
+//     never left half written.
+// -check: like -d, but instead of printing the differences, only reports the
+//     files that are out of date to the standard error, and exits with status
+//     1 if there are any. It's meant for continuous integration.
+// -verify: processes the output again before writing it, and fails if that
+//     changes it, which catches content confusing the parser, such as code
+//     blocks within the embedded content, before it breaks the document.
+// -json: instead of writing the markdown or the differences, prints to the
+//     standard output a JSON array with an object for each file, with its
+//     path, empty for the standard input, whether it changed, and the line,
+//     source, and size in bytes of the content embedded by each command run:
+//
+//         [{"path": "README.md", "changed": true,
+//           "commands": [{"line": 3, "source": "hello.go", "bytes": 120}]}]
+//
+//     It cannot be combined with -w, -d, -i, or -check.
+// -no-refetch-urls: keeps the blocks already embedded from URLs as they are,
+//     without fetching the URLs again, so remote content is pinned once it
+//     is first embedded. Since those blocks don't change, -d never reports
+//     them as out of date.
+// -timeout: the time after which fetching a URL fails, 30s by default. URLs are
+//     fetched again, up to two times, when the server fails with a 5xx status.
+// -refresh: fetches the URLs again even with -no-refetch-urls.
+// -header: adds a header to the requests fetching URLs, as in
+//     -header 'Authorization: token $GHE_TOKEN', and can be given several
+//     times. References to environment variables are replaced by their
+//     values, so tokens are never written in the command line. The proxy
+//     given by HTTP_PROXY, HTTPS_PROXY, and NO_PROXY is always used.
+// -caption: adds a caption with the given format before every code block, with
+//     {path} replaced by the path or URL of the embedded content, such as
+//     "> from {path}".
+// -guess-lang: guesses the language of the files with no extension, no
+//     well-known name, and no shebang line, when none is given, from their
+//     syntax.
+// -keep-going: skips the commands that fail, keeping their blocks as they are,
+//     instead of stopping at the first one, and reports all of them once
+//     every file is processed, exiting with a non zero status.
+// -missing-placeholder: embeds the given placeholder, with {path} replaced by
+//     the path or URL, when some content cannot be read, printing a warning
+//     instead of failing.
+// -normalize: instead of running the commands, rewrites them in their
+//     canonical form, with single spaces between the arguments and the flags
+//     in a fixed order, leaving everything else as it is. It can be combined
+//     with -w and -d.
+// -r: processes the markdown files in the directories given as paths, and in
+//     their subdirectories, skipping hidden directories and any other files.
+//     Paths can also be glob patterns, quoted to keep the shell from expanding
+//     them, where ** matches any number of directories, as in docs/**/*.md.
+// -paths-from: reads the paths of the markdown files to process from the given
+//     file, or the standard input if it is -, one per line, ignoring blank
+//     lines and lines starting with #. They are processed after the paths
+//     given as arguments.
+// -stdin-name: the path of the markdown read from the standard input, as in
+//     embedmd -d -stdin-name docs/guide.md < docs/guide.md, so its relative
+//     paths are resolved against its directory, and the messages and diffs
+//     name it. It cannot be used when paths are given.
+// -check-urls: instead of embedding anything, checks that the URLs used by
+//     the commands can be fetched, printing the result for each of them, and
+//     exits with a non zero status if any of them cannot. It cannot be used
+//     with -safe, which never fetches URLs.
+// -trim: removes the whitespace at the end of the embedded lines and the empty
+//     lines at the end of each snippet, which is the default, so -trim=false
+//     keeps them.
+// -wrap: wraps the embedded lines longer than this many characters, at the
+//     last space that fits, indenting the lines continuing them. Since this
+//     changes the content, wrapped commands may not work if copied.
+// -check-indent: prints a warning to the standard error for every embedded
+//     snippet mixing tabs and spaces in its indentation.
+// -check-overlap: prints a warning to the standard error for every command
+//     embedding lines of a file already embedded by a previous command.
+// -check-forbidden: reports every embedded line containing one of the
+//     substrings given with -forbidden, TODO, FIXME, and XXX by default,
+//     either as a warning with warn or by failing the command with error.
+// -forbidden: the comma separated substrings checked by -check-forbidden.
+// -redact: replaces the secrets found in the embedded content, such as API
+//     tokens or private keys, with REDACTED.
+// -redact-pattern: a regular expression matching the secrets replaced by
+//     -redact instead of the default ones, or only its first group if it has
+//     one. It can be repeated, and implies -redact.
+// -i: like -w, but shows the changes to each out of date block and asks
+//     whether to apply them, answering y, n, or a to apply all the following
+//     ones. If the standard input is not a terminal, it behaves like -d.
+// -format: selects how -d and -check report differences. The default, diff,
+//     prints a unified diff with -d and the out of date files with -check;
+//     github prints GitHub Actions error annotations for each out of date
+//     block instead.
+// -diff-format: selects the format of the diffs printed by -d: unified, the
+//     default, context, or side-by-side.
+// -lang: maps a file extension to the language of its code blocks, as in
+//     -lang yml=yaml. It can be repeated.
+// -name-lang: sets the language of the files with the given name, as in
+//     -name-lang Jenkinsfile=groovy, instead of the built-in one of
+//     well-known files such as Dockerfile. It can be repeated.
+// -allow-exec: allows the commands that run other programs, such as blame,
+//     which runs git, go:vet and go:build, the extractors given with
+//     ext:name, or the programs given with exec:, which can be any. It has no
+//     effect with -safe.
+// -allow-ssh: allows reading the files on ssh remotes, given as
+//     user@host:path or scp://user@host:port/path, by running ssh, which must
+//     log in without asking for a password. It has no effect with -safe.
+// -strict-checks: makes the commands using go:vet or go:build fail when the
+//     package does not pass, instead of embedding its errors.
+// -max-width: prints a warning to the standard error for every embedded line
+//     longer than the width given for its language, as in -max-width go=100.
+//     It can be repeated.
+// -require-tracked: fails any command embedding a local file that is not
+//     tracked by git. Files outside of a git repository are only rejected
+//     if -require-repo is set too.
+// -root: the directory that paths starting with //, as in //pkg/code.go, are
+//     relative to, instead of the closest directory containing the markdown
+//     file with a .git entry or, outside of a repository, the directory of the
+//     first file processed, or the current directory for the standard input.
+//     It's relative to the current directory.
+// -safe: for untrusted markdown, fails any command that would fetch a URL or
+//     read a file outside of the current directory. It cannot be used with
+//     -check-urls.
+// -verbose: logs to the standard error every command run, with the markdown
+//     file and line of the command, where the content came from, and how many
+//     lines and bytes it embedded, as in
+//     docs.md:12: code.go (docs/code.go): 8 lines, 213 bytes.
+// -stats: once all files are processed, prints to the standard error
+//     statistics about the commands, either as text or json.
+// -summary: once all files are processed, prints to the standard error how
+//     many there were, how many of them changed, or would with -d or -check,
+//     and how many commands were run, counting the standard input as one
+//     file, as in
+//     3 files processed, 1 changed, 12 commands run.
+// -cache: keeps the content extracted for every command embedding a local
+//     file in .embedmd/cache, so it's only extracted and formatted again once
+//     the file, the command, or the flags change.
+// -bundle: once all files are processed, writes to the given file a markdown
+//     file with the whole content of every embedded source, each in its own
+//     code block labeled with its path, sorted by path.
+//
+// The markdown files matching the gitignore-style patterns in .embedmdignore,
+// in the current directory, are skipped, as in:
+//
+//     # generated reference docs
+//     docs/api/
+//     !docs/api/index.md
+//     vendor/**/*.md
+//
+// Language aliases are also read from the JSON objects, mapping extensions to
+// languages, in ~/.embedmd/languages.json and then .embedmd/languages.json in
+// the current directory. Aliases in later files take precedence, and the ones
+// given with -lang override them all.
 //
 // For more information on the format of the commands, read the documentation
 // of the github.com/campoy/embedmd/embedmd package.
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/campoy/embedmd/embedmd"
 	"github.com/pmezard/go-difflib/difflib"
@@ -56,7 +212,54 @@ func usage() {
 func main() {
 	rewrite := flag.Bool("w", false, "write result to (markdown) file instead of stdout")
 	doDiff := flag.Bool("d", false, "display diffs instead of rewriting files")
+	doCheck := flag.Bool("check", false, "report the files that are out of date and exit with status 1 if any, without printing diffs")
+	verify := flag.Bool("verify", false, "fail unless processing the output again leaves it as it is")
+	jsonReport := flag.Bool("json", false, `print a JSON array instead of the output, with an object per file: {"path", "changed", "commands": [{"line", "source", "bytes"}]}`)
+	noRefetch := flag.Bool("no-refetch-urls", false, "keep the blocks already embedded from URLs instead of fetching them again")
+	timeout := flag.Duration("timeout", 30*time.Second, "time after which fetching a URL fails")
+	refresh := flag.Bool("refresh", false, "fetch the URLs again even with -no-refetch-urls")
+	headerFlags := make(headers)
+	flag.Var(headerFlags, "header", "header sent when fetching URLs, as in 'Authorization: token $TOKEN', with environment variables replaced (repeatable)")
+	normalize := flag.Bool("normalize", false, "rewrite the commands in their canonical form instead of running them")
+	caption := flag.String("caption", "", "add a caption with this format, with {path} replaced, before every code block")
+	guessLang := flag.Bool("guess-lang", false, "guess the language of files with no extension from their syntax")
+	keepGoing := flag.Bool("keep-going", false, "skip the commands that fail, reporting all of them at the end, instead of stopping")
+	placeholder := flag.String("missing-placeholder", "", "embed this placeholder, with {path} replaced, when some content cannot be read, instead of failing")
+	checkLinks := flag.Bool("check-urls", false, "check that the URLs used by the commands can be fetched, without embedding anything; not allowed with -safe")
+	interactive := flag.Bool("i", false, "ask before rewriting each out of date block in the files")
 	printVersion := flag.Bool("v", false, "display embedmd version")
+	format := flag.String("format", "diff", "format used by -d and -check to report differences: diff or github")
+	diffFormat := flag.String("diff-format", "unified", "format of the diffs printed by -d: unified, context, or side-by-side")
+	root := flag.String("root", "", "directory that paths starting with // are relative to, instead of the repository root or, outside of one, the directory of the first file processed")
+	safe := flag.Bool("safe", false, "fail commands fetching URLs or reading files outside of the current directory; not allowed with -check-urls")
+	trim := flag.Bool("trim", true, "remove the whitespace at the end of embedded lines and the empty lines at the end of the snippets")
+	wrap := flag.Int("wrap", 0, "wrap the embedded lines longer than this many characters")
+	checkIndent := flag.Bool("check-indent", false, "warn about embedded code mixing tabs and spaces in its indentation")
+	checkOverlap := flag.Bool("check-overlap", false, "warn about commands embedding overlapping line ranges of a file")
+	checkForbidden := flag.String("check-forbidden", "", "report embedded lines containing the -forbidden substrings: warn or error")
+	forbidden := flag.String("forbidden", strings.Join(embedmd.DefaultForbidden, ","), "comma separated substrings checked by -check-forbidden")
+	allowSSH := flag.Bool("allow-ssh", false, "allow reading files on ssh remotes, such as user@host:path, by running ssh")
+	allowExec := flag.Bool("allow-exec", false, "allow commands running other programs, such as blame running git, go:vet, extractors, or exec: (unsafe)")
+	strictChecks := flag.Bool("strict-checks", false, "fail the commands using go:vet or go:build on packages that do not pass")
+	tracked := flag.Bool("require-tracked", false, "fail commands embedding local files not tracked by git")
+	inRepo := flag.Bool("require-repo", false, "with -require-tracked, also fail on files outside of a git repository")
+	useCache := flag.Bool("cache", false, "keep the content extracted from local files in "+cacheDir+" across runs")
+	bundlePath := flag.String("bundle", "", "write every embedded source to this markdown file")
+	verbose := flag.Bool("verbose", false, "log to stderr every command run, with the lines and bytes it embedded")
+	statsFormat := flag.String("stats", "", "print statistics about the commands to stderr: text or json")
+	printSummary := flag.Bool("summary", false, "print to stderr how many files were processed and changed, and how many commands were run")
+	recursive := flag.Bool("r", false, "process the markdown files in the directories given as paths, recursively")
+	stdinName := flag.String("stdin-name", "", "path of the markdown read from the standard input, which relative paths are resolved against")
+	pathsFrom := flag.String("paths-from", "", "read the paths of the markdown files to process from this file, one per line, or - for the standard input")
+	langFlags := make(aliases)
+	flag.Var(langFlags, "lang", "alias from a file extension to a language, as in yml=yaml (repeatable)")
+	nameLangs := make(aliases)
+	flag.Var(nameLangs, "name-lang", "language of the files with the given name, as in Jenkinsfile=groovy (repeatable)")
+	redactSecrets := flag.Bool("redact", false, "replace common secrets in the embedded content, such as API tokens, with REDACTED")
+	var secretFlags patterns
+	flag.Var(&secretFlags, "redact-pattern", "redact the matches of this regular expression instead of the common secrets (repeatable)")
+	widthFlags := make(widths)
+	flag.Var(widthFlags, "max-width", "warn about embedded lines longer than N characters for a language, as in go=100 (repeatable)")
 	flag.Usage = usage
 	flag.Parse()
 
@@ -65,65 +268,1188 @@ func main() {
 		return
 	}
 
-	diff, err := embed(flag.Args(), *rewrite, *doDiff)
+	paths := flag.Args()
+	if *pathsFrom != "" {
+		listed, err := readPathList(*pathsFrom)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if len(listed) == 0 && len(paths) == 0 {
+			return // nothing to do, rather than reading the standard input.
+		}
+		paths = append(paths, listed...)
+	}
+	if len(paths) > 0 {
+		expanded, err := expandPaths(paths, *recursive)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if len(expanded) == 0 {
+			return // nothing to do, rather than reading the standard input.
+		}
+		paths = expanded
+	}
+
+	if *checkLinks {
+		failed, err := checkURLs(paths, config{timeout: *timeout, headers: headerFlags, safe: *safe})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if failed {
+			os.Exit(2)
+		}
+		return
+	}
+
+	langs, err := loadAliases(aliasFiles())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	for ext, lang := range langFlags {
+		langs[ext] = lang
+	}
+	ignore, err := loadIgnoreList(ignoreFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	cfg := config{
+		rewrite: *rewrite,
+		diff:    *doDiff,
+		format:  *format,
+		style:   *diffFormat,
+		safe:    *safe,
+		tracked: *tracked,
+		inRepo:  *inRepo,
+		exec:    *allowExec,
+		ssh:     *allowSSH,
+		indent:  *checkIndent,
+		overlap: *checkOverlap,
+		pinned:  *noRefetch && !*refresh,
+		noTrim:  !*trim,
+		wrap:    *wrap,
+		widths:  widthFlags,
+		langs:   langs,
+		names:   nameLangs,
+
+		normalize:   *normalize,
+		placeholder: *placeholder,
+		guessLang:   *guessLang,
+		caption:     *caption,
+		strict:      *strictChecks,
+		cache:       *useCache,
+		check:       *doCheck,
+		timeout:     *timeout,
+		headers:     headerFlags,
+		verify:      *verify,
+		ignore:      ignore,
+		verbose:     *verbose,
+		stdinName:   *stdinName,
+		root:        *root,
+	}
+	if *interactive {
+		cfg.confirm = &prompter{r: bufio.NewReader(stdin)}
+		cfg.noTerminal = !isTerminal(os.Stdin)
+	}
+	switch *checkForbidden {
+	case "":
+	case "warn", "error":
+		cfg.forbidden, cfg.forbiddenFatal = strings.Split(*forbidden, ","), *checkForbidden == "error"
+	default:
+		fmt.Fprintf(os.Stderr, "error: unknown severity %q for -check-forbidden\n", *checkForbidden)
+		os.Exit(2)
+	}
+	if *statsFormat != "" {
+		if *statsFormat != "text" && *statsFormat != "json" {
+			fmt.Fprintf(os.Stderr, "error: unknown stats format %q\n", *statsFormat)
+			os.Exit(2)
+		}
+		cfg.stats = new(embedmd.Stats)
+	}
+	if *bundlePath != "" {
+		cfg.bundle = new(embedmd.Bundle)
+	}
+	if *keepGoing {
+		cfg.failed = new([]string)
+	}
+	if *printSummary {
+		cfg.summary = new(summary)
+	}
+	if *jsonReport {
+		cfg.reports = &[]fileReport{}
+	}
+	if *redactSecrets || len(secretFlags) > 0 {
+		cfg.secrets = embedmd.DefaultSecrets
+		if len(secretFlags) > 0 {
+			cfg.secrets = secretFlags
+		}
+	}
+	diff, err := embed(paths, cfg)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(2)
 	}
-	if diff && *doDiff {
+	if cfg.stats != nil {
+		printStats(os.Stderr, *statsFormat, cfg.stats)
+	}
+	if cfg.failed != nil && len(*cfg.failed) > 0 {
+		for _, msg := range *cfg.failed {
+			fmt.Fprintln(os.Stderr, msg)
+		}
+		os.Exit(2)
+	}
+	if cfg.bundle != nil {
+		if err := writeBundle(*bundlePath, cfg.bundle); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	if diff && cfg.check {
+		os.Exit(1)
+	}
+	// differences are only found with -d, and -i without a terminal.
+	if diff {
 		os.Exit(2)
 	}
 }
 
+// config holds the settings that control how files are processed.
+type config struct {
+	rewrite bool   // rewrite the files in place.
+	diff    bool   // report differences rather than the output.
+	format  string // format of the differences: diff or github.
+	style   string // format of the diffs: unified, context, or side-by-side.
+	safe    bool   // lock down commands for untrusted markdown.
+	tracked bool   // only embed local files tracked by git.
+	inRepo  bool   // with tracked, files must be in a git repository.
+	exec    bool   // allow commands running other programs.
+	ssh     bool   // allow reading files on ssh remotes.
+	indent  bool   // warn about mixed tabs and spaces in indentation.
+	overlap bool   // warn about overlapping line ranges of a file.
+	pinned  bool   // keep the blocks embedded from urls.
+	noTrim  bool   // keep the whitespace at the end of embedded lines.
+	wrap    int    // if positive, wrap the embedded lines longer than this.
+	widths  widths // warn about lines longer than these, per language.
+
+	// if not nil, asks whether to rewrite each out of date block.
+	confirm *prompter
+	langs   map[string]string
+	names   map[string]string // languages of the files with these names.
+	stats   *embedmd.Stats    // if not nil, collects statistics on the commands.
+
+	// rewrite the commands in their canonical form instead of running them.
+	normalize bool
+	// if not empty, embedded in place of the content that cannot be read.
+	placeholder string
+	// guess the language of files with no extension from their content.
+	guessLang bool
+	// if not empty, the format of the captions before code blocks.
+	caption string
+	// fail the commands checking packages that do not pass.
+	strict bool
+	// if not nil, collects the embedded sources.
+	bundle *embedmd.Bundle
+	// if not empty, substrings reported in the embedded content, with an
+	// error rather than a warning if forbiddenFatal is set.
+	forbidden      []string
+	forbiddenFatal bool
+	// if not nil, the patterns of the secrets redacted from embedded content.
+	secrets []*regexp.Regexp
+	// keep the extracted content across runs.
+	cache bool
+	// only report the files that are out of date.
+	check bool
+	// if not zero, the time after which fetching a URL fails.
+	timeout time.Duration
+	// the headers sent when fetching URLs.
+	headers headers
+	// the patterns of the paths that are skipped.
+	ignore ignoreList
+	// if not nil, collects the errors of the commands, which are skipped.
+	failed *[]string
+	// if not nil, collects the reports of the files, printed as JSON instead
+	// of their output.
+	reports *[]fileReport
+	// fail unless processing the output again leaves it as it is.
+	verify bool
+	// log every command run, and what it embedded, to stderr.
+	verbose bool
+	// if not empty, the path of the file read from the standard input, which
+	// relative paths are resolved against.
+	stdinName string
+	// if not empty, the directory paths starting with // are relative to.
+	root string
+	// the directory paths starting with // are relative to outside of a
+	// repository, which is the one of the first file processed.
+	fallbackRoot string
+	// if not nil, counts the files processed for the summary printed at the
+	// end.
+	summary *summary
+	// the standard input is not a terminal, so -i reports the differences as
+	// -d does instead of asking.
+	noTerminal bool
+}
+
+// A summary counts the markdown files processed, the ones whose content
+// changed, or would change when only reporting the differences, and the
+// commands run.
+type summary struct {
+	files, changed, commands int
+}
+
+// String returns the summary as printed by -summary.
+func (s summary) String() string {
+	return fmt.Sprintf("%s processed, %d changed, %s run", plural(s.files, "file"), s.changed, plural(s.commands, "command"))
+}
+
+// add counts a processed file, with the given input and output.
+func (s *summary) add(in, out []byte) {
+	s.files++
+	if !bytes.Equal(in, out) {
+		s.changed++
+	}
+}
+
+// plural returns n followed by the noun, which is made plural unless n is 1.
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// A fileReport describes the processing of a markdown file, as printed by
+// -json.
+type fileReport struct {
+	Path     string          `json:"path"`
+	Changed  bool            `json:"changed"`
+	Commands []commandReport `json:"commands"`
+}
+
+// A commandReport describes the content embedded by a command.
+type commandReport struct {
+	Line   int    `json:"line"`
+	Source string `json:"source"`
+	Bytes  int    `json:"bytes"`
+}
+
+// reportOption returns an option adding every command run to the report.
+func reportOption(r *fileReport) embedmd.Option {
+	return embedmd.WithEmbedded(func(cmd embedmd.Command, size int) {
+		r.Commands = append(r.Commands, commandReport{cmd.Line, cmd.Path, size})
+	})
+}
+
+// printReports prints the reports of the files as a JSON array.
+func printReports(w io.Writer, reports []fileReport) error {
+	b, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// process processes the markdown in the file at path, or the standard input if
+// path is empty, reading it from in and writing the result to out, either by
+// running the commands with the given options or, if cfg.normalize is set,
+// normalizing them. With cfg.verify, nothing is written unless the result is
+// left as it is when processed again.
+func (cfg config) process(out io.Writer, in io.Reader, path string, opts ...embedmd.Option) error {
+	if !cfg.verify {
+		if cfg.normalize {
+			return embedmd.Normalize(out, in)
+		}
+		return embedmd.Process(out, in, opts...)
+	}
+	var buf bytes.Buffer
+	again := cfg
+	again.verify = false
+	if err := again.process(&buf, in, path, opts...); err != nil {
+		return err
+	}
+	if err := cfg.verifyOutput(path, buf.Bytes()); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(out)
+	return err
+}
+
+// verifyOutput processes again the output generated for the file at path, and
+// returns an error if that changes it, since then the output of embedmd would
+// not be stable: running it on its own output would not be a no-op. The
+// statistics and bundle are left alone, no questions are asked, and neither
+// warnings nor the failures skipped with -keep-going are reported again.
+func (cfg config) verifyOutput(path string, out []byte) error {
+	again := cfg
+	again.verify, again.stats, again.bundle = false, nil, nil
+	opts := again.options()
+	if cfg.failed != nil {
+		// the failed commands keep their blocks as in the first pass.
+		opts = append(opts, embedmd.WithKeepGoing(func(int, error) {}))
+	}
+	if path != "" {
+		opts = append(opts, embedmd.WithBaseDir(filepath.Dir(path)))
+	}
+	var buf bytes.Buffer
+	if err := again.process(&buf, bytes.NewReader(out), path, opts...); err != nil {
+		return fmt.Errorf("output is not stable: processing it again fails: %v", err)
+	}
+	if !bytes.Equal(out, buf.Bytes()) {
+		return fmt.Errorf("%d: output is not stable: processing it again changes this line", firstChangedLine(out, buf.Bytes()))
+	}
+	return nil
+}
+
+// firstChangedLine returns the number of the first line that differs between
+// a and b, counting from one.
+func firstChangedLine(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return bytes.Count(a[:i], []byte("\n")) + 1
+}
+
+// httpOptions returns the embedmd options used to fetch URLs.
+func (cfg config) httpOptions() []embedmd.Option {
+	var opts []embedmd.Option
+	if cfg.timeout > 0 {
+		opts = append(opts, embedmd.WithHTTPClient(&http.Client{Timeout: cfg.timeout}))
+	}
+	return append(opts, cfg.headers.options()...)
+}
+
+// options returns the embedmd options that apply to every processed file.
+func (cfg config) options() []embedmd.Option {
+	opts := cfg.httpOptions()
+	if cfg.safe {
+		opts = append(opts, embedmd.WithSafeMode("."))
+	}
+	if cfg.exec {
+		opts = append(opts, embedmd.WithExec())
+	}
+	if cfg.ssh {
+		opts = append(opts, embedmd.WithSSH())
+	}
+	if cfg.root != "" {
+		opts = append(opts, embedmd.WithRepoRoot(cfg.root))
+	}
+	if cfg.fallbackRoot != "" {
+		opts = append(opts, embedmd.WithRootFallback(cfg.fallbackRoot))
+	}
+	if cfg.noTrim {
+		opts = append(opts, embedmd.WithTrimTrailingSpace(false))
+	}
+	if cfg.wrap > 0 {
+		opts = append(opts, embedmd.WithWrap(cfg.wrap))
+	}
+	if cfg.indent {
+		opts = append(opts, embedmd.WithIndentCheck())
+	}
+	if cfg.overlap {
+		opts = append(opts, embedmd.WithOverlapCheck())
+	}
+	if cfg.secrets != nil {
+		opts = append(opts, embedmd.WithRedact(cfg.secrets))
+	}
+	if cfg.cache {
+		opts = append(opts, embedmd.WithCache(cacheDir))
+	}
+	if len(cfg.forbidden) > 0 {
+		opts = append(opts, embedmd.WithForbiddenCheck(cfg.forbiddenFatal, cfg.forbidden...))
+	}
+	if cfg.pinned {
+		opts = append(opts, embedmd.WithPinnedURLs())
+	}
+	if cfg.placeholder != "" {
+		opts = append(opts, embedmd.WithMissingPlaceholder(cfg.placeholder))
+	}
+	if cfg.guessLang {
+		opts = append(opts, embedmd.WithLangGuessing())
+	}
+	if cfg.caption != "" {
+		opts = append(opts, embedmd.WithCaption(cfg.caption))
+	}
+	if cfg.strict {
+		opts = append(opts, embedmd.WithStrictChecks())
+	}
+	if len(cfg.widths) > 0 {
+		opts = append(opts, embedmd.WithMaxWidth(cfg.widths))
+	}
+	if cfg.tracked {
+		opts = append(opts, embedmd.WithRequireTracked(cfg.inRepo))
+	}
+	for ext, lang := range cfg.langs {
+		opts = append(opts, embedmd.WithLangAlias(ext, lang))
+	}
+	for name, lang := range cfg.names {
+		opts = append(opts, embedmd.WithFileNameLang(name, lang))
+	}
+	if cfg.stats != nil {
+		opts = append(opts, embedmd.WithStats(cfg.stats))
+	}
+	if cfg.bundle != nil {
+		opts = append(opts, embedmd.WithBundle(cfg.bundle))
+	}
+	return opts
+}
+
+// writeBundle writes the collected sources to the file at path.
+func writeBundle(path string, b *embedmd.Bundle) error {
+	var buf bytes.Buffer
+	b.WriteTo(&buf)
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("could not write bundle: %v", err)
+	}
+	return nil
+}
+
+// printStats writes the statistics as text or json.
+func printStats(w io.Writer, format string, s *embedmd.Stats) {
+	if format == "json" {
+		json.NewEncoder(w).Encode(s)
+		return
+	}
+	fmt.Fprintf(w, "commands: %d (%d regexp, %d whole file, %d line range)\n", s.Commands, s.Regexp, s.WholeFile, s.LineRange)
+	fmt.Fprintf(w, "sources: %d local, %d url\n", s.Local, s.URL)
+	fmt.Fprintf(w, "embedded lines: %d\n", s.Lines)
+}
+
+// aliases maps file extensions to languages, and can be used as a flag
+// accepting values such as yml=yaml.
+type aliases map[string]string
+
+func (a aliases) String() string {
+	var s []string
+	for ext, lang := range a {
+		s = append(s, ext+"="+lang)
+	}
+	return strings.Join(s, ",")
+}
+
+func (a aliases) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 || i == len(s)-1 {
+		return fmt.Errorf("alias %q should have the form ext=lang", s)
+	}
+	a[s[:i]] = s[i+1:]
+	return nil
+}
+
+// widths maps languages to their maximum line width, and can be used as a
+// flag accepting values such as go=100.
+type widths map[string]int
+
+func (w widths) String() string {
+	var s []string
+	for lang, n := range w {
+		s = append(s, fmt.Sprintf("%s=%d", lang, n))
+	}
+	return strings.Join(s, ",")
+}
+
+func (w widths) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	n, err := strconv.Atoi(s[i+1:])
+	if i <= 0 || err != nil || n <= 0 {
+		return fmt.Errorf("width %q should have the form lang=N", s)
+	}
+	w[s[:i]] = n
+	return nil
+}
+
+// patterns is a list of regular expressions, and can be used as a repeatable
+// flag.
+type patterns []*regexp.Regexp
+
+func (p *patterns) String() string {
+	var s []string
+	for _, re := range *p {
+		s = append(s, re.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (p *patterns) Set(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return fmt.Errorf("bad pattern %q: %v", s, err)
+	}
+	*p = append(*p, re)
+	return nil
+}
+
+// headers holds the headers sent when fetching URLs, and can be used as a
+// repeatable flag accepting values such as "Authorization: token $TOKEN".
+type headers http.Header
+
+func (h headers) String() string {
+	var s []string
+	for key, values := range h {
+		for _, v := range values {
+			s = append(s, key+": "+v)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (h headers) Set(s string) error {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 || strings.TrimSpace(s[:i]) != s[:i] {
+		return fmt.Errorf("header %q should have the form Key: Value", s)
+	}
+	http.Header(h).Add(s[:i], strings.TrimSpace(s[i+1:]))
+	return nil
+}
+
+// options returns the options adding the headers to the requests.
+func (h headers) options() []embedmd.Option {
+	var opts []embedmd.Option
+	for key, values := range h {
+		for _, v := range values {
+			opts = append(opts, embedmd.WithHTTPHeader(key, v))
+		}
+	}
+	return opts
+}
+
+// cacheDir is the directory where -cache keeps the extracted content.
+var cacheDir = filepath.Join(".embedmd", "cache")
+
+// aliasFiles returns the paths of the files containing language aliases, in
+// increasing order of precedence.
+func aliasFiles() []string {
+	files := []string{filepath.Join(".embedmd", "languages.json")}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append([]string{filepath.Join(home, ".embedmd", "languages.json")}, files...)
+	}
+	return files
+}
+
+// loadAliases merges the language aliases in the given files, ignoring those
+// that do not exist.
+func loadAliases(paths []string) (aliases, error) {
+	langs := make(aliases)
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]string
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %v", path, err)
+		}
+		for ext, lang := range m {
+			langs[ext] = lang
+		}
+	}
+	return langs, nil
+}
+
+// ignoreFile holds the patterns of the markdown files that are skipped.
+const ignoreFile = ".embedmdignore"
+
+// An ignoreList holds the patterns of the paths to skip, in order.
+type ignoreList []ignorePattern
+
+type ignorePattern struct {
+	segments []string // the parts of the pattern between slashes.
+	negated  bool     // re-includes the paths matched by previous patterns.
+	dirOnly  bool     // only matches directories.
+}
+
+// loadIgnoreList reads the patterns in the file at path, which are empty if
+// it does not exist.
+func loadIgnoreList(path string) (ignoreList, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error: could not read %s: %v", path, err)
+	}
+	return parseIgnoreList(string(b)), nil
+}
+
+// parseIgnoreList parses the patterns in s, one per line, ignoring blank
+// lines and lines starting with #.
+func parseIgnoreList(s string) ignoreList {
+	var l ignoreList
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var p ignorePattern
+		if strings.HasPrefix(line, "!") {
+			p.negated, line = true, line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+		p.segments = strings.Split(line, "/")
+		if !anchored {
+			p.segments = append([]string{"**"}, p.segments...)
+		}
+		l = append(l, p)
+	}
+	return l
+}
+
+// ignored reports whether the file at path is skipped. Paths are matched once
+// cleaned and relative to the current directory, and the ones outside of it
+// are never skipped.
+//
+// Patterns are checked in order, and the last one matching the path or any of
+// its parent directories decides: a pattern starting with ! re-includes the
+// paths skipped by the previous ones, even in a skipped directory, unlike
+// git. Patterns with a slash, other than a trailing one, match paths from the
+// current directory, while the others match the name of any file or
+// directory. A trailing slash only matches directories, and a ** between
+// slashes matches any number of directories.
+func (l ignoreList) ignored(path string) bool {
+	if len(l) == 0 {
+		return false
+	}
+	if filepath.IsAbs(path) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return false
+		}
+		if path, err = filepath.Rel(wd, path); err != nil {
+			return false
+		}
+	}
+	rel := filepath.ToSlash(filepath.Clean(path))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+
+	segments := strings.Split(rel, "/")
+	ignored := false
+	for _, p := range l {
+		for n := 1; n <= len(segments); n++ {
+			if n == len(segments) && p.dirOnly {
+				break
+			}
+			if matchSegments(p.segments, segments[:n]) {
+				ignored = !p.negated
+				break
+			}
+		}
+	}
+	return ignored
+}
+
+// matchSegments reports whether the parts of a path match the ones of a
+// pattern, where ** matches any number of them.
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], segments[0])
+	return ok && matchSegments(pattern[1:], segments[1:])
+}
+
 var (
 	stdout io.Writer = os.Stdout
 	stdin  io.Reader = os.Stdin
+	stderr io.Writer = os.Stderr
 )
 
-func embed(paths []string, rewrite, doDiff bool) (foundDiff bool, err error) {
-	if rewrite && doDiff {
+func embed(paths []string, cfg config) (foundDiff bool, err error) {
+	if cfg.rewrite && cfg.diff {
 		return false, fmt.Errorf("error: cannot use -w and -d simultaneously")
 	}
+	if cfg.confirm != nil && (cfg.rewrite || cfg.diff) {
+		return false, fmt.Errorf("error: cannot use -i with -w or -d")
+	}
+	if cfg.check && (cfg.rewrite || cfg.diff || cfg.confirm != nil) {
+		return false, fmt.Errorf("error: cannot use -check with -w, -d, or -i")
+	}
+	if cfg.reports != nil && (cfg.rewrite || cfg.diff || cfg.confirm != nil || cfg.check) {
+		return false, fmt.Errorf("error: cannot use -json with -w, -d, -i, or -check")
+	}
+	if cfg.confirm != nil && cfg.noTerminal {
+		// without a terminal to ask, only report the differences.
+		cfg.confirm, cfg.diff = nil, true
+	}
+	switch cfg.format {
+	case "", "diff", "github":
+	default:
+		return false, fmt.Errorf("error: unknown format %q", cfg.format)
+	}
+	switch cfg.style {
+	case "", "unified", "context", "side-by-side":
+	default:
+		return false, fmt.Errorf("error: unknown diff format %q", cfg.style)
+	}
 
 	if len(paths) == 0 {
-		if rewrite {
+		if cfg.rewrite {
 			return false, fmt.Errorf("error: cannot use -w with standard input")
 		}
-		if !doDiff {
-			return false, embedmd.Process(stdout, stdin)
+		if cfg.confirm != nil {
+			return false, fmt.Errorf("error: cannot use -i with standard input")
+		}
+	} else if cfg.stdinName != "" {
+		return false, fmt.Errorf("error: cannot use -stdin-name with paths")
+	}
+
+	// the commands run are counted by the statistics, shared with -stats.
+	if cfg.summary != nil && cfg.stats == nil {
+		cfg.stats = new(embedmd.Stats)
+	}
+	var commands int
+	if cfg.stats != nil {
+		commands = cfg.stats.Commands
+	}
+	if cfg.summary != nil {
+		defer func() {
+			if err == nil {
+				cfg.summary.commands = cfg.stats.Commands - commands
+				fmt.Fprintln(stderr, cfg.summary)
+			}
+		}()
+	}
+
+	if len(paths) == 0 {
+		return embedStdin(cfg)
+	}
+	for _, path := range paths {
+		if !cfg.ignore.ignored(path) {
+			cfg.fallbackRoot = filepath.Dir(path)
+			break
+		}
+	}
+	for _, path := range paths {
+		if cfg.ignore.ignored(path) {
+			continue
+		}
+		d, err := processFile(path, cfg)
+		if err != nil {
+			return false, fmt.Errorf("%s:%v", path, err)
 		}
+		foundDiff = foundDiff || d
+	}
+	if cfg.reports != nil {
+		return false, printReports(stdout, *cfg.reports)
+	}
+	return foundDiff, nil
+}
 
+// embedStdin processes the markdown in the standard input as embed does with
+// the given files. If cfg.stdinName is set, the markdown is processed as if it
+// was read from the file with that name, so the paths are relative to its
+// directory, and the messages and diffs name it.
+func embedStdin(cfg config) (foundDiff bool, err error) {
+	path := cfg.stdinName
+	opts := cfg.fileOptions(path)
+	if path != "" {
+		opts = append(opts, embedmd.WithBaseDir(filepath.Dir(path)))
+	}
+	process := func(out io.Writer, in io.Reader, opts ...embedmd.Option) error {
+		if err := cfg.process(out, in, path, opts...); err != nil {
+			if path != "" {
+				return fmt.Errorf("%s:%v", path, err)
+			}
+			return err
+		}
+		return nil
+	}
+
+	if cfg.reports != nil {
+		r := fileReport{Path: path, Commands: []commandReport{}}
 		var out, in bytes.Buffer
-		if err := embedmd.Process(&out, io.TeeReader(stdin, &in)); err != nil {
+		if err := process(&out, io.TeeReader(stdin, &in), append(opts, reportOption(&r))...); err != nil {
 			return false, err
 		}
-		d, err := diff(in.String(), out.String())
-		if err != nil || len(d) == 0 {
-			return false, err
+		r.Changed = !bytes.Equal(in.Bytes(), out.Bytes())
+		if cfg.summary != nil {
+			cfg.summary.add(in.Bytes(), out.Bytes())
 		}
-		fmt.Fprintf(stdout, "%s", d)
-		return true, nil
+		return false, printReports(stdout, append(*cfg.reports, r))
+	}
+	if !cfg.diff && !cfg.check && cfg.summary == nil {
+		return false, process(stdout, stdin, opts...)
+	}
+
+	var out, in bytes.Buffer
+	var stale []int
+	if err := process(&out, io.TeeReader(stdin, &in), append(opts, staleBlocks(&stale))...); err != nil {
+		return false, err
+	}
+	if cfg.summary != nil {
+		cfg.summary.add(in.Bytes(), out.Bytes())
+	}
+	if !cfg.diff && !cfg.check {
+		_, err := out.WriteTo(stdout)
+		return false, err
+	}
+	if cfg.check {
+		return outOfDate(cfg, path, in.Bytes(), out.Bytes(), stale), nil
+	}
+	return report(cfg, path, in.String(), out.String(), stale)
+}
+
+// readPathList returns the paths listed in the file with the given name, or
+// the standard input if it is -, one per line. Blank lines and lines starting
+// with # are ignored.
+func readPathList(name string) ([]string, error) {
+	r := stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("error: could not read paths: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	var paths []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			paths = append(paths, line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("error: could not read paths: %v", err)
+	}
+	return paths, nil
+}
+
+// expandPaths returns the paths of the markdown files given by paths, where
+// glob patterns are replaced by the paths matching them and, if recursive is
+// set, directories by the markdown files in them and their subdirectories.
+// A ** in a pattern matches any number of directories.
+func expandPaths(paths []string, recursive bool) ([]string, error) {
+	var expanded []string
+	add := func(path string) error {
+		if fi, err := os.Stat(path); err != nil || !fi.IsDir() || !recursive {
+			expanded = append(expanded, path)
+			return nil
+		}
+		files, err := markdownFiles(path)
+		expanded = append(expanded, files...)
+		return err
 	}
 
 	for _, path := range paths {
-		d, err := processFile(path, rewrite, doDiff)
+		if !strings.ContainsAny(path, "*?[") {
+			if err := add(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var matches []string
+		var err error
+		if strings.Contains(path, "**") {
+			matches, err = globRecursive(path)
+		} else {
+			matches, err = filepath.Glob(path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error: bad pattern %q: %v", path, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("error: no files match %s", path)
+		}
+		for _, match := range matches {
+			if err := add(match); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// globRecursive returns the paths of the markdown files matching a pattern
+// with a **, which matches any number of directories, so docs/**/*.md matches
+// both docs/a.md and docs/guide/b.md.
+func globRecursive(pattern string) ([]string, error) {
+	i := strings.Index(pattern, "**")
+	root := filepath.Clean(pattern[:i])
+	rest := strings.TrimLeft(pattern[i+len("**"):], `/\`)
+	if rest == "" {
+		rest = "*"
+	}
+	if _, err := filepath.Match(rest, ""); err != nil {
+		return nil, err
+	}
+
+	files, err := markdownFiles(root)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, file := range files {
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return nil, err
+		}
+		// try the path after every separator, as ** can match none or more
+		// directories.
+		for {
+			if ok, _ := filepath.Match(rest, rel); ok {
+				matches = append(matches, file)
+				break
+			}
+			i := strings.IndexRune(rel, filepath.Separator)
+			if i < 0 {
+				break
+			}
+			rel = rel[i+1:]
+		}
+	}
+	return matches, nil
+}
+
+// markdownFiles returns the paths of the markdown files in dir and its
+// subdirectories, in lexical order, skipping hidden directories.
+func markdownFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case d.IsDir() && path != dir && strings.HasPrefix(d.Name(), "."):
+			return filepath.SkipDir
+		case !d.IsDir() && filepath.Ext(path) == ".md":
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error: could not list markdown files: %v", err)
+	}
+	return files, nil
+}
+
+// checkURLs prints whether each URL used in the given markdown files, or the
+// standard input if there are none, can be fetched with the timeout and
+// headers in cfg, and returns whether any of them could not.
+func checkURLs(paths []string, cfg config) (failed bool, err error) {
+	if cfg.safe {
+		return false, fmt.Errorf("error: cannot use -check-urls with -safe, which never fetches URLs")
+	}
+	opts := cfg.httpOptions()
+	check := func(path string, in io.Reader) error {
+		return embedmd.CheckURLs(in, func(line int, url string, err error) {
+			if path != "" {
+				fmt.Fprintf(stdout, "%s:", path)
+			}
+			if err != nil {
+				failed = true
+				fmt.Fprintf(stdout, "%d: %s: %v\n", line, url, err)
+			} else {
+				fmt.Fprintf(stdout, "%d: %s: ok\n", line, url)
+			}
+		}, opts...)
+	}
+
+	if len(paths) == 0 {
+		return failed, check("", stdin)
+	}
+	for _, path := range paths {
+		b, err := readFile(path)
 		if err != nil {
 			return false, fmt.Errorf("%s:%v", path, err)
 		}
-		foundDiff = foundDiff || d
+		if err := check(path, bytes.NewReader(b)); err != nil {
+			return false, fmt.Errorf("%s:%v", path, err)
+		}
 	}
-	return foundDiff, nil
+	return failed, nil
+}
+
+func staleBlocks(lines *[]int) embedmd.Option {
+	return embedmd.WithStaleBlocks(func(line int) { *lines = append(*lines, line) })
+}
+
+// fileOptions returns the options used to process the given markdown file,
+// which is the standard input if path is empty.
+func (cfg config) fileOptions(path string) []embedmd.Option {
+	opts := append(cfg.options(), warnings(path))
+	if cfg.verbose {
+		opts = append(opts, embedmd.WithLog(prefixWriter{stderr, location(path)}))
+	}
+	if cfg.failed != nil {
+		opts = append(opts, embedmd.WithKeepGoing(func(line int, err error) {
+			prefix := ""
+			if path != "" {
+				prefix = path + ":"
+			}
+			*cfg.failed = append(*cfg.failed, fmt.Sprintf("%s%d: %v", prefix, line, err))
+		}))
+	}
+	return opts
+}
+
+// location returns the prefix of the messages about the lines of the markdown
+// file at path, which is empty for the standard input.
+func location(path string) string {
+	if path == "" {
+		return ""
+	}
+	return path + ":"
+}
+
+// A prefixWriter writes a prefix to w before the content of every write, which
+// must be a whole line, as the ones logged with embedmd.WithLog.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+}
+
+func (p prefixWriter) Write(b []byte) (int, error) {
+	if _, err := io.WriteString(p.w, p.prefix); err != nil {
+		return 0, err
+	}
+	return p.w.Write(b)
+}
+
+// warnings prints the warnings about the given markdown file to stderr.
+func warnings(path string) embedmd.Option {
+	return embedmd.WithWarnings(func(line int, msg string) {
+		if path != "" {
+			fmt.Fprintf(stderr, "%s:", path)
+		}
+		fmt.Fprintf(stderr, "%d: warning: %s\n", line, msg)
+	})
+}
+
+// report writes the differences between the input and output of a file in
+// the format given in cfg, and returns whether any difference was found.
+// The given stale lines are the ones of the commands with out of date blocks.
+func report(cfg config, path, in, out string, stale []int) (bool, error) {
+	d, err := styledDiff(cfg.style, path, in, out)
+	if err != nil || len(d) == 0 {
+		return false, err
+	}
+	if cfg.format != "github" {
+		fmt.Fprintf(stdout, "%s", d)
+		return true, nil
+	}
+	annotate(path, stale)
+	return true, nil
+}
+
+// annotate prints the GitHub Actions error annotations for the given stale
+// lines of the markdown file at path, or for the whole file if there are none.
+func annotate(path string, stale []int) {
+	file := ""
+	if path != "" {
+		file = "file=" + path
+	}
+	if len(stale) == 0 {
+		fmt.Fprintf(stdout, "::error %s::file out of date\n", file)
+		return
+	}
+	if file != "" {
+		file += ","
+	}
+	for _, line := range stale {
+		fmt.Fprintf(stdout, "::error %sline=%d::embedded block out of date\n", file, line)
+	}
+}
+
+// outOfDate reports whether the output of processing the markdown in the file
+// at path differs from its content, printing the file to stderr if it does,
+// or the annotations for its stale lines with the github format.
+func outOfDate(cfg config, path string, in, out []byte, stale []int) bool {
+	if bytes.Equal(in, out) {
+		return false
+	}
+	if cfg.format == "github" {
+		annotate(path, stale)
+		return true
+	}
+	if path == "" {
+		path = "standard input"
+	}
+	fmt.Fprintf(stderr, "%s: out of date\n", path)
+	return true
 }
 
 type file interface {
 	io.ReadCloser
-	io.WriterAt
-	Truncate(int64) error
+	// Replace replaces the content of the file with b, closing it.
+	Replace(b []byte) error
 }
 
 // replaced by testing functions.
 var openFile = func(name string) (file, error) {
-	return os.OpenFile(name, os.O_RDWR, 0666)
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f}, nil
+}
+
+// osFile is a file in the file system, which is replaced atomically.
+type osFile struct{ *os.File }
+
+// Replace writes b to a temporary file in the same directory, with the same
+// mode, and renames it over the file, so the file is never left half written
+// if the process dies. The file is closed first, since open files cannot be
+// renamed over on Windows, and symbolic links are replaced by their targets.
+func (f osFile) Replace(b []byte) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	f.Close()
+	path, err := filepath.EvalSymlinks(f.Name())
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails once renamed.
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
 
 func readFile(path string) ([]byte, error) {
@@ -135,7 +1461,7 @@ func readFile(path string) ([]byte, error) {
 	return ioutil.ReadAll(f)
 }
 
-func processFile(path string, rewrite, doDiff bool) (foundDiff bool, err error) {
+func processFile(path string, cfg config) (foundDiff bool, err error) {
 	if filepath.Ext(path) != ".md" {
 		return false, fmt.Errorf("not a markdown file")
 	}
@@ -146,36 +1472,99 @@ func processFile(path string, rewrite, doDiff bool) (foundDiff bool, err error)
 	}
 	defer f.Close()
 
+	in, err := ioutil.ReadAll(f)
+	if err != nil {
+		return false, fmt.Errorf("could not read: %v", err)
+	}
+
 	buf := new(bytes.Buffer)
-	if err := embedmd.Process(buf, f, embedmd.WithBaseDir(filepath.Dir(path))); err != nil {
+	var stale []int
+	opts := append(cfg.fileOptions(path), embedmd.WithBaseDir(filepath.Dir(path)), staleBlocks(&stale))
+	if cfg.confirm != nil {
+		opts = append(opts, cfg.confirm.option(path))
+	}
+	r := fileReport{Path: path, Commands: []commandReport{}}
+	if cfg.reports != nil {
+		opts = append(opts, reportOption(&r))
+	}
+	if err := cfg.process(buf, bytes.NewReader(in), path, opts...); err != nil {
 		return false, err
 	}
+	if cfg.summary != nil {
+		cfg.summary.add(in, buf.Bytes())
+	}
 
-	if doDiff {
+	if cfg.reports != nil {
+		r.Changed = !bytes.Equal(in, buf.Bytes())
+		*cfg.reports = append(*cfg.reports, r)
+		return false, nil
+	}
+
+	if cfg.check {
+		return outOfDate(cfg, path, in, buf.Bytes(), stale), nil
+	}
+
+	if cfg.diff {
 		f, err := readFile(path)
 		if err != nil {
 			return false, fmt.Errorf("could not read %s for diff: %v", path, err)
 		}
-		data, err := diff(string(f), buf.String())
-		if err != nil || len(data) == 0 {
-			return false, err
-		}
-		fmt.Fprintf(stdout, "%s", data)
-		return true, nil
+		return report(cfg, path, string(f), buf.String(), stale)
 	}
 
-	if rewrite {
-		n, err := f.WriteAt(buf.Bytes(), 0)
-		if err != nil {
+	if cfg.rewrite || cfg.confirm != nil {
+		if bytes.Equal(in, buf.Bytes()) {
+			return false, nil // leave the file and its modification time alone.
+		}
+		if err := f.Replace(buf.Bytes()); err != nil {
 			return false, fmt.Errorf("could not write: %v", err)
 		}
-		return false, f.Truncate(int64(n))
+		return false, nil
 	}
 
 	io.Copy(stdout, buf)
 	return false, nil
 }
 
+// A prompter asks whether to rewrite each out of date block.
+type prompter struct {
+	r   *bufio.Reader
+	all bool // all the following blocks are rewritten without asking.
+}
+
+// option returns an option asking about the blocks in the given file.
+func (p *prompter) option(path string) embedmd.Option {
+	return embedmd.WithConfirmation(func(line int, old, new string) bool {
+		if p.all {
+			return true
+		}
+		d, err := diff(old, new)
+		if err != nil {
+			return false
+		}
+		fmt.Fprintf(stdout, "%s:%d:\n%s", path, line, d)
+		for {
+			fmt.Fprint(stdout, "rewrite this block? [y,n,a] ")
+			answer, err := p.r.ReadString('\n')
+			switch strings.TrimSpace(answer) {
+			case "y":
+				return true
+			case "a":
+				p.all = true
+				return true
+			case "n":
+				return false
+			}
+			if err != nil {
+				fmt.Fprintln(stdout)
+				return false
+			}
+		}
+	})
+}
+
+// diff returns the unified diff between a and b, without the names of files,
+// as used for the blocks of a single command.
 func diff(a, b string) (string, error) {
 	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
 		A:       difflib.SplitLines(a),
@@ -183,3 +1572,91 @@ func diff(a, b string) (string, error) {
 		Context: 3,
 	})
 }
+
+// styledDiff returns the differences between a and b, the old and new content
+// of the file at path, in the given style: unified, the default, context, or
+// side-by-side. The unified and context diffs name the files a/path and
+// b/path, as git does, so they can be applied with patch -p1.
+func styledDiff(style, path, a, b string) (string, error) {
+	from, to := diffLabels(path)
+	switch style {
+	case "context":
+		return difflib.GetContextDiffString(difflib.ContextDiff{
+			A:        difflib.SplitLines(a),
+			B:        difflib.SplitLines(b),
+			FromFile: from,
+			ToFile:   to,
+			Context:  3,
+		})
+	case "side-by-side":
+		return sideBySide(a, b), nil
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(a),
+		B:        difflib.SplitLines(b),
+		FromFile: from,
+		ToFile:   to,
+		Context:  3,
+	})
+}
+
+// diffLabels returns the names of the old and new versions of the file at
+// path in a diff, or - for the standard input if path is empty, as names with
+// spaces cannot be parsed by patch or git apply.
+func diffLabels(path string) (from, to string) {
+	if path == "" {
+		return "-", "-"
+	}
+	path = strings.TrimPrefix(filepath.ToSlash(path), "./")
+	return "a/" + path, "b/" + path
+}
+
+// sideBySide returns the lines that differ between a and b, with the lines
+// around them, in two columns separated by a marker as the one used by sdiff:
+// | for changed lines, < for removed lines, > for added lines, and a space for
+// the lines that did not change. Each group of changes starts with the lines
+// where it starts in a and b, as in @@ -1 +1 @@.
+func sideBySide(a, b string) string {
+	if a == b {
+		return ""
+	}
+	al, bl := strings.Split(a, "\n"), strings.Split(b, "\n")
+	// drop the empty line after the last newline, unless only one of them
+	// ends with a newline.
+	if al[len(al)-1] == "" && bl[len(bl)-1] == "" {
+		al, bl = al[:len(al)-1], bl[:len(bl)-1]
+	}
+	width := 0
+	for _, l := range al {
+		if len(l) > width {
+			width = len(l)
+		}
+	}
+
+	var buf bytes.Buffer
+	row := func(left string, marker byte, right string) {
+		line := fmt.Sprintf("%-*s %c %s", width, left, marker, right)
+		fmt.Fprintln(&buf, strings.TrimRight(line, " "))
+	}
+	m := difflib.NewMatcher(al, bl)
+	for _, group := range m.GetGroupedOpCodes(3) {
+		fmt.Fprintf(&buf, "@@ -%d +%d @@\n", group[0].I1+1, group[0].J1+1)
+		for _, op := range group {
+			i, j := op.I1, op.J1
+			for ; i < op.I2 && j < op.J2; i, j = i+1, j+1 {
+				marker := byte('|')
+				if op.Tag == 'e' {
+					marker = ' '
+				}
+				row(al[i], marker, bl[j])
+			}
+			for ; i < op.I2; i++ {
+				row(al[i], '<', "")
+			}
+			for ; j < op.J2; j++ {
+				row("", '>', bl[j])
+			}
+		}
+	}
+	return buf.String()
+}
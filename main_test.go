@@ -14,12 +14,21 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/campoy/embedmd/embedmd"
 )
 
 func TestEmbedStreams(t *testing.T) {
@@ -28,6 +37,12 @@ func TestEmbedStreams(t *testing.T) {
 		in, out   string
 		err       string
 		d, w      bool
+		format    string
+		style     string
+		safe      bool
+		normalize bool
+		stdinName string
+		root      string
 		foundDiff bool
 	}{
 		{name: "just some text",
@@ -50,13 +65,109 @@ func TestEmbedStreams(t *testing.T) {
 		{name: "non empty diff",
 			d:  true,
 			in: "# hello\ntest",
-			out: `@@ -1,2 +1,3 @@
+			out: `--- -
++++ -
+@@ -1,2 +1,3 @@
  # hello
  test
 +
 `,
 			foundDiff: true,
 		},
+		{name: "unknown format",
+			d: true, format: "xml",
+			err: "error: unknown format \"xml\"",
+		},
+		{name: "context diff",
+			d: true, style: "context",
+			in:        "# hello\ntest",
+			out:       "*** -\n--- -\n***************\n*** 1,2 ****\n--- 1,3 ----\n  # hello\n  test\n+ \n",
+			foundDiff: true,
+		},
+		{name: "side by side diff",
+			d: true, style: "side-by-side",
+			in: "# hello\n[embedmd]:# (sample/hello.go /package main/)\n```go\nold\n```\n",
+			out: "@@ -1 +1 @@\n" +
+				"# hello                                        # hello\n" +
+				"[embedmd]:# (sample/hello.go /package main/)   [embedmd]:# (sample/hello.go /package main/)\n" +
+				"```go                                          ```go\n" +
+				"old                                          | package main\n" +
+				"```                                            ```\n",
+			foundDiff: true,
+		},
+		{name: "empty side by side diff",
+			d: true, style: "side-by-side",
+			in:        "# hello\n",
+			foundDiff: false,
+		},
+		{name: "normalizing commands",
+			normalize: true,
+			in:        "[embedmd]:# (sample/hello.go  go   /package main/)\n```go\nold\n```\n",
+			out:       "[embedmd]:# (sample/hello.go /package main/)\n```go\nold\n```\n",
+		},
+		{name: "diff of normalized commands",
+			normalize: true, d: true,
+			in:        "[embedmd]:# (sample/hello.go  go)\n",
+			out:       "--- -\n+++ -\n@@ -1,2 +1,2 @@\n-[embedmd]:# (sample/hello.go  go)\n+[embedmd]:# (sample/hello.go)\n \n",
+			foundDiff: true,
+		},
+		{name: "unknown diff format",
+			d: true, style: "sdiff",
+			err: "error: unknown diff format \"sdiff\"",
+		},
+		{name: "github annotation for the whole input",
+			d: true, format: "github",
+			in:        "# hello\ntest",
+			out:       "::error ::file out of date\n",
+			foundDiff: true,
+		},
+		{name: "github annotation for a block",
+			d: true, format: "github",
+			in:        "# hello\n[embedmd]:# (sample/hello.go /package main/)\n```go\nold\n```\n",
+			out:       "::error line=2::embedded block out of date\n",
+			foundDiff: true,
+		},
+		{name: "safe mode allows local files",
+			safe: true,
+			in:   "[embedmd]:# (sample/hello.go /package main/)\n",
+			out:  "[embedmd]:# (sample/hello.go /package main/)\n```go\npackage main\n```\n",
+		},
+		{name: "safe mode forbids urls",
+			safe: true,
+			in:   "[embedmd]:# (https://golang.org/sample.go)\n",
+			err:  "1: could not read https://golang.org/sample.go: fetching urls is not allowed in safe mode",
+		},
+		{name: "safe mode forbids files outside of the current directory",
+			safe: true,
+			in:   "[embedmd]:# (../hello.go)\n",
+			err:  "1: could not read ../hello.go: ../hello.go is outside of .",
+		},
+		{name: "paths relative to the stdin name",
+			stdinName: "sample/docs.md",
+			in:        "[embedmd]:# (hello.go /func main/ /^}/)\n",
+			out:       "[embedmd]:# (hello.go /func main/ /^}/)\n```go\nfunc main() {\n\tfmt.Println(\"Hello, there, it is\", time.Now())\n}\n```\n",
+		},
+		{name: "diff named after the stdin name",
+			d: true, stdinName: "sample/docs.md",
+			in:        "[embedmd]:# (hello.go /func main/ /{/)\n",
+			out:       "--- a/sample/docs.md\n+++ b/sample/docs.md\n@@ -1,2 +1,5 @@\n [embedmd]:# (hello.go /func main/ /{/)\n+```go\n+func main() {\n+```\n \n",
+			foundDiff: true,
+		},
+		{name: "paths relative to the root",
+			root: "sample",
+			in:   "[embedmd]:# (//hello.go /func main/ /{/)\n",
+			out:  "[embedmd]:# (//hello.go /func main/ /{/)\n```go\nfunc main() {\n```\n",
+		},
+		{name: "paths relative to the root and to the markdown",
+			root: ".", stdinName: "sample/docs.md",
+			in:  "[embedmd]:# (//sample/hello.go /func main/ /{/)\n[embedmd]:# (hello.go /func main/ /{/)\n",
+			out: "[embedmd]:# (//sample/hello.go /func main/ /{/)\n```go\nfunc main() {\n```\n[embedmd]:# (hello.go /func main/ /{/)\n```go\nfunc main() {\n```\n",
+		},
+		{name: "errors named after the stdin name",
+			stdinName: "sample/docs.md",
+			in:        "[embedmd]:# (missing.go)\n",
+			err:       "sample/docs.md:1: could not read missing.go: open sample/missing.go: no such file or directory",
+		},
 	}
 
 	defer func(r io.Reader, w io.Writer) { stdin, stdout = r, w }(stdin, stdout)
@@ -65,7 +176,7 @@ func TestEmbedStreams(t *testing.T) {
 		stdin = strings.NewReader(tt.in)
 		buf := &bytes.Buffer{}
 		stdout = buf
-		foundDiff, err := embed(nil, tt.w, tt.d)
+		foundDiff, err := embed(nil, config{rewrite: tt.w, diff: tt.d, format: tt.format, style: tt.style, safe: tt.safe, normalize: tt.normalize, stdinName: tt.stdinName, root: tt.root})
 		if !eqErr(t, tt.name, err, tt.err) {
 			continue
 		}
@@ -80,25 +191,40 @@ func TestEmbedStreams(t *testing.T) {
 			}
 		}
 	}
+
+	_, err := embed([]string{"docs.md"}, config{stdinName: "sample/docs.md"})
+	eqErr(t, "stdin name with paths", err, "error: cannot use -stdin-name with paths")
 }
 
 func TestEmbedFiles(t *testing.T) {
 	tc := []struct {
-		name string
-		in   string
-		out  string
-		err  string
-		d, w bool
+		name   string
+		in     string
+		out    string
+		err    string
+		d, w   bool
+		format string
 	}{
 		{name: "rewriting a single file",
 			in:  "one\ntwo\nthree",
 			w:   true,
 			out: "one\ntwo\nthree\n",
 		},
+		{name: "rewriting an up to date file",
+			in:  "one\ntwo\nthree\n",
+			w:   true,
+			out: "",
+		},
 		{name: "diffing a single file",
 			in:  "one\ntwo\nthree",
 			d:   true,
-			out: "@@ -1 +1,4 @@\n+one\n+two\n+three\n \n",
+			out: "--- a/docs.md\n+++ b/docs.md\n@@ -1 +1,4 @@\n+one\n+two\n+three\n \n",
+		},
+		{name: "github annotations for a single file",
+			in: "[embedmd]:# (sample/hello.go /package main/)\n```go\npackage main\n```\n" +
+				"[embedmd]:# (sample/hello.go /func main/)\n```go\nold\n```\n",
+			d: true, format: "github",
+			out: "::error file=docs.md,line=5::embedded block out of date\n",
 		},
 	}
 
@@ -112,7 +238,7 @@ func TestEmbedFiles(t *testing.T) {
 			stdout = &f.buf
 		}
 
-		_, err := embed([]string{"docs.md"}, tt.w, tt.d)
+		_, err := embed([]string{"docs.md"}, config{rewrite: tt.w, diff: tt.d, format: tt.format})
 		if !eqErr(t, tt.name, err, tt.err) {
 			continue
 		}
@@ -123,6 +249,839 @@ func TestEmbedFiles(t *testing.T) {
 	}
 }
 
+func TestRootOutsideRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			t.Skipf("the temporary directory is in the repository %s", d)
+		}
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	code := filepath.Join(dir, "docs", "pkg", "code.go")
+	if err := os.MkdirAll(filepath.Dir(code), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(code, []byte("package pkg\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(f func(string) (file, error)) { openFile = f }(openFile)
+	defer func(w io.Writer) { stdout = w }(stdout)
+	a, b := filepath.Join(dir, "docs", "a.md"), filepath.Join(dir, "docs", "sub", "b.md")
+	openFile = newOpenFunc(map[string]string{a: "[embedmd]:# (//pkg/code.go)\n", b: "[embedmd]:# (//pkg/code.go)\n"})
+	var out bytes.Buffer
+	stdout = &out
+
+	// both are relative to the directory of the first file.
+	if _, err := embed([]string{a, b}, config{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	block := "[embedmd]:# (//pkg/code.go)\n```go\npackage pkg\n```\n"
+	if got := out.String(); got != block+block {
+		t.Errorf("expected output %q; got %q", block+block, got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	defer func(f func(string) (file, error)) { openFile = f }(openFile)
+	defer func(o, e io.Writer) { stdout, stderr = o, e }(stdout, stderr)
+	openFile = newOpenFunc(map[string]string{
+		"new.md":   "one\n",
+		"old.md":   "[embedmd]:# (sample/hello.go /func main/)\n```go\nold\n```\n",
+		"other.md": "[embedmd]:# (sample/hello.go /func main/)\n```go\nfunc main\n```\n",
+	})
+
+	tc := []struct {
+		name  string
+		paths []string
+		diff  bool
+		out   string
+	}{
+		{name: "up to date files",
+			paths: []string{"new.md", "other.md"}},
+		{name: "some files out of date",
+			paths: []string{"old.md", "new.md", "old.md"},
+			diff:  true,
+			out:   "old.md: out of date\nold.md: out of date\n"},
+	}
+	for _, tt := range tc {
+		var out, errs bytes.Buffer
+		stdout, stderr = &out, &errs
+		diff, err := embed(tt.paths, config{check: true})
+		if err != nil {
+			t.Errorf("case [%s]: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if diff != tt.diff {
+			t.Errorf("case [%s]: expected out of date %v; got %v", tt.name, tt.diff, diff)
+		}
+		if got := errs.String(); got != tt.out {
+			t.Errorf("case [%s]: expected report %q; got %q", tt.name, tt.out, got)
+		}
+		if out.Len() > 0 {
+			t.Errorf("case [%s]: expected no output; got %q", tt.name, out.String())
+		}
+	}
+
+	var out, errs bytes.Buffer
+	stdout, stderr = &out, &errs
+	diff, err := embed([]string{"old.md", "new.md"}, config{check: true, format: "github"})
+	if err != nil || !diff {
+		t.Errorf("case [github annotations]: expected out of date files; got %v, %v", diff, err)
+	}
+	if want := "::error file=old.md,line=1::embedded block out of date\n"; out.String() != want {
+		t.Errorf("case [github annotations]: expected annotations %q; got %q", want, out.String())
+	}
+	if errs.Len() > 0 {
+		t.Errorf("case [github annotations]: expected no report; got %q", errs.String())
+	}
+
+	_, err = embed([]string{"old.md"}, config{check: true, diff: true})
+	eqErr(t, "check and diff", err, "error: cannot use -check with -w, -d, or -i")
+}
+
+func TestJSONReport(t *testing.T) {
+	defer func(f func(string) (file, error)) { openFile = f }(openFile)
+	defer func(w io.Writer) { stdout = w }(stdout)
+	openFile = newOpenFunc(map[string]string{
+		"new.md": "one\n",
+		"old.md": "[embedmd]:# (sample/hello.go /func main/)\n```go\nold\n```\n",
+	})
+
+	var out bytes.Buffer
+	stdout = &out
+	if _, err := embed([]string{"old.md", "new.md"}, config{reports: &[]fileReport{}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `[
+  {
+    "path": "old.md",
+    "changed": true,
+    "commands": [
+      {
+        "line": 1,
+        "source": "sample/hello.go",
+        "bytes": 10
+      }
+    ]
+  },
+  {
+    "path": "new.md",
+    "changed": false,
+    "commands": []
+  }
+]
+`
+	if got := out.String(); got != want {
+		t.Errorf("expected report\n%s; got\n%s", want, got)
+	}
+
+	_, err := embed([]string{"old.md"}, config{reports: &[]fileReport{}, rewrite: true})
+	eqErr(t, "json and rewrite", err, "error: cannot use -json with -w, -d, -i, or -check")
+}
+
+func TestVerbose(t *testing.T) {
+	defer func(f func(string) (file, error)) { openFile = f }(openFile)
+	defer func(o, e io.Writer) { stdout, stderr = o, e }(stdout, stderr)
+	openFile = newOpenFunc(map[string]string{
+		"docs.md": "# hello\n[embedmd]:# (sample/hello.go /func main/ /^}/)\n",
+	})
+
+	var errs bytes.Buffer
+	stdout, stderr = ioutil.Discard, &errs
+	if _, err := embed([]string{"docs.md"}, config{verbose: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "docs.md:2: sample/hello.go (sample/hello.go): 3 lines, 64 bytes\n"
+	if got := errs.String(); got != want {
+		t.Errorf("expected log %q; got %q", want, got)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	defer func(f func(string) (file, error)) { openFile = f }(openFile)
+	defer func(o, e io.Writer) { stdout, stderr = o, e }(stdout, stderr)
+	defer func(r io.Reader) { stdin = r }(stdin)
+	docs := map[string]string{
+		"new.md":   "one\n",
+		"old.md":   "[embedmd]:# (sample/hello.go /func main/)\n```go\nold\n```\n",
+		"other.md": "[embedmd]:# (sample/hello.go /func main/)\n```go\nfunc main\n```\n[embedmd]:# (sample/hello.go /package/)\n",
+	}
+
+	tc := []struct {
+		name    string
+		paths   []string
+		stdin   string
+		cfg     config
+		out     string
+		printed string
+	}{
+		{name: "printing",
+			paths: []string{"old.md", "new.md", "other.md"},
+			out:   "3 files processed, 2 changed, 3 commands run\n"},
+		{name: "reporting differences",
+			paths: []string{"old.md", "new.md", "other.md"},
+			cfg:   config{diff: true},
+			out:   "3 files processed, 2 changed, 3 commands run\n"},
+		{name: "checking",
+			paths: []string{"new.md"},
+			cfg:   config{check: true},
+			out:   "1 file processed, 0 changed, 0 commands run\n"},
+		{name: "normalizing",
+			paths: []string{"old.md"},
+			cfg:   config{normalize: true},
+			out:   "1 file processed, 0 changed, 0 commands run\n"},
+		{name: "standard input",
+			stdin:   docs["old.md"],
+			out:     "1 file processed, 1 changed, 1 command run\n",
+			printed: "[embedmd]:# (sample/hello.go /func main/)\n```go\nfunc main\n```\n"},
+		{name: "checking standard input",
+			stdin: docs["new.md"],
+			cfg:   config{check: true},
+			out:   "1 file processed, 0 changed, 0 commands run\n"},
+	}
+	for _, tt := range tc {
+		openFile = newOpenFunc(docs)
+		stdin = strings.NewReader(tt.stdin)
+		var out, errs bytes.Buffer
+		stdout, stderr = &out, &errs
+		tt.cfg.summary = new(summary)
+		if _, err := embed(tt.paths, tt.cfg); err != nil {
+			t.Errorf("case [%s]: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if got := errs.String(); got != tt.out {
+			t.Errorf("case [%s]: expected summary %q; got %q", tt.name, tt.out, got)
+		}
+		if strings.Contains(out.String(), "processed") {
+			t.Errorf("case [%s]: expected no summary in the output; got %q", tt.name, out.String())
+		}
+		if tt.printed != "" && out.String() != tt.printed {
+			t.Errorf("case [%s]: expected output %q; got %q", tt.name, tt.printed, out.String())
+		}
+	}
+}
+
+func TestReplaceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "docs.md")
+	if err := ioutil.WriteFile(path, []byte("a much longer old content\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	replace := func(path, content string) {
+		f, err := openFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := f.Replace([]byte(content)); err != nil {
+			t.Fatalf("could not replace %s: %v", path, err)
+		}
+		if b, err := ioutil.ReadFile(path); err != nil || string(b) != content {
+			t.Errorf("expected content %q; got %q (%v)", content, b, err)
+		}
+	}
+
+	replace(path, "new\n")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0640 {
+		t.Errorf("expected mode %v; got %v", os.FileMode(0640), info.Mode().Perm())
+	}
+	if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 1 {
+		t.Errorf("expected no temporary files to be left; got %d files (%v)", len(files), err)
+	}
+
+	link := filepath.Join(dir, "link.md")
+	if err := os.Symlink("docs.md", link); err != nil {
+		t.Skipf("could not create a symbolic link: %v", err)
+	}
+	replace(link, "newer\n")
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected %s to be kept as a symbolic link (%v)", link, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"inline.md": "Use `embedmd -w`.\n",
+		"fenced.md": "# Usage\n\n```sh\nembedmd -w docs.md\n```\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(f func(string) (file, error)) { openFile = f }(openFile)
+	defer func(w io.Writer) { stdout = w }(stdout)
+
+	tc := []struct {
+		name string
+		in   string
+		out  string
+		err  string
+	}{
+		{name: "stable output",
+			in:  "[embedmd]:# (inline.md)\n",
+			out: "[embedmd]:# (inline.md)\n```md\nUse `embedmd -w`.\n```\n"},
+		{name: "embedded code block",
+			in:  "[embedmd]:# (fenced.md)\n",
+			out: "[embedmd]:# (fenced.md)\n````md\n# Usage\n\n```sh\nembedmd -w docs.md\n```\n````\n"},
+	}
+	for _, tt := range tc {
+		path := filepath.Join(dir, "docs.md")
+		openFile = newOpenFunc(map[string]string{path: tt.in})
+		var out bytes.Buffer
+		stdout = &out
+		_, err := embed([]string{path}, config{verify: true})
+		if err != nil {
+			err = fmt.Errorf("%s", strings.TrimPrefix(err.Error(), dir+string(filepath.Separator)))
+		}
+		if !eqErr(t, tt.name, err, tt.err) {
+			continue
+		}
+		if got := out.String(); got != tt.out {
+			t.Errorf("case [%s]: expected output %q; got %q", tt.name, tt.out, got)
+		}
+	}
+
+	err = config{}.verifyOutput("", []byte("[embedmd]:# (sample/hello.go /func main/)\n```go\nold\n```\n"))
+	eqErr(t, "changed output", err, "3: output is not stable: processing it again changes this line")
+}
+
+func TestKeepGoing(t *testing.T) {
+	defer func(f func(string) (file, error)) { openFile = f }(openFile)
+	f := newFakeFile("[embedmd]:# (sample/hello.go /func main/)\n```go\nold\n```\n" +
+		"[embedmd]:# (sample/hello.go /func missing/)\n```go\nkept\n```\n")
+	openFile = func(path string) (file, error) { return f, nil }
+
+	cfg := config{rewrite: true, failed: new([]string)}
+	if _, err := embed([]string{"docs.md"}, cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "[embedmd]:# (sample/hello.go /func main/)\n```go\nfunc main\n```\n" +
+		"[embedmd]:# (sample/hello.go /func missing/)\n```go\nkept\n```\n"
+	if got := f.buf.String(); got != want {
+		t.Errorf("expected output \n%q; got\n%q", want, got)
+	}
+	wantErrs := `[docs.md:5: could not extract content from sample/hello.go: could not match "/func missing/"]`
+	if got := fmt.Sprint(*cfg.failed); got != wantErrs {
+		t.Errorf("expected errors %s; got %s", wantErrs, got)
+	}
+
+	// the output is verified skipping the same commands, reported only once.
+	f = newFakeFile("[embedmd]:# (sample/hello.go /func main/)\n```go\nold\n```\n" +
+		"[embedmd]:# (sample/hello.go /func missing/)\n```go\nkept\n```\n")
+	cfg = config{rewrite: true, verify: true, failed: new([]string)}
+	if _, err := embed([]string{"docs.md"}, cfg); err != nil {
+		t.Fatalf("unexpected error verifying: %v", err)
+	}
+	if got := f.buf.String(); got != want {
+		t.Errorf("expected verified output \n%q; got\n%q", want, got)
+	}
+	if got := fmt.Sprint(*cfg.failed); got != wantErrs {
+		t.Errorf("expected errors verifying %s; got %s", wantErrs, got)
+	}
+}
+
+func TestInteractive(t *testing.T) {
+	in := "[embedmd]:# (sample/hello.go /package main/)\n```go\nold\n```\n" +
+		"[embedmd]:# (sample/hello.go /func main/)\n```go\nold\n```\n"
+	tc := []struct {
+		name    string
+		answers string
+		out     string
+	}{
+		{name: "some changes rejected",
+			answers: "n\ny\n",
+			out: "[embedmd]:# (sample/hello.go /package main/)\n```go\nold\n```\n" +
+				"[embedmd]:# (sample/hello.go /func main/)\n```go\nfunc main\n```\n"},
+		{name: "unknown answers are asked again",
+			answers: "maybe\ny\nn\n",
+			out: "[embedmd]:# (sample/hello.go /package main/)\n```go\npackage main\n```\n" +
+				"[embedmd]:# (sample/hello.go /func main/)\n```go\nold\n```\n"},
+		{name: "all changes accepted",
+			answers: "a\n",
+			out: "[embedmd]:# (sample/hello.go /package main/)\n```go\npackage main\n```\n" +
+				"[embedmd]:# (sample/hello.go /func main/)\n```go\nfunc main\n```\n"},
+		{name: "no answers leave the file untouched",
+			answers: "",
+			out:     ""},
+	}
+
+	defer func(f func(string) (file, error)) { openFile = f }(openFile)
+	defer func(w io.Writer) { stdout = w }(stdout)
+
+	for _, tt := range tc {
+		f := newFakeFile(in)
+		openFile = func(path string) (file, error) { return f, nil }
+		var prompts bytes.Buffer
+		stdout = &prompts
+
+		cfg := config{confirm: &prompter{r: bufio.NewReader(strings.NewReader(tt.answers))}}
+		if _, err := embed([]string{"docs.md"}, cfg); err != nil {
+			t.Errorf("case [%s]: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if got := f.buf.String(); tt.out != got {
+			t.Errorf("case [%s]: expected output \n%q; got\n%q", tt.name, tt.out, got)
+		}
+		if !strings.HasPrefix(prompts.String(), "docs.md:1:\n@@ ") {
+			t.Errorf("case [%s]: expected the first prompt for docs.md:1; got %q", tt.name, prompts.String())
+		}
+	}
+
+	_, err := embed([]string{"docs.md"}, config{confirm: &prompter{}, rewrite: true})
+	eqErr(t, "interactive and rewrite", err, "error: cannot use -i with -w or -d")
+	_, err = embed(nil, config{confirm: &prompter{}})
+	eqErr(t, "interactive with standard input", err, "error: cannot use -i with standard input")
+
+	// without a terminal, the differences are reported as with -d.
+	f := newFakeFile(in)
+	openFile = func(path string) (file, error) { return f, nil }
+	var out bytes.Buffer
+	stdout = &out
+	diff, err := embed([]string{"docs.md"}, config{confirm: &prompter{}, noTerminal: true})
+	if err != nil || !diff {
+		t.Errorf("case [interactive without a terminal]: expected differences; got %v, %v", diff, err)
+	}
+	if !strings.HasPrefix(out.String(), "--- a/docs.md\n") {
+		t.Errorf("case [interactive without a terminal]: expected a diff; got %q", out.String())
+	}
+	if f.buf.Len() > 0 {
+		t.Errorf("case [interactive without a terminal]: expected the file untouched; got %q", f.buf.String())
+	}
+	_, err = embed([]string{"docs.md"}, config{confirm: &prompter{}, noTerminal: true, rewrite: true})
+	eqErr(t, "interactive and rewrite without a terminal", err, "error: cannot use -i with -w or -d")
+}
+
+func TestIsTerminal(t *testing.T) {
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	if isTerminal(null) {
+		t.Errorf("expected %s not to be a terminal", os.DevNull)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if isTerminal(r) {
+		t.Errorf("expected a pipe not to be a terminal")
+	}
+}
+
+func TestCheckURLs(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok.go" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	defer func(w io.Writer) { stdout = w }(stdout)
+	defer func(r io.Reader) { stdin = r }(stdin)
+
+	in := "[embedmd]:# (" + s.URL + "/ok.go)\n```go\nold\n```\n" +
+		"[embedmd]:# (sample/hello.go)\n" +
+		"[embedmd]:# (" + s.URL + "/missing.go /func/)\n"
+	var out bytes.Buffer
+	stdout, stdin = &out, strings.NewReader(in)
+
+	failed, err := checkURLs(nil, config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !failed {
+		t.Errorf("expected the missing URL to fail")
+	}
+	want := "1: " + s.URL + "/ok.go: ok\n" +
+		"6: " + s.URL + "/missing.go: status 404 Not Found\n"
+	if got := out.String(); got != want {
+		t.Errorf("expected output \n%q; got\n%q", want, got)
+	}
+
+	_, err = checkURLs(nil, config{safe: true})
+	eqErr(t, "check in safe mode", err, "error: cannot use -check-urls with -safe, which never fetches URLs")
+
+	// a server that never responds fails once the timeout is over.
+	done := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-done }))
+	defer hung.Close()
+	defer close(done)
+	out.Reset()
+	stdin = strings.NewReader("[embedmd]:# (" + hung.URL + "/code.go)\n")
+	start := time.Now()
+	failed, err = checkURLs(nil, config{timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !failed || !strings.Contains(out.String(), "Client.Timeout exceeded") {
+		t.Errorf("expected the URL to time out; got %q", out.String())
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("expected to give up after the timeout; took %v", d)
+	}
+}
+
+func TestLoadAliases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"home.json": `{"yml": "yaml", "mmd": "mermaid"}`,
+		"repo.json": `{"yml": "yaml2", "h": "c"}`,
+		"bad.json":  `{"yml": `,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tc := []struct {
+		name  string
+		files []string
+		langs string
+		err   string
+	}{
+		{name: "no files",
+			files: []string{"missing.json"},
+			langs: "map[]"},
+		{name: "a single file",
+			files: []string{"home.json"},
+			langs: "map[mmd:mermaid yml:yaml]"},
+		{name: "later files take precedence",
+			files: []string{"home.json", "missing.json", "repo.json"},
+			langs: "map[h:c mmd:mermaid yml:yaml2]"},
+		{name: "invalid file",
+			files: []string{"bad.json"},
+			err:   "could not parse " + filepath.Join(dir, "bad.json") + ": unexpected end of JSON input"},
+	}
+
+	for _, tt := range tc {
+		var paths []string
+		for _, f := range tt.files {
+			paths = append(paths, filepath.Join(dir, f))
+		}
+		langs, err := loadAliases(paths)
+		if !eqErr(t, tt.name, err, tt.err) {
+			continue
+		}
+		if got := fmt.Sprint(map[string]string(langs)); got != tt.langs {
+			t.Errorf("case [%s]: expected aliases %s; got %s", tt.name, tt.langs, got)
+		}
+	}
+}
+
+func TestReadPathList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	list := filepath.Join(dir, "list.txt")
+	if err := ioutil.WriteFile(list, []byte("# docs\nREADME.md\n\n  docs/a.md  \n#docs/b.md\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer func(r io.Reader) { stdin = r }(stdin)
+
+	tc := []struct {
+		name  string
+		file  string
+		stdin string
+		paths string
+		err   string
+	}{
+		{name: "from a file",
+			file:  list,
+			paths: "[README.md docs/a.md]"},
+		{name: "from stdin",
+			file:  "-",
+			stdin: "a.md\r\nb.md",
+			paths: "[a.md b.md]"},
+		{name: "empty list",
+			file:  "-",
+			stdin: "# nothing\n\n",
+			paths: "[]"},
+		{name: "missing file",
+			file: filepath.Join(dir, "missing.txt"),
+			err:  "error: could not read paths: open " + filepath.Join(dir, "missing.txt") + ": no such file or directory"},
+	}
+
+	for _, tt := range tc {
+		stdin = strings.NewReader(tt.stdin)
+		paths, err := readPathList(tt.file)
+		if !eqErr(t, tt.name, err, tt.err) {
+			continue
+		}
+		if got := fmt.Sprint(paths); got != tt.paths {
+			t.Errorf("case [%s]: expected paths %s; got %s", tt.name, tt.paths, got)
+		}
+	}
+}
+
+func TestExpandPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.md", "b.txt", "docs/c.md", "docs/guide/d.md", "docs/guide/e.go", "docs/.git/f.md"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tc := []struct {
+		name      string
+		paths     []string
+		recursive bool
+		out       []string
+		err       string
+	}{
+		{name: "plain paths",
+			paths: []string{"a.md", "missing.md", "docs"},
+			out:   []string{"a.md", "missing.md", "docs"}},
+		{name: "glob",
+			paths: []string{"*.md", "docs/*.md", "docs/g*"},
+			out:   []string{"a.md", "docs/c.md", "docs/guide"}},
+		{name: "recursive glob",
+			paths: []string{"docs/**/*.md"},
+			out:   []string{"docs/c.md", "docs/guide/d.md"}},
+		{name: "recursive glob from the current directory",
+			paths: []string{"**"},
+			out:   []string{"a.md", "docs/c.md", "docs/guide/d.md"}},
+		{name: "directories without recursion",
+			paths: []string{"docs", "a.md"},
+			out:   []string{"docs", "a.md"}},
+		{name: "directories with recursion",
+			paths:     []string{"docs", "a.md"},
+			recursive: true,
+			out:       []string{"docs/c.md", "docs/guide/d.md", "a.md"}},
+		{name: "glob matching directories with recursion",
+			paths:     []string{"docs/g*"},
+			recursive: true,
+			out:       []string{"docs/guide/d.md"}},
+		{name: "glob with no matches",
+			paths: []string{"*.rst"},
+			err:   "error: no files match *.rst"},
+		{name: "bad pattern",
+			paths: []string{"[a.md"},
+			err:   `error: bad pattern "[a.md": syntax error in pattern`},
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tc {
+		var want []string
+		for _, path := range tt.out {
+			want = append(want, filepath.FromSlash(path))
+		}
+		got, err := expandPaths(tt.paths, tt.recursive)
+		if !eqErr(t, tt.name, err, tt.err) {
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("case [%s]: expected paths %v; got %v", tt.name, want, got)
+		}
+	}
+}
+
+func TestIgnoreList(t *testing.T) {
+	l := parseIgnoreList("# generated\n" +
+		"\n" +
+		"api/\n" +
+		"!api/index.md\n" +
+		"/CHANGELOG.md\n" +
+		"draft-*.md  \n" +
+		"vendor/**/*.md\n" +
+		"notes.md/\n")
+
+	tc := []struct {
+		path    string
+		ignored bool
+	}{
+		{"README.md", false},
+		{"api/types.md", true},
+		{"docs/api/types.md", true},
+		{"docs/api/v1/types.md", true},
+		{"api.md", false},
+		{"api/index.md", false},
+		{"docs/api/index.md", true},
+		{"CHANGELOG.md", true},
+		{"./CHANGELOG.md", true},
+		{"docs/CHANGELOG.md", false},
+		{"draft-intro.md", true},
+		{"docs/guide/draft-intro.md", true},
+		{"vendor/README.md", true},
+		{"vendor/pkg/docs/a.md", true},
+		{"docs/vendor/README.md", false},
+		{"notes.md", false},
+		{"notes.md/a.md", true},
+		{"../api/types.md", false},
+	}
+	for _, tt := range tc {
+		if got := l.ignored(filepath.FromSlash(tt.path)); got != tt.ignored {
+			t.Errorf("case [%s]: expected ignored %v; got %v", tt.path, tt.ignored, got)
+		}
+	}
+
+	if l := parseIgnoreList("# nothing\n\n"); l.ignored("README.md") {
+		t.Errorf("expected nothing to be ignored by an empty list")
+	}
+}
+
+func TestEmbedIgnoredFiles(t *testing.T) {
+	defer func(f func(string) (file, error)) { openFile = f }(openFile)
+	defer func(w io.Writer) { stdout = w }(stdout)
+	openFile = newOpenFunc(map[string]string{"docs/a.md": "a\n"})
+	var out bytes.Buffer
+	stdout = &out
+
+	cfg := config{ignore: parseIgnoreList("gen/\n")}
+	if _, err := embed([]string{"gen/missing.md", "docs/a.md"}, cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := out.String(); got != "a\n" {
+		t.Errorf("expected output %q; got %q", "a\n", got)
+	}
+}
+
+func TestAliasesFlag(t *testing.T) {
+	a := make(aliases)
+	for _, s := range []string{"yml=yaml", "mmd=mermaid", "yml=yaml2"} {
+		if err := a.Set(s); err != nil {
+			t.Fatalf("could not set %q: %v", s, err)
+		}
+	}
+	if got, want := fmt.Sprint(map[string]string(a)), "map[mmd:mermaid yml:yaml2]"; got != want {
+		t.Errorf("expected aliases %s; got %s", want, got)
+	}
+	for _, s := range []string{"yml", "=yaml", "yml="} {
+		if err := a.Set(s); err == nil {
+			t.Errorf("expected an error setting %q", s)
+		}
+	}
+}
+
+func TestWidthsFlag(t *testing.T) {
+	w := make(widths)
+	for _, s := range []string{"go=100", "python=79", "go=120"} {
+		if err := w.Set(s); err != nil {
+			t.Fatalf("could not set %q: %v", s, err)
+		}
+	}
+	if got, want := fmt.Sprint(map[string]int(w)), "map[go:120 python:79]"; got != want {
+		t.Errorf("expected widths %s; got %s", want, got)
+	}
+	for _, s := range []string{"go", "=100", "go=", "go=wide", "go=0"} {
+		if err := w.Set(s); err == nil {
+			t.Errorf("expected an error setting %q", s)
+		}
+	}
+}
+
+func TestHeadersFlag(t *testing.T) {
+	h := make(headers)
+	for _, s := range []string{"Authorization: token $TOKEN", "X-Team:docs"} {
+		if err := h.Set(s); err != nil {
+			t.Fatalf("could not set %q: %v", s, err)
+		}
+	}
+	if got, want := len(h.options()), 2; got != want {
+		t.Errorf("expected %d options; got %d", want, got)
+	}
+	if got, want := http.Header(h).Get("Authorization"), "token $TOKEN"; got != want {
+		t.Errorf("expected Authorization %q; got %q", want, got)
+	}
+	if got, want := http.Header(h).Get("X-Team"), "docs"; got != want {
+		t.Errorf("expected X-Team %q; got %q", want, got)
+	}
+	for _, s := range []string{"Authorization", ": token", "Bad Key : value"} {
+		if err := h.Set(s); err == nil {
+			t.Errorf("expected an error setting %q", s)
+		}
+	}
+}
+
+func TestPatternsFlag(t *testing.T) {
+	var p patterns
+	for _, s := range []string{`token=\w+`, `secret`} {
+		if err := p.Set(s); err != nil {
+			t.Fatalf("could not set %q: %v", s, err)
+		}
+	}
+	if got, want := p.String(), `token=\w+,secret`; got != want {
+		t.Errorf("expected patterns %s; got %s", want, got)
+	}
+	if err := p.Set("(unclosed"); err == nil {
+		t.Errorf("expected an error setting %q", "(unclosed")
+	}
+}
+
+func TestStats(t *testing.T) {
+	defer func(r io.Reader, w io.Writer) { stdin, stdout = r, w }(stdin, stdout)
+	stdin = strings.NewReader("[embedmd]:# (sample/hello.go)\n[embedmd]:# (sample/hello.go /package.*/)\n")
+	stdout = ioutil.Discard
+
+	cfg := config{stats: new(embedmd.Stats)}
+	if _, err := embed(nil, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	tc := []struct{ format, out string }{
+		{"text", "commands: 2 (1 regexp, 1 whole file, 0 line range)\nsources: 2 local, 0 url\nembedded lines: 15\n"},
+		{"json", `{"commands":2,"regexp":1,"wholeFile":1,"lineRange":0,"url":0,"local":2,"lines":15}` + "\n"},
+	}
+	for _, tt := range tc {
+		var buf bytes.Buffer
+		printStats(&buf, tt.format, cfg.stats)
+		if got := buf.String(); got != tt.out {
+			t.Errorf("case [%s]: expected stats %q; got %q", tt.format, tt.out, got)
+		}
+	}
+}
+
 func eqErr(t *testing.T, id string, err error, msg string) bool {
 	if err == nil && msg == "" {
 		return true
@@ -142,8 +1101,11 @@ type fakeFile struct {
 	buf bytes.Buffer
 }
 
-func (f *fakeFile) WriteAt(b []byte, offset int64) (int, error) { return f.buf.Write(b) }
-func (f *fakeFile) Truncate(int64) error                        { return nil }
+func (f *fakeFile) Replace(b []byte) error {
+	f.buf.Reset()
+	_, err := f.buf.Write(b)
+	return err
+}
 
 func newFakeFile(s string) *fakeFile {
 	return &fakeFile{ReadCloser: ioutil.NopCloser(strings.NewReader(s))}